@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+const minPasswordLen = 8
+
+// reauthWindow is how recently a user without a local password must have
+// signed in through their provider to confirm a change without a code.
+const reauthWindow = 10 * time.Minute
+
+func jsonError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// changePasswordHandler sets a new password and signs the user out
+// everywhere else: other sessions end and API tokens are revoked.
+func changePasswordHandler(users *store.UserStore, sessions *store.SessionStore, tokens *store.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userID := store.UserIDFromContext(r.Context())
+		if userID == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			CurrentPassword string `json:"currentPassword"`
+			NewPassword     string `json:"newPassword"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if len(body.NewPassword) < minPasswordLen {
+			jsonError(w, http.StatusBadRequest, "password must be at least 8 characters long")
+			return
+		}
+		if err := users.ChangePassword(userID, body.CurrentPassword, body.NewPassword); err != nil {
+			if err == store.ErrInvalidCredentials {
+				jsonError(w, http.StatusForbidden, "current password is incorrect")
+				return
+			}
+			slog.ErrorContext(r.Context(), "change password", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		var current string
+		if c, err := r.Cookie(store.SessionCookieName); err == nil {
+			current = c.Value
+		}
+		revokeCredentials(r, sessions, tokens, userID, current)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func resetPageHandler(w http.ResponseWriter, r *http.Request) {
+	ui.render(w, r, "reset.html", nil)
+}
+
+func resetHandler(users *store.UserStore, sessions *store.SessionStore, resets *store.ResetStore, tokens *store.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			resetPageHandler(w, r)
+			return
+		case http.MethodPost:
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		// Validate before consuming so a typo doesn't burn the token.
+		if len(body.Password) < minPasswordLen {
+			jsonError(w, http.StatusBadRequest, "password must be at least 8 characters long")
+			return
+		}
+		userID, err := resets.Consume(body.Token)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "reset link is invalid or has expired")
+			return
+		}
+		if err := users.SetPassword(userID, body.Password); err != nil {
+			if err == store.ErrUserNotFound {
+				jsonError(w, http.StatusBadRequest, "reset link is invalid or has expired")
+				return
+			}
+			slog.ErrorContext(r.Context(), "reset password", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		revokeCredentials(r, sessions, tokens, userID, "")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// revokeCredentials ends the user's sessions except keep, and revokes their
+// API tokens, after the password changed. Failures are logged: the new
+// password is already in place.
+func revokeCredentials(r *http.Request, sessions *store.SessionStore, tokens *store.TokenStore, userID, keep string) {
+	n, err := sessions.DeleteForUserExcept(userID, keep)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "revoke sessions", "err", err)
+	}
+	m, err := tokens.DeleteForUser(userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "revoke API tokens", "err", err)
+	}
+	slog.InfoContext(r.Context(), "password changed", "user", userID, "sessions_revoked", n, "tokens_revoked", m)
+}
+
+// purgeSummary describes what purgeUser removed.
+type purgeSummary struct {
+	Username string
+	Sessions int
+	Tokens   int
+	Resets   int
+	Chats    int
+	Archive  string
+}
+
+// purgeUser deletes a user account together with its sessions, API tokens,
+// reset tokens and chats. With archive set, chats are moved under
+// data/archive instead.
+func purgeUser(users *store.UserStore, sessions *store.SessionStore, chats *store.ChatStore, resets *store.ResetStore, tokens *store.TokenStore, usage *store.UsageStore, userID string, archive bool) (purgeSummary, error) {
+	var sum purgeSummary
+	u := users.ByID(userID)
+	if u == nil {
+		return sum, store.ErrUserNotFound
+	}
+	sum.Username = u.Username
+	if err := users.Delete(userID); err != nil {
+		return sum, err
+	}
+	var err error
+	if sum.Sessions, err = sessions.DeleteForUser(userID); err != nil {
+		return sum, err
+	}
+	if sum.Tokens, err = tokens.DeleteForUser(userID); err != nil {
+		return sum, err
+	}
+	if sum.Resets, err = resets.DeleteForUser(userID); err != nil {
+		return sum, err
+	}
+	if err := usage.DeleteForUser(userID); err != nil {
+		return sum, err
+	}
+	if archive {
+		sum.Chats, sum.Archive, err = chats.ArchiveUser(userID, filepath.Join(*data, "archive"))
+	} else {
+		sum.Chats, err = chats.DeleteUser(userID)
+	}
+	return sum, err
+}
+
+// confirmIdentity checks that a request to delete the account or turn off
+// two-factor authentication comes from the account holder and not just from
+// someone holding their session. Local accounts give their password. SSO
+// and LDAP accounts have none here, so they give a current code if 2FA is
+// on, and must otherwise have signed in within reauthWindow. On failure it
+// writes the response and returns false.
+func confirmIdentity(w http.ResponseWriter, r *http.Request, users *store.UserStore, sessions *store.SessionStore, throttle *store.LoginThrottle, u *store.User, password, code string) bool {
+	if u.Source == "" {
+		if err := users.CheckPassword(u.ID, password); err != nil {
+			jsonError(w, http.StatusForbidden, "password is incorrect")
+			return false
+		}
+		return true
+	}
+	if users.HasTOTP(u.ID) {
+		key := "2fa:" + u.ID
+		if wait := throttle.Reserve(key); wait > 0 {
+			jsonError(w, http.StatusTooManyRequests, "too many failed attempts, try again later")
+			return false
+		}
+		if err := users.VerifySecondFactor(u.ID, code); err != nil {
+			if err != store.ErrInvalidCode {
+				throttle.Refund(key)
+				slog.ErrorContext(r.Context(), "verify 2fa", "err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return false
+			}
+			jsonError(w, http.StatusForbidden, "authentication code is incorrect")
+			return false
+		}
+		throttle.Succeed(key)
+		return true
+	}
+	var signedIn time.Time
+	if c, err := r.Cookie(store.SessionCookieName); err == nil {
+		signedIn, _ = sessions.SignedInAt(c.Value)
+	}
+	if time.Since(signedIn) > reauthWindow {
+		jsonError(w, http.StatusForbidden, "sign in again to confirm, then retry within 10 minutes")
+		return false
+	}
+	return true
+}
+
+func deleteAccountHandler(users *store.UserStore, sessions *store.SessionStore, chats *store.ChatStore, resets *store.ResetStore, tokens *store.TokenStore, usage *store.UsageStore, throttle *store.LoginThrottle) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userID := store.UserIDFromContext(r.Context())
+		u := users.ByID(userID)
+		if u == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+		}
+		if !confirmIdentity(w, r, users, sessions, throttle, u, body.Password, body.Code) {
+			return
+		}
+		sum, err := purgeUser(users, sessions, chats, resets, tokens, usage, userID, false)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "delete account", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "deleted account", "username", sum.Username, "sessions", sum.Sessions, "chats", sum.Chats)
+		clearSessionCookie(w, r)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+func TestChangePasswordRevokesOtherCredentials(t *testing.T) {
+	dir := t.TempDir()
+	users, err := store.NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := store.NewSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := store.NewTokenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := users.Register("alice@example.com", "old password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := sessions.Create(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := sessions.Create(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secret, err := tokens.Create(u.ID, "script", []string{"read"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := store.RequireAuth(users, sessions, tokens, changePasswordHandler(users, sessions, tokens))
+	req := httptest.NewRequest(http.MethodPost, "/account/password", strings.NewReader(`{"currentPassword":"old password","newPassword":"new password"}`))
+	req.AddCookie(&http.Cookie{Name: store.SessionCookieName, Value: current})
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if _, ok := sessions.Get(current); !ok {
+		t.Error("the session that changed the password was ended")
+	}
+	if _, ok := sessions.Get(other); ok {
+		t.Error("other session still valid")
+	}
+	if _, ok := tokens.Lookup(secret); ok {
+		t.Error("API token still valid")
+	}
+}
+
+func TestDeleteAccountConfirmation(t *testing.T) {
+	dir := t.TempDir()
+	users, err := store.NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := store.NewSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := store.NewTokenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chats, err := store.NewChatStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resets, err := store.NewResetStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := store.NewUsageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := store.RequireAuth(users, sessions, tokens, deleteAccountHandler(users, sessions, chats, resets, tokens, usage, store.NewLoginThrottle()))
+	del := func(session, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodDelete, "/account", strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: store.SessionCookieName, Value: session})
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+	signIn := func(userID string) string {
+		t.Helper()
+		id, err := sessions.Create(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	// A local account confirms with its password.
+	local, err := users.Register("alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid := signIn(local.ID)
+	if rec := del(sid, `{"password":"wrong"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("local, wrong password: status %d", rec.Code)
+	}
+	if rec := del(sid, `{"password":"correct horse battery"}`); rec.Code != http.StatusNoContent {
+		t.Errorf("local, right password: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// An SSO account without 2FA needs a recent sign-in.
+	sso, _, err := users.External("bob@example.com", "oidc", "sub-bob", true, store.LinkNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid = signIn(sso.ID)
+	ageSession(t, dir, sid, time.Hour)
+	if rec := del(sid, `{"password":""}`); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "sign in again") {
+		t.Errorf("SSO, old session: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := del(signIn(sso.ID), ""); rec.Code != http.StatusNoContent {
+		t.Errorf("SSO, fresh session: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// An LDAP account with 2FA needs a code, however recent the sign-in.
+	ldap, _, err := users.External("carol@example.com", "ldap", "uid=carol", true, store.LinkNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := users.BeginTOTP(ldap.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.ConfirmTOTP(ldap.ID, totp(t, secret, time.Now().Add(-30*time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	sid = signIn(ldap.ID)
+	if rec := del(sid, `{"password":"anything"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("LDAP, no code: status %d", rec.Code)
+	}
+	if rec := del(sid, `{"code":"`+totp(t, secret, time.Now())+`"}`); rec.Code != http.StatusNoContent {
+		t.Errorf("LDAP, right code: status %d: %s", rec.Code, rec.Body)
+	}
+
+	for _, name := range []string{"alice@example.com", "bob@example.com", "carol@example.com"} {
+		if users.ByUsername(name) != nil {
+			t.Errorf("%s was not deleted", name)
+		}
+	}
+}
+
+// ageSession moves the sign-in time of a stored session back by d.
+func ageSession(t *testing.T, dir, id string, d time.Duration) {
+	t.Helper()
+	p := filepath.Join(dir, "sessions", id+".json")
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ent map[string]any
+	if err := json.Unmarshal(data, &ent); err != nil {
+		t.Fatal(err)
+	}
+	ent["createdAt"] = time.Now().Add(-d)
+	if data, err = json.Marshal(ent); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	defer func(w, p, c string, s bool) { *web, *publicURL, *tlsCert, *tlsSelfSigned = w, p, c, s }(*web, *publicURL, *tlsCert, *tlsSelfSigned)
+	for _, tc := range []struct {
+		web, public string
+		tls         bool
+		want        string
+	}{
+		{"localhost:8080", "", false, "http://localhost:8080"},
+		{"localhost:8080", "", true, "https://localhost:8080"},
+		{"0.0.0.0:443", "", true, "https://localhost"},
+		{":8080", "", false, "http://localhost:8080"},
+		{"[::]:80", "", false, "http://localhost"},
+		{"[::1]:443", "", true, "https://[::1]"},
+		{"0.0.0.0:8080", "https://chat.example.com/", false, "https://chat.example.com"},
+		{"0.0.0.0:8080", "https://example.com/chat", false, "https://example.com/chat"},
+	} {
+		*web, *publicURL, *tlsCert, *tlsSelfSigned = tc.web, tc.public, "", tc.tls
+		if got := baseURL(); got != tc.want {
+			t.Errorf("-web %s -public-url %q tls %v: %s, want %s", tc.web, tc.public, tc.tls, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// adminUser is the admin view of a store.User; it never includes the hash.
+type adminUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
+	TwoFA    bool   `json:"twoFactor"`
+	Chats    int    `json:"chats"`
+	Bytes    int64  `json:"bytes"`
+}
+
+func newAdminUser(u store.User, chats *store.ChatStore) adminUser {
+	au := adminUser{
+		ID:       u.ID,
+		Username: u.Username,
+		Role:     u.Role,
+		Disabled: u.Disabled,
+		TwoFA:    u.TOTPSecret != "",
+	}
+	n, size, err := chats.Usage(u.ID)
+	if err != nil {
+		slog.Error("chat usage", "err", err)
+	}
+	au.Chats, au.Bytes = n, size
+	return au
+}
+
+// adminUsersHandler serves /admin/users and /admin/users/{id}[/action].
+func adminUsersHandler(users *store.UserStore, sessions *store.SessionStore, chats *store.ChatStore, resets *store.ResetStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		if path == "/admin/users" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			list := users.List()
+			result := make([]adminUser, len(list))
+			for i := range list {
+				result[i] = newAdminUser(list[i], chats)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"users": result})
+			return
+		}
+		rest := strings.TrimPrefix(path, "/admin/users/")
+		if rest == path || rest == "" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		userID, action, _ := strings.Cut(rest, "/")
+		u := users.ByID(userID)
+		if u == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if action == "" || action == "usage" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(newAdminUser(*u, chats))
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		self := store.UserIDFromContext(r.Context()) == userID
+		switch action {
+		case "disable", "enable":
+			if self && action == "disable" {
+				jsonError(w, http.StatusBadRequest, "you cannot disable your own account")
+				return
+			}
+			if err := users.SetDisabled(userID, action == "disable"); err != nil {
+				slog.ErrorContext(r.Context(), "admin set disabled", "err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if action == "disable" {
+				if _, err := sessions.DeleteForUser(userID); err != nil {
+					slog.ErrorContext(r.Context(), "admin revoke sessions", "err", err)
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "role":
+			var body struct {
+				Role string `json:"role"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			if self && body.Role != store.RoleAdmin {
+				jsonError(w, http.StatusBadRequest, "you cannot remove your own admin role")
+				return
+			}
+			if err := users.SetRole(userID, body.Role); err != nil {
+				if err == store.ErrInvalidRole {
+					jsonError(w, http.StatusBadRequest, "role must be \"admin\" or \"user\"")
+					return
+				}
+				slog.ErrorContext(r.Context(), "admin set role", "err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "reset-2fa":
+			// For users who lost both their device and their recovery codes.
+			if err := users.DisableTOTP(userID); err != nil {
+				slog.ErrorContext(r.Context(), "admin reset 2fa", "err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "logout":
+			n, err := sessions.DeleteForUser(userID)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "admin logout", "err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int{"sessions": n})
+		case "reset-password":
+			token, err := resets.Issue(userID, store.ResetTokenDuration)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "admin reset token", "err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"url":       "/reset?token=" + url.QueryEscape(token),
+				"expiresIn": store.ResetTokenDuration.String(),
+			})
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// Backup archives are gzip-compressed tar files. The first entry is
+// manifest.json, listing every file that follows with its size and SHA-256.
+const (
+	backupFormat  = "chatlocal-backup"
+	backupVersion = 1
+	manifestName  = "manifest.json"
+)
+
+// snapshotWait bounds how long a backup waits for writes to pause.
+const snapshotWait = 30 * time.Second
+
+type backupManifest struct {
+	Format      string       `json:"format"`
+	Version     int          `json:"version"`
+	Created     time.Time    `json:"created"`
+	DataVersion int          `json:"dataVersion"` // layout of the data directory
+	Sessions    bool         `json:"sessions"`
+	Files       []backupFile `json:"files"`
+}
+
+type backupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// writeBackup writes a snapshot of dataDir to w as a backup archive. Login
+// sessions are only included when sessions is set; password reset tokens
+// never are.
+func writeBackup(w io.Writer, dataDir string, sessions bool) (*backupManifest, error) {
+	keep := func(rel string) bool {
+		top, _, _ := strings.Cut(rel, "/")
+		return top != "resets" && (sessions || top != "sessions")
+	}
+	dir, paths, err := store.Snapshot(dataDir, keep, snapshotWait)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	m := &backupManifest{Format: backupFormat, Version: backupVersion, Created: time.Now().UTC(), Sessions: sessions, Files: []backupFile{}}
+	if m.DataVersion, err = store.ReadDataVersion(dir); err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(p)))
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, backupFile{Path: p, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))})
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	add := func(name string, size int64, r io.Reader) error {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: size, ModTime: m.Created, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}
+	if err := add(manifestName, int64(len(manifest)), bytes.NewReader(manifest)); err != nil {
+		return nil, err
+	}
+	for _, bf := range m.Files {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(bf.Path)))
+		if err != nil {
+			return nil, err
+		}
+		// The snapshot cannot change, so the size still matches.
+		err = add(bf.Path, bf.Size, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return m, gz.Close()
+}
+
+// readBackup reads a backup archive, checking it against its manifest,
+// and calls fn, when not nil, with each file. It fails on anything
+// unexpected: a newer format or data layout, files missing from the
+// manifest or the archive, and wrong sizes or checksums. fn may already
+// have been called for some files when it does.
+func readBackup(r io.Reader, fn func(f backupFile, data []byte) error) (*backupManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != manifestName {
+		return nil, errors.New("not a backup archive: no manifest")
+	}
+	var m backupManifest
+	if err := json.NewDecoder(io.LimitReader(tr, 64<<20)).Decode(&m); err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	if m.Format != backupFormat {
+		return nil, errors.New("not a backup archive: unknown format")
+	}
+	if m.Version > backupVersion {
+		return nil, fmt.Errorf("the archive has format version %d, made by a newer chatlocal; this one reads up to %d", m.Version, backupVersion)
+	}
+	if m.DataVersion > store.DataVersion {
+		return nil, fmt.Errorf("the archive has data layout %d, made by a newer chatlocal; this one knows layout %d", m.DataVersion, store.DataVersion)
+	}
+	want := make(map[string]backupFile, len(m.Files))
+	for _, f := range m.Files {
+		if !fs.ValidPath(f.Path) || f.Path == "." || f.Path == manifestName {
+			return nil, fmt.Errorf("manifest: bad path %q", f.Path)
+		}
+		want[f.Path] = f
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &m, err
+		}
+		f, ok := want[hdr.Name]
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			return &m, fmt.Errorf("%s: not in the manifest", hdr.Name)
+		}
+		delete(want, hdr.Name)
+		data, err := io.ReadAll(io.LimitReader(tr, f.Size+1))
+		if err != nil {
+			return &m, fmt.Errorf("%s: %w", f.Path, err)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != f.Size || hex.EncodeToString(sum[:]) != f.SHA256 {
+			return &m, fmt.Errorf("%s: checksum mismatch; the archive is damaged", f.Path)
+		}
+		if fn != nil {
+			if err := fn(f, data); err != nil {
+				return &m, err
+			}
+		}
+	}
+	if len(want) > 0 {
+		return &m, fmt.Errorf("%d files of the manifest are missing from the archive; it may be truncated", len(want))
+	}
+	return &m, nil
+}
+
+func cmdBackup(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := fs.String("o", "", "Archive to write, or - for standard output (default chatlocal-backup-<time>.tar.gz)")
+	sessions := fs.Bool("sessions", false, "Include login sessions, so users stay logged in after a restore")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: chatlocal [flags] backup [-sessions] [-o file]")
+		return 2
+	}
+	name := *out
+	if name == "" {
+		name = "chatlocal-backup-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	}
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if name != "-" {
+		var err error
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "backup:", err)
+			return 1
+		}
+		w = f
+	}
+	m, err := writeBackup(w, *data, *sessions)
+	if f != nil {
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(name)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "backup:", err)
+		return 1
+	}
+	if name != "-" {
+		fmt.Printf("Backed up %d files of %s to %s\n", len(m.Files), *data, name)
+	}
+	return 0
+}
+
+// cmdRestore restores a whole backup into an empty data directory with
+// the server stopped, or one user's chats at any time.
+func cmdRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	user := fs.String("user", "", "Only put back the chats of this user, leaving other data alone")
+	check := fs.Bool("check", false, "Only check the archive")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: chatlocal [flags] restore [-check] [-user <email>] <archive>")
+		return 2
+	}
+	archive := fs.Arg(0)
+	m, err := verifyBackup(archive, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", archive, err)
+		return 1
+	}
+	if *check {
+		fmt.Printf("%s is intact: %d files, data layout %d, made %s", archive, len(m.Files), m.DataVersion, m.Created.Local().Format(time.DateTime))
+		if m.Sessions {
+			fmt.Print(", with sessions")
+		}
+		fmt.Println()
+		return 0
+	}
+	if *user != "" {
+		return restoreUserChats(archive, *user)
+	}
+	return exclusive("restore", func([]string) int { return restoreAll(archive, m) })(nil)
+}
+
+// verifyBackup checks the archive at name, calling fn as readBackup does.
+func verifyBackup(name string, fn func(f backupFile, data []byte) error) (*backupManifest, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readBackup(f, fn)
+}
+
+// restoreAll writes every file of a checked archive into the data
+// directory, which must be empty.
+func restoreAll(archive string, m *backupManifest) int {
+	entries, err := os.ReadDir(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore:", err)
+		return 1
+	}
+	for _, e := range entries {
+		if e.Name() != store.LockFile && e.Name() != store.SnapshotLockFile {
+			fmt.Fprintf(os.Stderr, "restore: %s is not empty; move it away first, or restore into a new directory with -data\n", *data)
+			return 1
+		}
+	}
+	_, err = verifyBackup(archive, func(f backupFile, b []byte) error {
+		p := filepath.Join(*data, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return err
+		}
+		return os.WriteFile(p, b, 0600)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore:", err)
+		return 1
+	}
+	fmt.Printf("Restored %d files into %s from the backup of %s\n", len(m.Files), *data, m.Created.Local().Format(time.DateTime))
+	if !m.Sessions {
+		fmt.Println("The backup has no sessions, so everyone has to log in again.")
+	}
+	if m.DataVersion < store.DataVersion {
+		fmt.Printf("The backup has data layout %d; run migrate before starting the server.\n", m.DataVersion)
+	}
+	return 0
+}
+
+// restoreUserChats puts back the chats a user had in the archive, matching
+// the user by email, so it also works for an account that was deleted and
+// registered again. Chats that exist are left alone. It only adds chat
+// files, so it is safe while the server runs.
+func restoreUserChats(archive, email string) int {
+	_, u, ok := lookupUser(email)
+	if !ok {
+		return 1
+	}
+	chats, err := store.NewChatStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "chat store:", err)
+		return 1
+	}
+	var oldID string
+	_, err = verifyBackup(archive, func(f backupFile, b []byte) error {
+		if f.Path != "users.json" {
+			return nil
+		}
+		var users []store.User
+		if err := json.Unmarshal(b, &users); err != nil {
+			return fmt.Errorf("users.json: %w", err)
+		}
+		for _, bu := range users {
+			if bu.Username == u.Username {
+				oldID = bu.ID
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore:", err)
+		return 1
+	}
+	if oldID == "" {
+		fmt.Fprintf(os.Stderr, "restore: the backup has no user %q\n", u.Username)
+		return 1
+	}
+	prefix := "chats/" + oldID + "/"
+	restored, skipped := 0, make(map[string]bool)
+	_, err = verifyBackup(archive, func(f backupFile, b []byte) error {
+		name, ok := strings.CutPrefix(f.Path, prefix)
+		if !ok {
+			return nil
+		}
+		chatID, _, _ := strings.Cut(name, ".")
+		if skipped[chatID] {
+			return nil // keep the title of a chat that was left alone
+		}
+		done, err := chats.RestoreFile(u.ID, name, b)
+		if err != nil {
+			return err
+		}
+		// {chatID}.json.gz comes before {chatID}.meta.json.
+		if strings.HasSuffix(name, ".json.gz") {
+			if done {
+				restored++
+			} else {
+				skipped[chatID] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore:", err)
+		return 1
+	}
+	fmt.Printf("Restored %d chats of %s; %d already there were left alone\n", restored, u.Username, len(skipped))
+	return 0
+}
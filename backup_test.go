@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// useDataDir points -data at dir until t ends.
+func useDataDir(t *testing.T, dir string) {
+	old := *data
+	*data = dir
+	t.Cleanup(func() { *data = old })
+}
+
+// backupSource fills a data directory with a user who has two chats, a
+// session and a reset token, and returns it with the chat IDs.
+func backupSource(t *testing.T) (dir string, chatA, chatB string) {
+	t.Helper()
+	dir = t.TempDir()
+	users, err := store.NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := users.Register("alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chats, err := store.NewChatStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := func(text string) []store.ChatMessage {
+		return []store.ChatMessage{{Sender: "Me", Text: text, Type: "sent"}}
+	}
+	if chatA, err = chats.Import(u.ID, "First", msg("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if chatB, err = chats.Import(u.ID, "Second", msg("again")); err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := store.NewSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessions.Create(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	resets, err := store.NewResetStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resets.Issue(u.ID, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	return dir, chatA, chatB
+}
+
+// backupFileOf writes a backup of dir to a file and returns its name.
+func backupFileOf(t *testing.T, dir string, sessions bool) string {
+	t.Helper()
+	var b bytes.Buffer
+	if _, err := writeBackup(&b, dir, sessions); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(name, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	src, chatA, chatB := backupSource(t)
+	for _, sessions := range []bool{false, true} {
+		archive := backupFileOf(t, src, sessions)
+		dst := filepath.Join(t.TempDir(), "restored")
+		useDataDir(t, dst)
+		if code := cmdRestore([]string{archive}); code != 0 {
+			t.Fatalf("restore exited with %d", code)
+		}
+
+		for _, name := range []string{"users.json", "VERSION"} {
+			want, _ := os.ReadFile(filepath.Join(src, name))
+			if got, err := os.ReadFile(filepath.Join(dst, name)); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%s differs after restore: %v", name, err)
+			}
+		}
+		users, err := store.NewUserStore(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := users.ByUsername("alice@example.com")
+		if u == nil {
+			t.Fatal("user missing after restore")
+		}
+		chats, err := store.NewChatStore(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list, err := chats.ListWithTitles(u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, c := range list {
+			titles = append(titles, c.Title)
+		}
+		slices.Sort(titles)
+		if !slices.Equal(titles, []string{"First", "Second"}) {
+			t.Errorf("restored chats %q", titles)
+		}
+		for id, text := range map[string]string{chatA: "hello", chatB: "again"} {
+			if msgs, err := chats.Get(u.ID, id); err != nil || len(msgs) != 1 || msgs[0].Text != text {
+				t.Errorf("chat %s: %+v, %v", id, msgs, err)
+			}
+		}
+
+		if entries, _ := os.ReadDir(filepath.Join(dst, "resets")); len(entries) != 0 {
+			t.Error("reset tokens were backed up")
+		}
+		entries, _ := os.ReadDir(filepath.Join(dst, "sessions"))
+		if sessions != (len(entries) == 1) {
+			t.Errorf("with -sessions=%v, %d sessions restored", sessions, len(entries))
+		}
+	}
+}
+
+// rewriteArchive returns archive with each entry passed through fn, which
+// returns the new content, or false to drop the entry.
+func rewriteArchive(t *testing.T, archive []byte, fn func(name string, data []byte) ([]byte, bool)) []byte {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var out bytes.Buffer
+	gw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, ok := fn(hdr.Name, b)
+		if !ok {
+			continue
+		}
+		hdr.Size = int64(len(b))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(b)
+	}
+	tw.Close()
+	gw.Close()
+	return out.Bytes()
+}
+
+func TestReadBackupRejectsDamage(t *testing.T) {
+	src, _, _ := backupSource(t)
+	var b bytes.Buffer
+	if _, err := writeBackup(&b, src, false); err != nil {
+		t.Fatal(err)
+	}
+	good := b.Bytes()
+	if _, err := readBackup(bytes.NewReader(good), nil); err != nil {
+		t.Fatalf("intact archive: %v", err)
+	}
+	editManifest := func(edit func(m *backupManifest)) []byte {
+		return rewriteArchive(t, good, func(name string, data []byte) ([]byte, bool) {
+			if name != manifestName {
+				return data, true
+			}
+			var m backupManifest
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatal(err)
+			}
+			edit(&m)
+			data, _ = json.Marshal(m)
+			return data, true
+		})
+	}
+
+	for _, tc := range []struct {
+		name    string
+		archive []byte
+		err     string // substring of the error
+	}{
+		{"not gzip", []byte("users.json"), "not a backup archive"},
+		{"cut short", good[:len(good)-100], "unexpected EOF"},
+		{"changed file", rewriteArchive(t, good, func(name string, data []byte) ([]byte, bool) {
+			if name == "users.json" {
+				data = bytes.Replace(data, []byte("alice"), []byte("mallo"), 1)
+			}
+			return data, true
+		}), "users.json: checksum mismatch"},
+		{"missing file", rewriteArchive(t, good, func(name string, data []byte) ([]byte, bool) {
+			return data, name != "users.json"
+		}), "may be truncated"},
+		{"file not in the manifest", editManifest(func(m *backupManifest) {
+			m.Files = slices.DeleteFunc(m.Files, func(f backupFile) bool { return f.Path == "users.json" })
+		}), "users.json: not in the manifest"},
+		{"no manifest", rewriteArchive(t, good, func(name string, data []byte) ([]byte, bool) {
+			return data, name != manifestName
+		}), "no manifest"},
+		{"newer format", editManifest(func(m *backupManifest) { m.Version = backupVersion + 1 }), "newer chatlocal"},
+		{"newer layout", editManifest(func(m *backupManifest) { m.DataVersion = store.DataVersion + 1 }), "newer chatlocal"},
+		{"path outside", editManifest(func(m *backupManifest) { m.Files[0].Path = "../users.json" }), "bad path"},
+	} {
+		_, err := readBackup(bytes.NewReader(tc.archive), nil)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestRestoreRefusesNonEmptyDirectory(t *testing.T) {
+	src, _, _ := backupSource(t)
+	archive := backupFileOf(t, src, false)
+	dst := t.TempDir()
+	users := filepath.Join(dst, "users.json")
+	if err := os.WriteFile(users, []byte("[]"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	useDataDir(t, dst)
+	if code := cmdRestore([]string{archive}); code != 1 {
+		t.Errorf("restore into a non-empty directory exited with %d", code)
+	}
+	if b, _ := os.ReadFile(users); string(b) != "[]" {
+		t.Errorf("users.json was overwritten: %s", b)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "chats")); err == nil {
+		t.Error("chats were restored")
+	}
+}
+
+func TestRestoreUserChats(t *testing.T) {
+	dir, chatA, chatB := backupSource(t)
+	archive := backupFileOf(t, dir, false)
+	useDataDir(t, dir)
+	users, err := store.NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chats, err := store.NewChatStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := users.ByUsername("alice@example.com")
+
+	// One chat was deleted since the backup, the other has moved on.
+	if err := chats.Delete(alice.ID, chatB); err != nil {
+		t.Fatal(err)
+	}
+	if err := chats.Append(alice.ID, chatA, store.ChatMessage{Sender: "Me", Text: "newer", Type: "sent"}); err != nil {
+		t.Fatal(err)
+	}
+	if code := cmdRestore([]string{"-user", "alice@example.com", archive}); code != 0 {
+		t.Fatalf("restore -user exited with %d", code)
+	}
+	if msgs, err := chats.Get(alice.ID, chatB); err != nil || len(msgs) != 1 || msgs[0].Text != "again" {
+		t.Errorf("deleted chat: %+v, %v", msgs, err)
+	}
+	if msgs, err := chats.Get(alice.ID, chatA); err != nil || len(msgs) != 2 {
+		t.Errorf("existing chat was replaced: %+v, %v", msgs, err)
+	}
+
+	// The account was deleted and registered again, with a new ID.
+	if err := users.Delete(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	again, err := users.Register("alice@example.com", "another password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := cmdRestore([]string{"-user", "alice@example.com", archive}); code != 0 {
+		t.Fatalf("restore -user after re-registering exited with %d", code)
+	}
+	if list, err := chats.List(again.ID); err != nil || len(list) != 2 {
+		t.Errorf("chats of the new account: %v, %v", list, err)
+	}
+
+	if code := cmdRestore([]string{"-user", "bob@example.com", archive}); code != 1 {
+		t.Errorf("restore -user of an unknown user exited with %d", code)
+	}
+}
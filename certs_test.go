@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSelfSignedCert(t *testing.T) {
+	// load makes or reuses the certificate in dir and parses it.
+	load := func(dir, listen string) (certFile string, cert *x509.Certificate) {
+		t.Helper()
+		certFile, keyFile, err := selfSignedCert(dir, listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("key file: %v, %v", info.Mode(), err)
+		}
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			t.Fatal(err)
+		}
+		return certFile, cert
+	}
+
+	dir := t.TempDir()
+	certFile, cert := load(dir, "192.0.2.7:8443")
+	for _, host := range []string{"localhost", "127.0.0.1", "::1", "192.0.2.7"} {
+		if err := cert.VerifyHostname(host); err != nil {
+			t.Error(err)
+		}
+	}
+	if cert.VerifyHostname("other.example.com") == nil {
+		t.Error("the certificate covers any host")
+	}
+	if !slices.Equal(cert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}) || cert.IsCA {
+		t.Errorf("usage %v, CA %v", cert.ExtKeyUsage, cert.IsCA)
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.AddDate(1, 0, 0).After(cert.NotAfter) {
+		t.Errorf("valid from %s to %s", cert.NotBefore, cert.NotAfter)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: "localhost", Roots: roots}); err != nil {
+		t.Errorf("a client trusting the certificate rejects it: %v", err)
+	}
+
+	// The certificate is made once and then reused, whatever -web says.
+	before, _ := os.ReadFile(certFile)
+	load(dir, "chat.example.com:443")
+	if after, _ := os.ReadFile(certFile); !bytes.Equal(before, after) {
+		t.Error("the certificate was made again")
+	}
+
+	// A host name to listen on is covered too.
+	if _, cert := load(t.TempDir(), "chat.example.com:443"); cert.VerifyHostname("chat.example.com") != nil {
+		t.Errorf("the certificate for chat.example.com covers %v", cert.DNSNames)
+	}
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+const commandUsage = `Commands:
+  serve                          Run the web server (the default)
+  user list                      List users
+  user add [-admin] [-password-stdin] <email>
+                                 Create a local user with a generated or given password
+  user disable|enable <email>    Disable or enable an account
+  user reset-password [-password-stdin] <email>
+                                 Set a new password, log the user out everywhere
+                                 and revoke their API tokens
+  user set-role <email> admin|user
+  user delete [-archive] <email> Delete a user, their chats and tokens
+  reset-token <email>            Print a single-use password reset link
+  chat list -user <email>        List a user's chats
+  chat export -user <email> [-o file] [chat-id...]
+                                 Write chats as JSON, all of them by default
+  chat import -user <email> <file|->
+                                 Add the chats of an export as new chats
+  backup [-sessions] [-o file]   Write a consistent snapshot of the data directory
+                                 to a .tar.gz archive with a checksummed manifest
+  restore [-check] [-user <email>] <archive>
+                                 Check an archive, restore it into an empty data
+                                 directory, or put back one user's chats
+  migrate                        Upgrade the data directory to this version's layout
+
+The user commands that change accounts, migrate and a full restore refuse
+to run while the server is running. The others are safe at any time.
+`
+
+// usage prints the command-line help.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: chatlocal [flags] [command]\n\n%s\nFlags:\n", commandUsage)
+	flag.PrintDefaults()
+}
+
+// runCommand executes an administrative subcommand given after the flags,
+// e.g. "chatlocal -data data user list", and returns the process exit code.
+// Commands that change what the server keeps in memory run under the data
+// directory lock and refuse to run while the server is up; the others are
+// safe at any time.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "user":
+		return runSubcommand("user", args[1:], map[string]func([]string) int{
+			"list":           cmdUserList,
+			"add":            exclusive("user add", cmdUserAdd),
+			"disable":        exclusive("user disable", cmdUserDisable(true)),
+			"enable":         exclusive("user enable", cmdUserDisable(false)),
+			"reset-password": exclusive("user reset-password", cmdUserResetPassword),
+			"set-role":       cmdSetRole,
+			"delete":         cmdDeleteUser,
+		})
+	case "chat":
+		return runSubcommand("chat", args[1:], map[string]func([]string) int{
+			"list":   cmdChatList,
+			"export": cmdChatExport,
+			"import": cmdChatImport,
+		})
+	case "backup":
+		return cmdBackup(args[1:])
+	case "restore":
+		return cmdRestore(args[1:])
+	case "migrate":
+		return exclusive("migrate", cmdMigrate)(args[1:])
+	case "reset-token":
+		return cmdResetToken(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], commandUsage)
+		return 2
+	}
+}
+
+func runSubcommand(group string, args []string, cmds map[string]func([]string) int) int {
+	if len(args) == 0 || cmds[args[0]] == nil {
+		fmt.Fprintf(os.Stderr, "usage: chatlocal [flags] %s <command>\n\n%s", group, commandUsage)
+		return 2
+	}
+	return cmds[args[0]](args[1:])
+}
+
+// exclusive wraps cmd to run holding the data directory lock.
+func exclusive(name string, cmd func([]string) int) func([]string) int {
+	return func(args []string) int {
+		lock, ok := lockData(name)
+		if !ok {
+			return 1
+		}
+		defer lock.Unlock()
+		return cmd(args)
+	}
+}
+
+// lockData takes the data directory lock for the command name. If the
+// server or another command holds it, it says so and returns false.
+func lockData(name string) (*store.DataLock, bool) {
+	lock, err := store.LockDataDir(*data, "chatlocal "+name)
+	var locked *store.LockedError
+	if errors.As(err, &locked) {
+		fmt.Fprintf(os.Stderr, "%s: %s is using %s; stop it first\n", name, locked.Holder, *data)
+		return nil, false
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return nil, false
+	}
+	return lock, true
+}
+
+// lookupUser opens the user store and finds the user with the given email.
+func lookupUser(email string) (*store.UserStore, *store.User, bool) {
+	email = strings.TrimSpace(strings.ToLower(email))
+	users, err := store.NewUserStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "user store:", err)
+		return nil, nil, false
+	}
+	u := users.ByUsername(email)
+	if u == nil {
+		fmt.Fprintf(os.Stderr, "no user %q\n", email)
+		return nil, nil, false
+	}
+	return users, u, true
+}
+
+// newPassword reads a password from the first line of standard input, or
+// generates one when fromStdin is false.
+func newPassword(fromStdin bool) (password string, generated bool, err error) {
+	if !fromStdin {
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			return "", false, err
+		}
+		return base64.RawURLEncoding.EncodeToString(b), true, nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", false, err
+	}
+	password = strings.TrimRight(line, "\r\n")
+	if len(password) < minPasswordLen {
+		return "", false, fmt.Errorf("password must be at least %d characters long", minPasswordLen)
+	}
+	return password, false, nil
+}
+
+func cmdUserList(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: chatlocal [flags] user list")
+		return 2
+	}
+	users, err := store.NewUserStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "user store:", err)
+		return 1
+	}
+	chats, err := store.NewChatStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "chat store:", err)
+		return 1
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMAIL\tROLE\tSTATUS\t2FA\tSOURCE\tCHATS\tID")
+	for _, u := range users.List() {
+		status := "active"
+		if u.Disabled {
+			status = "disabled"
+		}
+		twoFA := "off"
+		if u.TOTPSecret != "" {
+			twoFA = "on"
+		}
+		source := u.Source
+		if source == "" {
+			source = "local"
+		}
+		n, _, _ := chats.Usage(u.ID)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", u.Username, u.Role, status, twoFA, source, n, u.ID)
+	}
+	tw.Flush()
+	return 0
+}
+
+func cmdUserAdd(args []string) int {
+	fs := flag.NewFlagSet("user add", flag.ContinueOnError)
+	admin := fs.Bool("admin", false, "Give the user the admin role")
+	stdin := fs.Bool("password-stdin", false, "Read the password from standard input instead of generating one")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: chatlocal [flags] user add [-admin] [-password-stdin] <email>")
+		return 2
+	}
+	email := strings.TrimSpace(strings.ToLower(fs.Arg(0)))
+	if _, err := mail.ParseAddress(email); err != nil {
+		fmt.Fprintf(os.Stderr, "%q is not a valid email address\n", email)
+		return 1
+	}
+	password, generated, err := newPassword(*stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "password:", err)
+		return 1
+	}
+	users, err := store.NewUserStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "user store:", err)
+		return 1
+	}
+	u, err := users.Register(email, password)
+	if err == store.ErrUserExists {
+		fmt.Fprintf(os.Stderr, "user %q already exists\n", email)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "add user:", err)
+		return 1
+	}
+	if *admin {
+		if err := users.SetRole(u.ID, store.RoleAdmin); err != nil {
+			fmt.Fprintln(os.Stderr, "set role:", err)
+			return 1
+		}
+	}
+	fmt.Printf("Added %s (%s)\n", u.Username, u.ID)
+	if generated {
+		fmt.Printf("Password: %s\n", password)
+	}
+	return 0
+}
+
+func cmdUserDisable(disable bool) func([]string) int {
+	verb := "enable"
+	if disable {
+		verb = "disable"
+	}
+	return func(args []string) int {
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "usage: chatlocal [flags] user %s <email>\n", verb)
+			return 2
+		}
+		users, u, ok := lookupUser(args[0])
+		if !ok {
+			return 1
+		}
+		if err := users.SetDisabled(u.ID, disable); err != nil {
+			fmt.Fprintf(os.Stderr, "%s user: %v\n", verb, err)
+			return 1
+		}
+		if disable {
+			sessions, err := store.NewSessionStore(*data)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "session store:", err)
+				return 1
+			}
+			if _, err := sessions.DeleteForUser(u.ID); err != nil {
+				fmt.Fprintln(os.Stderr, "revoke sessions:", err)
+				return 1
+			}
+		}
+		fmt.Printf("%s is now %sd\n", u.Username, verb)
+		return 0
+	}
+}
+
+func cmdUserResetPassword(args []string) int {
+	fs := flag.NewFlagSet("user reset-password", flag.ContinueOnError)
+	stdin := fs.Bool("password-stdin", false, "Read the password from standard input instead of generating one")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: chatlocal [flags] user reset-password [-password-stdin] <email>")
+		return 2
+	}
+	users, u, ok := lookupUser(fs.Arg(0))
+	if !ok {
+		return 1
+	}
+	password, generated, err := newPassword(*stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "password:", err)
+		return 1
+	}
+	if err := users.SetPassword(u.ID, password); err != nil {
+		fmt.Fprintln(os.Stderr, "set password:", err)
+		return 1
+	}
+	sessions, err := store.NewSessionStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "session store:", err)
+		return 1
+	}
+	n, err := sessions.DeleteForUser(u.ID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "revoke sessions:", err)
+		return 1
+	}
+	tokens, err := store.NewTokenStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "token store:", err)
+		return 1
+	}
+	m, err := tokens.DeleteForUser(u.ID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "revoke API tokens:", err)
+		return 1
+	}
+	fmt.Printf("New password set for %s; %d sessions and %d API tokens revoked\n", u.Username, n, m)
+	if generated {
+		fmt.Printf("Password: %s\n", password)
+	}
+	return 0
+}
+
+// chatExportVersion is the version of the chat export format.
+const chatExportVersion = 1
+
+type chatExport struct {
+	Version    int            `json:"version"`
+	User       string         `json:"user"`
+	ExportedAt time.Time      `json:"exportedAt"`
+	Chats      []exportedChat `json:"chats"`
+}
+
+type exportedChat struct {
+	ID       string              `json:"id"`
+	Title    string              `json:"title"`
+	Messages []store.ChatMessage `json:"messages"`
+}
+
+// chatFlags parses the flags of a chat command, which all need -user.
+func chatFlags(name string, args []string, extra func(fs *flag.FlagSet)) (*flag.FlagSet, *store.User, *store.ChatStore, int) {
+	fs := flag.NewFlagSet("chat "+name, flag.ContinueOnError)
+	user := fs.String("user", "", "Email of the user whose chats to use")
+	if extra != nil {
+		extra(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, nil, 2
+	}
+	if *user == "" {
+		fmt.Fprintf(os.Stderr, "chat %s: -user is required\n", name)
+		return nil, nil, nil, 2
+	}
+	_, u, ok := lookupUser(*user)
+	if !ok {
+		return nil, nil, nil, 1
+	}
+	chats, err := store.NewChatStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "chat store:", err)
+		return nil, nil, nil, 1
+	}
+	return fs, u, chats, 0
+}
+
+func cmdChatList(args []string) int {
+	fs, u, chats, code := chatFlags("list", args, nil)
+	if fs == nil {
+		return code
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: chatlocal [flags] chat list -user <email>")
+		return 2
+	}
+	infos, err := chats.ListWithTitles(u.ID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "list chats:", err)
+		return 1
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tMESSAGES\tTITLE")
+	for _, c := range infos {
+		n := "?"
+		if msgs, err := chats.Get(u.ID, c.ID); err == nil {
+			n = fmt.Sprint(len(msgs))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.ID, n, c.Title)
+	}
+	tw.Flush()
+	return 0
+}
+
+func cmdChatExport(args []string) int {
+	var out *string
+	fs, u, chats, code := chatFlags("export", args, func(fs *flag.FlagSet) {
+		out = fs.String("o", "", "Write to this file instead of standard output")
+	})
+	if fs == nil {
+		return code
+	}
+	infos, err := chats.ListWithTitles(u.ID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "list chats:", err)
+		return 1
+	}
+	if fs.NArg() > 0 {
+		titles := make(map[string]string)
+		for _, c := range infos {
+			titles[c.ID] = c.Title
+		}
+		infos = infos[:0]
+		for _, id := range fs.Args() {
+			if _, ok := titles[id]; !ok {
+				fmt.Fprintf(os.Stderr, "%s has no chat %q\n", u.Username, id)
+				return 1
+			}
+			infos = append(infos, store.ChatInfo{ID: id, Title: titles[id]})
+		}
+	}
+	exp := chatExport{Version: chatExportVersion, User: u.Username, ExportedAt: time.Now().UTC(), Chats: []exportedChat{}}
+	for _, c := range infos {
+		msgs, err := chats.Get(u.ID, c.ID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read chat %s: %v\n", c.ID, err)
+			return 1
+		}
+		exp.Chats = append(exp.Chats, exportedChat{ID: c.ID, Title: c.Title, Messages: msgs})
+	}
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(exp); err != nil {
+		fmt.Fprintln(os.Stderr, "write export:", err)
+		return 1
+	}
+	if *out != "" {
+		fmt.Fprintf(os.Stderr, "Exported %d chats of %s to %s\n", len(exp.Chats), u.Username, *out)
+	}
+	return 0
+}
+
+// cmdChatImport adds chats from an export. It only creates new chat files,
+// which the server reads from disk, so it is safe while the server runs.
+func cmdChatImport(args []string) int {
+	fs, u, chats, code := chatFlags("import", args, nil)
+	if fs == nil {
+		return code
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: chatlocal [flags] chat import -user <email> <file|->")
+		return 2
+	}
+	var r io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	var exp chatExport
+	if err := json.NewDecoder(r).Decode(&exp); err != nil {
+		fmt.Fprintln(os.Stderr, "read export:", err)
+		return 1
+	}
+	if exp.Version != chatExportVersion {
+		fmt.Fprintf(os.Stderr, "unsupported export version %d\n", exp.Version)
+		return 1
+	}
+	for i, c := range exp.Chats {
+		for j, m := range c.Messages {
+			if m.Type != "sent" && m.Type != "received" {
+				fmt.Fprintf(os.Stderr, "chat %d, message %d: type must be sent or received, not %q\n", i+1, j+1, m.Type)
+				return 1
+			}
+		}
+	}
+	for _, c := range exp.Chats {
+		if _, err := chats.Import(u.ID, c.Title, c.Messages); err != nil {
+			fmt.Fprintln(os.Stderr, "import chat:", err)
+			return 1
+		}
+	}
+	fmt.Printf("Imported %d chats for %s\n", len(exp.Chats), u.Username)
+	return 0
+}
+
+func cmdMigrate(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: chatlocal [flags] migrate")
+		return 2
+	}
+	from, err := store.Migrate(*data, func(desc string) { fmt.Println("Migrating", desc) })
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	if from == store.DataVersion {
+		fmt.Printf("%s already has layout %d; nothing to do\n", *data, from)
+	} else {
+		fmt.Printf("Upgraded %s from layout %d to %d\n", *data, from, store.DataVersion)
+	}
+	return 0
+}
+
+// cmdResetToken needs no lock while the server runs: each token is its own
+// file, written atomically and read from disk only when it is used, and the
+// server keeps none of them in memory. A token for an account the server
+// deletes meanwhile is refused when used, like any unknown one.
+func cmdResetToken(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: chatlocal [flags] reset-token <email>")
+		return 2
+	}
+	email := strings.TrimSpace(strings.ToLower(args[0]))
+	users, err := store.NewUserStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "user store:", err)
+		return 1
+	}
+	u := users.ByUsername(email)
+	if u == nil {
+		fmt.Fprintf(os.Stderr, "no user %q\n", email)
+		return 1
+	}
+	resets, err := store.NewResetStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reset store:", err)
+		return 1
+	}
+	token, err := resets.Issue(u.ID, store.ResetTokenDuration)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "issue token:", err)
+		return 1
+	}
+	fmt.Printf("Reset link for %s (valid for %s, single use):\n", u.Username, store.ResetTokenDuration)
+	fmt.Printf("%s/reset?token=%s\n", baseURL(), url.QueryEscape(token))
+	if *publicURL == "" {
+		fmt.Fprintln(os.Stderr, "The link uses -web; set -public-url if users reach the server at another address.")
+	}
+	return 0
+}
+
+// baseURL is where users reach the server: -public-url, or else built from
+// -web and the TLS flags.
+func baseURL() string {
+	if *publicURL != "" {
+		return strings.TrimSuffix(*publicURL, "/")
+	}
+	scheme := "http"
+	if *tlsCert != "" || *tlsSelfSigned {
+		scheme = "https"
+	}
+	host, port, err := net.SplitHostPort(*web)
+	if err != nil {
+		host, port = *web, ""
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		// Listening on all interfaces; any name of the machine would do.
+		host = "localhost"
+	}
+	if port == "" || scheme == "http" && port == "80" || scheme == "https" && port == "443" {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		return scheme + "://" + host
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+func cmdSetRole(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: chatlocal [flags] user set-role <email> admin|user")
+		return 2
+	}
+	// A running server would keep the old role and write it back.
+	lock, ok := lockData("user set-role")
+	if !ok {
+		return 1
+	}
+	defer lock.Unlock()
+	email := strings.TrimSpace(strings.ToLower(args[0]))
+	users, err := store.NewUserStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "user store:", err)
+		return 1
+	}
+	u := users.ByUsername(email)
+	if u == nil {
+		fmt.Fprintf(os.Stderr, "no user %q\n", email)
+		return 1
+	}
+	if err := users.SetRole(u.ID, args[1]); err != nil {
+		fmt.Fprintln(os.Stderr, "set role:", err)
+		return 1
+	}
+	fmt.Printf("%s is now %s\n", u.Username, args[1])
+	return 0
+}
+
+func cmdDeleteUser(args []string) int {
+	fs := flag.NewFlagSet("user delete", flag.ContinueOnError)
+	archive := fs.Bool("archive", false, "Move chats to data/archive instead of deleting them")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: chatlocal [flags] user delete [-archive] <email>")
+		return 2
+	}
+	// The server keeps users in memory and would write the account back,
+	// and it must not be halfway through a chat that is being removed.
+	lock, ok := lockData("user delete")
+	if !ok {
+		return 1
+	}
+	defer lock.Unlock()
+	email := strings.TrimSpace(strings.ToLower(fs.Arg(0)))
+	users, err := store.NewUserStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "user store:", err)
+		return 1
+	}
+	u := users.ByUsername(email)
+	if u == nil {
+		fmt.Fprintf(os.Stderr, "no user %q\n", email)
+		return 1
+	}
+	sessions, err := store.NewSessionStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "session store:", err)
+		return 1
+	}
+	chats, err := store.NewChatStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "chat store:", err)
+		return 1
+	}
+	resets, err := store.NewResetStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reset store:", err)
+		return 1
+	}
+	tokens, err := store.NewTokenStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "token store:", err)
+		return 1
+	}
+	usage, err := store.NewUsageStore(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "usage store:", err)
+		return 1
+	}
+	sum, err := purgeUser(users, sessions, chats, resets, tokens, usage, u.ID, *archive)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "delete user:", err)
+		return 1
+	}
+	fmt.Printf("Deleted user %s (%s)\n", sum.Username, u.ID)
+	fmt.Printf("  sessions revoked:   %d\n", sum.Sessions)
+	fmt.Printf("  API tokens revoked: %d\n", sum.Tokens)
+	fmt.Printf("  reset tokens:       %d\n", sum.Resets)
+	if sum.Archive != "" {
+		fmt.Printf("  chats archived:     %d -> %s\n", sum.Chats, sum.Archive)
+	} else {
+		fmt.Printf("  chats deleted:      %d\n", sum.Chats)
+	}
+	return 0
+}
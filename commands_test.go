@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+func TestResetPasswordRevokesCredentials(t *testing.T) {
+	dir := t.TempDir()
+	useDataDir(t, dir)
+	users, err := store.NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := users.Register("alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := store.NewSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, err := sessions.Create(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := store.NewTokenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secret, err := tokens.Create(u.ID, "script", []string{store.ScopeRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := runCommand([]string{"user", "reset-password", "alice@example.com"}); code != 0 {
+		t.Fatalf("user reset-password exited with %d", code)
+	}
+	if _, ok := sessions.Get(sid); ok {
+		t.Error("the session survived a password reset")
+	}
+	if _, ok := tokens.Lookup(secret); ok {
+		t.Error("the API token survived a password reset")
+	}
+	users, err = store.NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Authenticate(context.Background(), "alice@example.com", "correct horse battery"); err == nil {
+		t.Error("the old password still works")
+	}
+}
+
+func TestOldCommandNamesAreGone(t *testing.T) {
+	useDataDir(t, t.TempDir())
+	for _, args := range [][]string{{"set-role", "a@example.com", "admin"}, {"delete-user", "a@example.com"}} {
+		if code := runCommand(args); code != 2 {
+			t.Errorf("%q exited with %d, want the usage error", args, code)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envPrefix starts the environment variable for each flag: -rate-limit is
+// CHATLOCAL_RATE_LIMIT.
+const envPrefix = "CHATLOCAL_"
+
+// secretFlags are redacted when the configuration is printed.
+var secretFlags = map[string]bool{
+	"oidc-client-secret": true,
+	"ldap-bind-password": true,
+	"metrics-token":      true,
+}
+
+var (
+	configFile  = flag.String("config", "", "Config file (flat TOML, keys are flag names); also CHATLOCAL_CONFIG")
+	printConfig = flag.Bool("print-config", false, "Print the effective configuration with secrets redacted and exit")
+)
+
+// configSources records where each flag got its value: "flag", "env",
+// "file" or, when missing, the default.
+var configSources = map[string]string{}
+
+// loadConfig fills in the flags not given on the command line, first from
+// CHATLOCAL_* environment variables and then from the config file, so
+// flags win over the environment and the environment over the file.
+func loadConfig() error {
+	flag.Visit(func(f *flag.Flag) { configSources[f.Name] = "flag" })
+	if _, ok := configSources["config"]; !ok {
+		*configFile = os.Getenv(envPrefix + "CONFIG")
+	}
+	var file map[string]string
+	if *configFile != "" {
+		b, err := os.ReadFile(*configFile)
+		if err != nil {
+			return err
+		}
+		if file, err = parseConfigFile(string(b)); err != nil {
+			return fmt.Errorf("%s: %w", *configFile, err)
+		}
+	}
+
+	var errs []error
+	for key := range file {
+		if f := flag.Lookup(key); f == nil || key == "config" || key == "print-config" {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", *configFile, key))
+		}
+	}
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		key, ok := strings.CutPrefix(name, envPrefix)
+		if !ok || key == "CONFIG" {
+			continue
+		}
+		if flag.Lookup(envKey(key)) == nil {
+			errs = append(errs, fmt.Errorf("unknown environment variable %s", name))
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if configSources[f.Name] != "" || f.Name == "config" {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", envName(f.Name), err))
+			}
+			configSources[f.Name] = "env"
+		} else if v, ok := file[f.Name]; ok {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %v", *configFile, f.Name, err))
+			}
+			configSources[f.Name] = "file"
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func envKey(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+}
+
+// parseConfigFile reads the flat subset of TOML the config file uses:
+// key = value lines, where a value is a quoted string, a number, true or
+// false, or an array of strings (joined with commas, as the flags expect).
+// Keys are flag names; underscores may stand in for dashes.
+func parseConfigFile(s string) (map[string]string, error) {
+	values := make(map[string]string)
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("line %d: %s", i+1, fmt.Sprintf(format, args...))
+		}
+		if line[0] == '[' {
+			return nil, fail("tables are not supported; put every setting at the top level")
+		}
+		key, rest, ok := strings.Cut(line, "=")
+		key = envKey(strings.TrimSpace(key))
+		if !ok || key == "" || strings.Trim(key, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return nil, fail("want key = value")
+		}
+		if _, dup := values[key]; dup {
+			return nil, fail("%s is set twice", key)
+		}
+		v, rest, err := parseConfigValue(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fail("%s: %v", key, err)
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+			return nil, fail("%s: unexpected %q after the value", key, rest)
+		}
+		values[key] = v
+	}
+	return values, nil
+}
+
+// parseConfigValue parses the value at the start of s and returns it with
+// the rest of s.
+func parseConfigValue(s string) (string, string, error) {
+	switch {
+	case s == "":
+		return "", "", errors.New("missing value")
+	case s[0] == '"':
+		// A TOML basic string has the escapes of a Go string.
+		end := 1
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return "", "", errors.New("unterminated string")
+		}
+		v, err := strconv.Unquote(s[:end+1])
+		return v, s[end+1:], err
+	case s[0] == '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case s[0] == '[':
+		var items []string
+		rest := strings.TrimSpace(s[1:])
+		for rest != "" && rest[0] != ']' {
+			item, r, err := parseConfigValue(rest)
+			if err != nil {
+				return "", "", err
+			}
+			items = append(items, item)
+			rest = strings.TrimSpace(r)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if rest != "" && rest[0] != ']' {
+				return "", "", errors.New("want , or ] in array")
+			}
+		}
+		if rest == "" {
+			return "", "", errors.New("unterminated array")
+		}
+		return strings.Join(items, ","), rest[1:], nil
+	}
+	v, rest, _ := strings.Cut(s, "#")
+	v = strings.TrimSpace(v)
+	if v != "true" && v != "false" {
+		if _, err := strconv.ParseFloat(strings.ReplaceAll(v, "_", ""), 64); err != nil {
+			return "", "", fmt.Errorf("%q is not a string, number or boolean; quote strings", v)
+		}
+		v = strings.ReplaceAll(v, "_", "")
+	}
+	if rest != "" {
+		rest = "#" + rest
+	}
+	return v, rest, nil
+}
+
+// parseLLMURL accepts the Ollama server as a base URL, such as
+// https://gpu.example.com/ollama, or as its /api/generate endpoint. A
+// missing scheme means http. It returns the base URL without a trailing slash.
+func parseLLMURL(s string) (string, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("scheme must be http or https, not %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", errors.New("missing host")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", errors.New("must not have a query or fragment")
+	}
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/api/generate")
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// validateConfig checks the settings that can be checked before anything
+// is opened and reports every problem at once. If all is well it puts the
+// reloadable settings into effect.
+func validateConfig() error {
+	var errs []error
+	check := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %w", name, err))
+		}
+	}
+	s, err := newSettings(func(name string) string { return flag.Lookup(name).Value.String() })
+	if err != nil {
+		errs = append(errs, err)
+	}
+	_, err = parseCIDRs(*trustedProxies)
+	check("trusted-proxies", err)
+	_, err = newCSRFProtection(*trustedOrigins)
+	check("trusted-origins", err)
+	if *publicURL != "" {
+		if u, err := url.Parse(*publicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+			check("public-url", errors.New("must be an http:// or https:// URL"))
+		}
+	}
+	_, err = newLogger(io.Discard, *logFormat)
+	check("log-format", err)
+	if *shutdownWait < 0 {
+		check("shutdown-timeout", errors.New("must not be negative"))
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		check("tls-cert", errors.New("-tls-cert and -tls-key must be given together"))
+	}
+	if *oidcIssuer != "" && (*oidcClientID == "" || *oidcRedirect == "") {
+		check("oidc-issuer", errors.New("needs -oidc-client-id and -oidc-redirect-url"))
+	}
+	if *oidcIssuer == "" && !*passwordLogin {
+		check("password-login", errors.New("false needs single sign-on (-oidc-issuer)"))
+	}
+	if *ldapURL != "" && *ldapBaseDN == "" {
+		check("ldap-url", errors.New("needs -ldap-base-dn"))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	live.Store(s)
+	logLevelVar.Set(s.LogLevel)
+	return nil
+}
+
+// redactedValue returns the value of f as it may be shown: secrets are
+// replaced and passwords in URLs removed.
+func redactedValue(f *flag.Flag) string {
+	v := f.Value.String()
+	if secretFlags[f.Name] && v != "" {
+		return "<redacted>"
+	}
+	if u, err := url.Parse(v); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return v
+}
+
+// effectiveConfig returns every setting as it will be used, in the config
+// file format, with secrets redacted and where each value came from.
+func effectiveConfig() string {
+	var b strings.Builder
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		v := redactedValue(f)
+		switch f.Value.(flag.Getter).Get().(type) {
+		case bool, int:
+			fmt.Fprintf(&b, "%s = %s", f.Name, v)
+		default:
+			fmt.Fprintf(&b, "%s = %s", f.Name, strconv.Quote(v))
+		}
+		if src := configSources[f.Name]; src != "" {
+			fmt.Fprintf(&b, " # %s", src)
+		}
+		b.WriteByte('\n')
+	})
+	return b.String()
+}
+
+// logConfig logs the settings that differ from their defaults.
+func logConfig() {
+	var attrs []any
+	flag.VisitAll(func(f *flag.Flag) {
+		if configSources[f.Name] != "" && f.Name != "config" {
+			attrs = append(attrs, slog.String(f.Name, redactedValue(f)))
+		}
+	})
+	slog.Info("configuration", "file", *configFile, slog.Group("settings", attrs...))
+}
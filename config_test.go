@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	for _, tc := range []struct {
+		name, in string
+		want     map[string]string
+		err      string // substring of the error, "" for none
+	}{
+		{
+			name: "comments and blank lines",
+			in:   "# chatlocal\n\n  # indented\nweb = \"localhost:8080\" # trailing\n",
+			want: map[string]string{"web": "localhost:8080"},
+		},
+		{
+			name: "hash inside a string",
+			in:   `model = "llama3 # not a comment" # a comment` + "\n" + `metrics_token = 'a#b'`,
+			want: map[string]string{"model": "llama3 # not a comment", "metrics-token": "a#b"},
+		},
+		{
+			name: "escapes",
+			in:   `a = "tab\there \"quoted\" back\\slash \u00e9"` + "\n" + `b = 'C:\no\escapes'`,
+			want: map[string]string{"a": "tab\there \"quoted\" back\\slash é", "b": `C:\no\escapes`},
+		},
+		{
+			name: "bools and numbers",
+			in:   "require_2fa = true\ndev = false\nmax-queue = 50\nrate_limit = 1_000 # per minute\nratio = 0.5",
+			want: map[string]string{"require-2fa": "true", "dev": "false", "max-queue": "50", "rate-limit": "1000", "ratio": "0.5"},
+		},
+		{
+			name: "arrays",
+			in:   `allowed_domains = ["example.com", 'example.org' ,"a,b"] # three` + "\n" + `trusted-proxies = []`,
+			want: map[string]string{"allowed-domains": "example.com,example.org,a,b", "trusted-proxies": ""},
+		},
+		{name: "duplicate key", in: "max-queue = 1\nmax_queue = 2", err: "line 2: max-queue is set twice"},
+		{name: "table", in: "[server]\nweb = \"x\"", err: "line 1: tables are not supported"},
+		{name: "no equals", in: "web", err: "want key = value"},
+		{name: "bad key", in: "Web.Port = 1", err: "want key = value"},
+		{name: "bare word", in: "model = llama3", err: "quote strings"},
+		{name: "missing value", in: "model =", err: "missing value"},
+		{name: "unterminated string", in: `model = "llama3`, err: "unterminated string"},
+		{name: "escaped quote at the end", in: `model = "llama3\"`, err: "unterminated string"},
+		{name: "unterminated array", in: `allowed_domains = ["a", "b"`, err: "unterminated array"},
+		{name: "bad array", in: `allowed_domains = ["a" "b"]`, err: "want , or ]"},
+		{name: "junk after the value", in: `model = "a" "b"`, err: `unexpected "\"b\""`},
+		{name: "bad escape", in: `model = "\q"`, err: "model"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseConfigFile(tc.in)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseLLMURL(t *testing.T) {
+	for in, want := range map[string]string{
+		"localhost:11434":                             "http://localhost:11434",
+		"http://localhost:11434/":                     "http://localhost:11434",
+		"http://localhost:11434/api/generate":         "http://localhost:11434",
+		"https://gpu.example.com/ollama/":             "https://gpu.example.com/ollama",
+		"https://gpu.example.com/ollama/api/generate": "https://gpu.example.com/ollama",
+		"ftp://example.com":                           "",
+		"http://":                                     "",
+		"http://localhost:11434/?model=x":             "",
+		"http://localhost:11434/#top":                 "",
+	} {
+		got, err := parseLLMURL(in)
+		if want == "" {
+			if err == nil {
+				t.Errorf("%s: accepted as %s", in, got)
+			}
+		} else if got != want || err != nil {
+			t.Errorf("%s: %s, %v; want %s", in, got, err, want)
+		}
+	}
+}
+
+// keepFlags restores every flag and where it came from when t ends.
+func keepFlags(t *testing.T) {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) { values[f.Name] = f.Value.String() })
+	sources := maps.Clone(configSources)
+	t.Cleanup(func() {
+		flag.VisitAll(func(f *flag.Flag) { f.Value.Set(values[f.Name]) })
+		clear(configSources)
+		maps.Copy(configSources, sources)
+	})
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	keepFlags(t)
+	useSettings(t, nil)
+	file := filepath.Join(t.TempDir(), "chatlocal.toml")
+	write := func(s string) {
+		if err := os.WriteFile(file, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("rate-limit = 1\nmax-queue = 2\ndaily-token-quota = 3\n")
+	*configFile = file
+	configSources["config"] = "flag"
+	// As if -rate-limit 7 was on the command line.
+	flag.Lookup("rate-limit").Value.Set("7")
+	configSources["rate-limit"] = "flag"
+	t.Setenv("CHATLOCAL_MAX_QUEUE", "8")
+
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][2]string{
+		"rate-limit":          {"7", "flag"},
+		"max-queue":           {"8", "env"},
+		"daily-token-quota":   {"3", "file"},
+		"monthly-token-quota": {"0", ""},
+	}
+	check := func(when string) {
+		t.Helper()
+		for name, w := range want {
+			if v, src := flag.Lookup(name).Value.String(), configSources[name]; v != w[0] || src != w[1] {
+				t.Errorf("%s: -%s is %s from %q, want %s from %q", when, name, v, src, w[0], w[1])
+			}
+		}
+	}
+	check("load")
+
+	// A reload resolves values the same way.
+	write("rate-limit = 11\nmax-queue = 12\ndaily-token-quota = 13\nmonthly-token-quota = 14\n")
+	rl := &reloader{sched: newScheduler(0, nil, 0), rate: store.NewRateLimiter(0, time.Minute)}
+	res, err := rl.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want["daily-token-quota"] = [2]string{"13", "file"}
+	want["monthly-token-quota"] = [2]string{"14", "file"}
+	check("reload")
+	if got := strings.Join(res.Changed, ","); got != "daily-token-quota,monthly-token-quota" {
+		t.Errorf("reload changed %s", got)
+	}
+	if s := current(); s.RatePerMinute != 7 || s.MaxQueue != 8 || s.DailyTokens != 13 || s.MonthlyTokens != 14 {
+		t.Errorf("settings after reload: %+v", s)
+	}
+}
+
+func TestConfigUnknownKeys(t *testing.T) {
+	keepFlags(t)
+	file := filepath.Join(t.TempDir(), "chatlocal.toml")
+	if err := os.WriteFile(file, []byte("no-such-setting = 1\nprint_config = true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	*configFile = file
+	configSources["config"] = "flag"
+	t.Setenv("CHATLOCAL_NO_SUCH_THING", "1")
+	err := loadConfig()
+	for _, want := range []string{`unknown setting "no-such-setting"`, `unknown setting "print-config"`, "unknown environment variable CHATLOCAL_NO_SUCH_THING"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error %v, want %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ollama "github.com/agerasimovski/chatlocal/llmapi"
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// probeTimeout bounds each readiness check of the LLM backend.
+const probeTimeout = 3 * time.Second
+
+// backendUnreachable is shown to users when Ollama cannot be reached.
+const backendUnreachable = "the LLM backend is unreachable; check that Ollama is running or try again later"
+
+// backendError turns an error from the LLM backend into a message for users.
+func backendError(err error) string {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return backendUnreachable
+	}
+	return "the LLM backend returned an error: " + strings.TrimPrefix(err.Error(), "ollama: ")
+}
+
+// healthzHandler answers as long as the process serves requests.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+type readyCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// notReady is all callers without a session learn about a failed check;
+// the reason is logged.
+const notReady = "not ready"
+
+// loadTimeout bounds a model load started by warmModel.
+const loadTimeout = 10 * time.Minute
+
+// loading is set while a model load started by warmModel runs.
+var loading atomic.Bool
+
+// warmModel asks the backend to load model in the background, one load at
+// a time, so the first prompt does not wait for it. It runs at startup and
+// when a reload changes the backend or the model.
+func warmModel(llm, model string) {
+	if !loading.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer loading.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), loadTimeout)
+		defer cancel()
+		start := time.Now()
+		if err := ollama.Load(ctx, llm, model); err != nil {
+			slog.Warn("loading model", "model", model, "err", err)
+			return
+		}
+		slog.Info("model loaded", "model", model, "duration", time.Since(start))
+	}()
+}
+
+// readyzHandler reports whether prompts can be answered: the data
+// directory must be writable, the backend reachable and the default model
+// installed. It answers 503 when not. Whether the model is in memory right
+// now is reported in "loaded" but does not count, since Ollama unloads
+// idle models and loads them again on the next prompt. Only signed-in
+// users are told why a check failed, and which model is configured.
+func readyzHandler(dataDir string, users *store.UserStore, sessions *store.SessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]readyCheck{"data": {OK: true}, "backend": {OK: true}, "model": {OK: true}}
+		if err := checkWritable(dataDir); err != nil {
+			slog.WarnContext(r.Context(), "readiness: data directory", "err", err)
+			checks["data"] = readyCheck{Error: "data directory is not writable"}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+		defer cancel()
+		if info := store.RequestFromContext(ctx); info != nil {
+			ctx = ollama.WithRequestID(ctx, info.ID)
+		}
+		loaded := false
+		s := current()
+		names, err := ollama.Models(ctx, s.LLM)
+		if err != nil {
+			slog.WarnContext(r.Context(), "readiness: backend", "err", err)
+			checks["backend"] = readyCheck{Error: backendError(err)}
+			checks["model"] = readyCheck{Error: "unknown while the backend is unavailable"}
+		} else if !ollama.HasModel(names, s.Model) {
+			slog.WarnContext(r.Context(), "readiness: model not installed", "model", s.Model)
+			checks["model"] = readyCheck{Error: "model " + s.Model + " is not installed; run: ollama pull " + s.Model}
+		} else if running, err := ollama.Loaded(ctx, s.LLM); err != nil {
+			slog.WarnContext(r.Context(), "readiness: loaded models", "err", err)
+		} else {
+			loaded = ollama.HasModel(running, s.Model)
+		}
+
+		ready := true
+		for _, c := range checks {
+			ready = ready && c.OK
+		}
+		body := map[string]interface{}{
+			"ready":  ready,
+			"loaded": loaded,
+			"checks": checks,
+		}
+		if signedIn(r, users, sessions) {
+			body["model"] = s.Model
+		} else {
+			for name, c := range checks {
+				if !c.OK {
+					checks[name] = readyCheck{Error: notReady}
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// signedIn reports whether r carries the session of an enabled user.
+func signedIn(r *http.Request, users *store.UserStore, sessions *store.SessionStore) bool {
+	c, err := r.Cookie(store.SessionCookieName)
+	if err != nil {
+		return false
+	}
+	userID, ok := sessions.Get(c.Value)
+	return ok && !users.IsDisabled(userID)
+}
+
+// checkWritable creates and removes a file in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// fakeOllama serves the model list endpoints. The model is installed, and
+// loaded once a generate request asked for it. With broken set, every
+// request fails.
+type fakeOllama struct {
+	loaded, broken atomic.Bool
+	loads          atomic.Int32
+}
+
+func (f *fakeOllama) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.broken.Load() {
+		http.Error(w, "secret internal detail", http.StatusInternalServerError)
+		return
+	}
+	list := func(names ...string) {
+		var body struct {
+			Models []map[string]string `json:"models"`
+		}
+		for _, n := range names {
+			body.Models = append(body.Models, map[string]string{"name": n})
+		}
+		json.NewEncoder(w).Encode(body)
+	}
+	switch r.URL.Path {
+	case "/api/tags":
+		list("gemma3:latest")
+	case "/api/ps":
+		if f.loaded.Load() {
+			list("gemma3:latest")
+		} else {
+			list()
+		}
+	case "/api/generate":
+		f.loads.Add(1)
+		f.loaded.Store(true)
+		json.NewEncoder(w).Encode(map[string]any{"model": "gemma3", "done": true})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type readyResponse struct {
+	Ready  bool
+	Loaded bool
+	Model  *string
+	Checks map[string]readyCheck
+}
+
+func TestReadyz(t *testing.T) {
+	fake := &fakeOllama{}
+	backend := httptest.NewServer(fake)
+	t.Cleanup(backend.Close)
+	useSettings(t, map[string]string{"llm": backend.URL, "model": "gemma3"})
+	dir := t.TempDir()
+	users, err := store.NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := store.NewSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := users.Register("alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, err := sessions.Create(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := readyzHandler(dir, users, sessions)
+	get := func(session string) (int, readyResponse) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: store.SessionCookieName, Value: session})
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		var resp readyResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, resp
+	}
+
+	fake.broken.Store(true)
+	code, resp := get("")
+	if code != http.StatusServiceUnavailable || resp.Ready {
+		t.Errorf("backend down: status %d, ready %v", code, resp.Ready)
+	}
+	if c := resp.Checks["backend"]; c.OK || c.Error != notReady || resp.Model != nil {
+		t.Errorf("anonymous caller got backend check %+v, model %v", c, resp.Model)
+	}
+	for _, session := range []string{"", "bogus"} {
+		if _, resp := get(session); resp.Checks["backend"].Error != notReady {
+			t.Errorf("session %q: backend error %q", session, resp.Checks["backend"].Error)
+		}
+	}
+	_, resp = get(sid)
+	if c := resp.Checks["backend"]; c.Error != "the LLM backend returned an error: 500 Internal Server Error" || resp.Model == nil {
+		t.Errorf("signed-in caller got backend check %+v, model %v", c, resp.Model)
+	}
+
+	// Installed but not loaded: ready, and readyz does not load it.
+	fake.broken.Store(false)
+	for _, session := range []string{"", sid} {
+		code, resp = get(session)
+		if code != http.StatusOK || !resp.Ready || resp.Loaded {
+			t.Errorf("model not loaded: status %d, %+v", code, resp)
+		}
+	}
+	if n := fake.loads.Load(); n != 0 {
+		t.Errorf("readyz loaded the model %d times", n)
+	}
+
+	warmModel(backend.URL, "gemma3")
+	for deadline := time.Now().Add(5 * time.Second); loading.Load() || fake.loads.Load() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("model was not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	code, resp = get("")
+	if code != http.StatusOK || !resp.Ready || !resp.Loaded {
+		t.Errorf("model loaded: status %d, %+v", code, resp)
+	}
+	if n := fake.loads.Load(); n != 1 {
+		t.Errorf("%d loads, want 1", n)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/metrics"
+)
+
+var (
+	httpRequests = metrics.NewCounterVec("chatlocal_http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "code")
+	httpDuration = metrics.NewHistogramVec("chatlocal_http_request_duration_seconds",
+		"HTTP request latency by route; streams are timed until they end.", metrics.DefBuckets, "route")
+	activeStreams = metrics.NewGaugeVec("chatlocal_active_streams",
+		"Clients currently following an answer as it is generated.")
+	generationsTotal = metrics.NewCounterVec("chatlocal_generations_total",
+		"Finished generations by model and status (empty when complete).", "model", "status")
+	timeToFirstToken = metrics.NewHistogramVec("chatlocal_time_to_first_token_seconds",
+		"Time from sending a prompt to the backend until it starts answering, including model load.",
+		[]float64{.1, .25, .5, 1, 2, 5, 10, 20, 30, 60, 120}, "model")
+	tokensPerSecond = metrics.NewHistogramVec("chatlocal_generation_tokens_per_second",
+		"Completion tokens per second of evaluation, per generation.",
+		[]float64{1, 2, 5, 10, 20, 30, 50, 75, 100, 150, 200}, "model")
+	tokensTotal = metrics.NewCounterVec("chatlocal_tokens_total",
+		"Tokens processed by model and kind (prompt or completion).", "model", "kind")
+	upstreamErrors = metrics.NewCounterVec("chatlocal_upstream_errors_total",
+		"Failed requests to the LLM backend: connect (unreachable), status (error response) or stream (broke off).", "kind")
+)
+
+// upstreamErrorKind classifies an error from promptLLM.
+func upstreamErrorKind(err error) string {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return "connect"
+	}
+	return "status"
+}
+
+// statusRecorder remembers the status code and size of a response. It
+// passes Flush through so streaming keeps working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// metricMethod keeps the method label to a fixed set.
+func metricMethod(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return m
+	}
+	return "other"
+}
+
+// instrument counts, times and logs requests to h by the pattern of mux
+// they were routed to. h must be mux, or wrap it in handlers that pass the
+// request through unchanged, so that it sees r.Pattern set by the mux.
+// Requests h answers without reaching mux are matched against it after.
+func instrument(mux *http.ServeMux, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := r.Pattern
+		if route == "" {
+			_, route = mux.Handler(r)
+		}
+		if route == "" {
+			route = "unmatched"
+		}
+		elapsed := time.Since(start)
+		httpRequests.With(route, metricMethod(r.Method), strconv.Itoa(rec.status)).Inc()
+		httpDuration.With(route).Observe(elapsed.Seconds())
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", elapsed),
+			slog.String("remote", clientIP(r)))
+	})
+}
+
+// metricsHandler serves the metrics to callers presenting token as a
+// bearer token. An empty token allows everyone, for a private listener.
+func metricsHandler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		metrics.Default.ServeHTTP(w, r)
+	}
+}
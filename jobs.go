@@ -0,0 +1,391 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/agerasimovski/chatlocal/llmapi"
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// finishedJobTTL is how long a finished job stays attachable, so a client
+// that reconnects just after the end still receives the tail of the stream.
+const finishedJobTTL = time.Minute
+
+var (
+	errJobRunning = errors.New("an answer is already being generated for this chat")
+	errDraining   = errors.New("server is shutting down")
+)
+
+// job is one generation running independently of any HTTP request. Its
+// output is buffered so any number of clients can attach at any offset.
+type job struct {
+	userID, chatID string
+	llm, model     string // from the settings when the job started
+	cancel         context.CancelFunc
+
+	mu       sync.Mutex
+	out      []byte
+	state    jobState
+	discard  bool
+	finished time.Time
+	changed  chan struct{}
+}
+
+// jobState is what clients following a job are told besides its output.
+type jobState struct {
+	Position int    `json:"position"` // place in the queue, 0 once running
+	Done     bool   `json:"done"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"` // why the job failed, for the user
+}
+
+// since returns the output after offset from, the job's state, and a
+// channel that is closed when either changes.
+func (j *job) since(from int) ([]byte, jobState, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var chunk []byte
+	if from < len(j.out) {
+		chunk = j.out[from:]
+	}
+	return chunk, j.state, j.changed
+}
+
+// resume checks that offset from lies within the output. Events carry
+// text, so for them it moves back to the start of a UTF-8 sequence rather
+// than split one; plain text clients get exactly the bytes they ask for.
+func (j *job) resume(from int, events bool) (int, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if from < 0 || from > len(j.out) {
+		return 0, false
+	}
+	for events && from > 0 && from < len(j.out) && !utf8.RuneStart(j.out[from]) {
+		from--
+	}
+	return from, true
+}
+
+// notify wakes everyone following the job. j.mu must be held.
+func (j *job) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func (j *job) write(s string) {
+	j.mu.Lock()
+	j.out = append(j.out, s...)
+	j.notify()
+	j.mu.Unlock()
+}
+
+func (j *job) setPosition(n int) {
+	j.mu.Lock()
+	if j.state.Position != n {
+		j.state.Position = n
+		j.notify()
+	}
+	j.mu.Unlock()
+}
+
+func (j *job) finish(status, reason string) {
+	j.mu.Lock()
+	j.state = jobState{Done: true, Status: status, Error: reason}
+	j.finished = time.Now()
+	j.notify()
+	j.mu.Unlock()
+}
+
+// jobManager runs generations in the background and saves their answers
+// to the chat store when they end. There is at most one job per chat.
+type jobManager struct {
+	chats *store.ChatStore
+	usage *store.UsageStore
+	gens  *generations
+	sched *scheduler
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func newJobManager(chats *store.ChatStore, usage *store.UsageStore, gens *generations, sched *scheduler) *jobManager {
+	return &jobManager{chats: chats, usage: usage, gens: gens, sched: sched, jobs: make(map[string]*job)}
+}
+
+func jobKey(userID, chatID string) string {
+	return userID + "/" + chatID
+}
+
+// get returns the running or recently finished job of a chat, or nil.
+func (m *jobManager) get(userID, chatID string) *job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep()
+	return m.jobs[jobKey(userID, chatID)]
+}
+
+// running reports whether an answer is being generated for the chat.
+func (m *jobManager) running(userID, chatID string) bool {
+	j := m.get(userID, chatID)
+	if j == nil {
+		return false
+	}
+	_, st, _ := j.since(0)
+	return !st.Done
+}
+
+// sweep forgets finished jobs past their TTL. m.mu must be held.
+func (m *jobManager) sweep() {
+	for k, j := range m.jobs {
+		j.mu.Lock()
+		expired := j.state.Done && time.Since(j.finished) > finishedJobTTL
+		j.mu.Unlock()
+		if expired {
+			delete(m.jobs, k)
+		}
+	}
+}
+
+// reserve claims the chat for a new job. prepare runs once the claim is
+// made and may save the prompt; if it or queueing fails the claim is
+// released again. Only the claim itself happens under m.mu, so a slow disk
+// or a busy queue holds up this chat but no others.
+func (m *jobManager) reserve(ctx context.Context, userID, chatID string, prepare func() (string, error)) (*job, error) {
+	key := jobKey(userID, chatID)
+	m.mu.Lock()
+	m.sweep()
+	if j := m.jobs[key]; j != nil {
+		if _, st, _ := j.since(0); !st.Done {
+			m.mu.Unlock()
+			return nil, errJobRunning
+		}
+	}
+	genCtx, ok := m.gens.begin()
+	if !ok {
+		m.mu.Unlock()
+		return nil, errDraining
+	}
+	// The job outlives the request but keeps its ID for logging.
+	info := &store.RequestInfo{UserID: userID}
+	if ri := store.RequestFromContext(ctx); ri != nil {
+		info.ID = ri.ID
+	}
+	ctx, cancel := context.WithCancel(store.ContextWithRequest(genCtx, info))
+	s := current()
+	j := &job{userID: userID, chatID: chatID, llm: s.LLM, model: s.Model, cancel: cancel, changed: make(chan struct{})}
+	m.jobs[key] = j
+	m.mu.Unlock()
+
+	t, err := m.sched.enqueue(userID, j.model, j.setPosition)
+	var prompt string
+	if err == nil {
+		if prompt, err = prepare(); err != nil {
+			m.sched.release(t)
+		}
+	}
+	if err != nil {
+		m.mu.Lock()
+		if m.jobs[key] == j {
+			delete(m.jobs, key)
+		}
+		m.mu.Unlock()
+		cancel()
+		m.gens.end()
+		// Anyone who attached meanwhile is told it did not start.
+		j.finish(store.StatusFailed, "")
+		return nil, err
+	}
+	go m.run(ctx, j, t, prompt)
+	return j, nil
+}
+
+// cancel stops the job of a chat without saving its answer, for example
+// because the chat was deleted.
+func (m *jobManager) cancel(userID, chatID string) {
+	if j := m.get(userID, chatID); j != nil {
+		j.mu.Lock()
+		j.discard = true
+		j.mu.Unlock()
+		j.cancel()
+	}
+}
+
+func (m *jobManager) run(ctx context.Context, j *job, t *ticket, prompt string) {
+	defer m.gens.end()
+	defer j.cancel()
+	defer m.sched.release(t)
+	status, reason := "", ""
+	var httpResponse *http.Response
+	begun := time.Now()
+	err := m.sched.wait(ctx, t)
+	if err == nil {
+		if *logPrompts {
+			slog.InfoContext(ctx, "prompt", "chat", j.chatID, "text", prompt)
+		}
+		start := time.Now()
+		httpResponse, err = promptLLM(ctx, j.llm, j.model, prompt)
+		if err == nil {
+			timeToFirstToken.With(j.model).Observe(time.Since(start).Seconds())
+		} else if ctx.Err() == nil {
+			upstreamErrors.With(upstreamErrorKind(err)).Inc()
+		}
+	}
+	switch {
+	case err != nil && m.gens.interrupted(ctx):
+		status = store.StatusInterrupted
+	case err != nil && ctx.Err() != nil:
+		// Cancelled, the answer is discarded.
+	case err != nil:
+		slog.ErrorContext(ctx, "generation failed", "chat", j.chatID, "model", j.model, "err", err)
+		status, reason = store.StatusFailed, backendError(err)
+	default:
+		var final *ollama.Response
+		final, err = ollama.Stream(httpResponse, func(paragraph string) error {
+			j.write(paragraph + "\n\n")
+			return nil
+		})
+		httpResponse.Body.Close()
+		used := store.Usage{Requests: 1}
+		if final != nil {
+			used.PromptTokens, used.CompletionTokens = final.PromptEvalCount, final.EvalCount
+			used.TotalDuration = time.Duration(final.TotalDuration)
+			used.LoadDuration = time.Duration(final.LoadDuration)
+			used.EvalDuration = time.Duration(final.EvalDuration)
+			tokensTotal.With(j.model, "prompt").Add(float64(used.PromptTokens))
+			tokensTotal.With(j.model, "completion").Add(float64(used.CompletionTokens))
+			if used.EvalDuration > 0 {
+				tokensPerSecond.With(j.model).Observe(used.EvalRate())
+			}
+		}
+		if err := m.usage.Record(j.userID, j.model, time.Now(), used); err != nil {
+			slog.ErrorContext(ctx, "record usage", "err", err)
+		}
+		if err != nil {
+			if m.gens.interrupted(ctx) {
+				status = store.StatusInterrupted
+			} else if ctx.Err() == nil {
+				slog.WarnContext(ctx, "generation broke off", "chat", j.chatID, "model", j.model, "err", err)
+				upstreamErrors.With("stream").Inc()
+				status = store.StatusIncomplete
+				var se *ollama.StreamError
+				if errors.As(err, &se) {
+					reason = backendError(se)
+				}
+			}
+		}
+	}
+
+	j.mu.Lock()
+	discard, text := j.discard, strings.TrimSpace(string(j.out))
+	j.mu.Unlock()
+	if !discard {
+		err := m.chats.Append(j.userID, j.chatID,
+			store.ChatMessage{Sender: "LLM", Text: text, Type: "received", Time: time.Now().Format("3:04 PM"), Status: status, Error: reason})
+		if err != nil {
+			slog.ErrorContext(ctx, "save answer", "chat", j.chatID, "err", err)
+		}
+		generationsTotal.With(j.model, status).Inc()
+		slog.InfoContext(ctx, "generation", "chat", j.chatID, "model", j.model, "status", cmp.Or(status, "complete"),
+			"bytes", len(text), "duration", time.Since(begun))
+	}
+	// Mark the job done only after saving, so a client that sees the end
+	// of the stream and reloads the chat finds the answer.
+	j.finish(status, reason)
+}
+
+// streamJob writes the output of j from offset from until the job ends or
+// the client goes away. If the job fails before producing any output the
+// client gets a 502 instead of an empty stream.
+//
+// Clients that accept text/event-stream get Server-Sent Events instead of
+// plain text: "queue" events with the queue position while waiting, text
+// events whose id is the offset reached, and a final "done" event with the
+// status of the answer.
+func streamJob(w http.ResponseWriter, r *http.Request, j *job, from int) {
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	from, ok := j.resume(from, sse)
+	if !ok {
+		jsonError(w, http.StatusBadRequest, "from is not an offset within the answer")
+		return
+	}
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	activeStreams.With().Inc()
+	defer activeStreams.With().Dec()
+	flusher, _ := w.(http.Flusher)
+	wrote := false
+	position := 0
+	for {
+		chunk, st, changed := j.since(from)
+		var err error
+		if sse && st.Position != position {
+			position = st.Position
+			err = writeEvent(w, "queue", "", map[string]int{"position": position})
+			wrote = true
+		}
+		if len(chunk) > 0 && err == nil {
+			from += len(chunk)
+			if sse {
+				err = writeEvent(w, "", strconv.Itoa(from), string(chunk))
+			} else {
+				_, err = w.Write(chunk)
+			}
+			wrote = true
+		}
+		if st.Done && err == nil {
+			if !wrote && from == 0 && st.Status == store.StatusFailed {
+				jsonError(w, http.StatusBadGateway, cmp.Or(st.Error, "generation failed"))
+				return
+			}
+			if sse {
+				err = writeEvent(w, "done", "", map[string]string{"status": st.Status, "error": st.Error})
+			}
+		}
+		if err != nil {
+			return
+		}
+		if flusher != nil && wrote {
+			flusher.Flush()
+		}
+		if st.Done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	if id != "" {
+		b.WriteString("id: " + id + "\n")
+	}
+	b.WriteString("data: " + string(data) + "\n\n")
+	_, err = io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// newTestJobs returns a job manager whose backend always fails, and a chat
+// store with one chat for userID "u".
+func newTestJobs(t *testing.T) (*jobManager, string) {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no model", http.StatusInternalServerError)
+	}))
+	t.Cleanup(backend.Close)
+	useSettings(t, map[string]string{"llm": backend.URL})
+	dir := t.TempDir()
+	chats, err := store.NewChatStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := store.NewUsageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatID, err := chats.Create("u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newJobManager(chats, usage, newGenerations(), newScheduler(0, nil, 0))
+	t.Cleanup(func() {
+		if !m.gens.wait(5 * time.Second) {
+			t.Error("generations still running")
+		}
+	})
+	return m, chatID
+}
+
+func TestReservePreparesOutsideLock(t *testing.T) {
+	m, chatID := newTestJobs(t)
+	preparing, proceed := make(chan struct{}), make(chan struct{})
+	reserved := make(chan error, 1)
+	go func() {
+		_, err := m.reserve(context.Background(), "u", chatID, func() (string, error) {
+			close(preparing)
+			<-proceed
+			return "hello", nil
+		})
+		reserved <- err
+	}()
+	<-preparing
+
+	// Other chats, and lookups of this one, go ahead while it prepares.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if !m.running("u", chatID) {
+			t.Error("chat being prepared is not running")
+		}
+		if _, err := m.reserve(context.Background(), "u", chatID, func() (string, error) { return "again", nil }); !errors.Is(err, errJobRunning) {
+			t.Errorf("second reserve of the chat: %v, want errJobRunning", err)
+		}
+		if _, err := m.reserve(context.Background(), "u", "other", func() (string, error) { return "", errors.New("no such chat") }); err == nil {
+			t.Error("reserve of another chat succeeded despite prepare failing")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job manager blocked while a prompt was being prepared")
+	}
+	close(proceed)
+	if err := <-reserved; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReserveRollsBack(t *testing.T) {
+	m, chatID := newTestJobs(t)
+	failure := errors.New("disk full")
+	if _, err := m.reserve(context.Background(), "u", chatID, func() (string, error) { return "", failure }); err != failure {
+		t.Fatalf("reserve: %v, want %v", err, failure)
+	}
+	if m.get("u", chatID) != nil {
+		t.Error("failed reservation left a job behind")
+	}
+	if n := m.gens.count(); n != 0 {
+		t.Errorf("%d generations still counted", n)
+	}
+	if running, waiting := m.sched.stats(); running+waiting != 0 {
+		t.Errorf("scheduler still holds %d running, %d waiting", running, waiting)
+	}
+	j, err := m.reserve(context.Background(), "u", chatID, func() (string, error) { return "hello", nil })
+	if err != nil {
+		t.Fatalf("reserve after rollback: %v", err)
+	}
+	waitDone(t, j)
+}
+
+func waitDone(t *testing.T, j *job) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		_, st, changed := j.since(0)
+		if st.Done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatal("job did not finish")
+		}
+	}
+}
+
+func TestJobResume(t *testing.T) {
+	j := &job{changed: make(chan struct{})}
+	j.write("héllo") // é is two bytes, at 1 and 2
+	for _, tc := range []struct {
+		from   int
+		events bool
+		want   int
+		ok     bool
+	}{
+		{0, true, 0, true},
+		{2, false, 2, true},
+		{2, true, 1, true},
+		{3, true, 3, true},
+		{6, true, 6, true},
+		{7, false, 0, false},
+		{-1, false, 0, false},
+	} {
+		got, ok := j.resume(tc.from, tc.events)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("resume(%d, %v) = %d, %v; want %d, %v", tc.from, tc.events, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestStreamRejectsBadOffsets(t *testing.T) {
+	j := &job{changed: make(chan struct{})}
+	j.write("hello")
+	j.finish("", "")
+	for _, from := range []int{6, 1 << 30} {
+		rec := httptest.NewRecorder()
+		streamJob(rec, httptest.NewRequest(http.MethodGet, "/chats/c/stream", nil), j, from)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("from=%d: status %d, want 400", from, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	streamJob(rec, httptest.NewRequest(http.MethodGet, "/chats/c/stream", nil), j, 2)
+	if rec.Code != http.StatusOK || rec.Body.String() != "llo" {
+		t.Errorf("from=2: status %d, body %q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,174 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// BER tags used by the LDAPv3 messages this package speaks.
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	appBindRequest      = 0x60
+	appBindResponse     = 0x61
+	appUnbindRequest    = 0x42
+	appSearchRequest    = 0x63
+	appSearchEntry      = 0x64
+	appSearchDone       = 0x65
+	appSearchReference  = 0x73
+	ctxSimpleAuth       = 0x80
+	filterAnd           = 0xa0
+	filterOr            = 0xa1
+	filterNot           = 0xa2
+	filterEqualityMatch = 0xa3
+	filterPresent       = 0x87
+)
+
+// maxPacket bounds the size of a single message read from the server.
+const maxPacket = 1 << 20
+
+var errMalformed = errors.New("ldap: malformed BER packet")
+
+// packet is a decoded BER element. Constructed elements have children.
+type packet struct {
+	tag      byte
+	value    []byte
+	children []*packet
+}
+
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for v := n; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func element(tag byte, content []byte) []byte {
+	out := append([]byte{tag}, encodeLength(len(content))...)
+	return append(out, content...)
+}
+
+func constructed(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, p := range parts {
+		content = append(content, p...)
+	}
+	return element(tag, content)
+}
+
+func encodeInt(tag byte, v int) []byte {
+	if v == 0 {
+		return element(tag, []byte{0})
+	}
+	var b []byte
+	for x := v; x > 0; x >>= 8 {
+		b = append([]byte{byte(x)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return element(tag, b)
+}
+
+func octetString(s string) []byte {
+	return element(tagOctetString, []byte(s))
+}
+
+func boolean(v bool) []byte {
+	if v {
+		return element(tagBoolean, []byte{0xff})
+	}
+	return element(tagBoolean, []byte{0})
+}
+
+// readPacket reads one complete BER element from r.
+func readPacket(r *bufio.Reader) ([]byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	header := []byte{tag, first}
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 4 {
+			return nil, errMalformed
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			header = append(header, b)
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxPacket {
+		return nil, errMalformed
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return append(header, body...), nil
+}
+
+// decode parses a single BER element and returns it with the remaining bytes.
+func decode(b []byte) (*packet, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errMalformed
+	}
+	p := &packet{tag: b[0]}
+	length := int(b[1])
+	off := 2
+	if b[1]&0x80 != 0 {
+		n := int(b[1] & 0x7f)
+		if n == 0 || n > 4 || len(b) < 2+n {
+			return nil, nil, errMalformed
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			length = length<<8 | int(b[2+i])
+		}
+		off += n
+	}
+	if length < 0 || len(b) < off+length {
+		return nil, nil, errMalformed
+	}
+	p.value = b[off : off+length]
+	if p.tag&0x20 != 0 {
+		rest := p.value
+		for len(rest) > 0 {
+			c, r, err := decode(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			p.children = append(p.children, c)
+			rest = r
+		}
+	}
+	return p, b[off+length:], nil
+}
+
+func (p *packet) int() int {
+	v := 0
+	for _, b := range p.value {
+		v = v<<8 | int(b)
+	}
+	return v
+}
@@ -0,0 +1,230 @@
+// Package ldap is a small LDAPv3 client that does just enough to
+// authenticate users: simple binds and searches with equality filters.
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Result codes from RFC 4511 that callers care about.
+const (
+	ResultSuccess            = 0
+	ResultSizeLimitExceeded  = 4
+	ResultInvalidCredentials = 49
+)
+
+// Error is a non-success LDAPResult returned by the server.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// IsInvalidCredentials reports whether err is a failed bind.
+func IsInvalidCredentials(err error) bool {
+	var le *Error
+	return errors.As(err, &le) && le.Code == ResultInvalidCredentials
+}
+
+// IsSizeLimitExceeded reports whether a search matched more entries than
+// its size limit allowed.
+func IsSizeLimitExceeded(err error) bool {
+	var le *Error
+	return errors.As(err, &le) && le.Code == ResultSizeLimitExceeded
+}
+
+// Entry is a search result.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the first value of attr, matched case-insensitively.
+func (e *Entry) Get(attr string) string {
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, attr) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// Conn is a single LDAP connection. It is not safe for concurrent use.
+type Conn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgID int
+}
+
+// Dial connects to an ldap:// or ldaps:// URL.
+func Dial(rawURL string, timeout time.Duration) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	d := &net.Dialer{Timeout: timeout}
+	var c net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		c, err = d.Dial("tcp", host)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		c, err = tls.DialWithDialer(d, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(timeout))
+	}
+	return &Conn{conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// Close sends an unbind request and closes the connection.
+func (c *Conn) Close() error {
+	c.msgID++
+	_, _ = c.conn.Write(constructed(tagSequence, encodeInt(tagInteger, c.msgID), element(appUnbindRequest, nil)))
+	return c.conn.Close()
+}
+
+func (c *Conn) send(op []byte) (int, error) {
+	c.msgID++
+	msg := constructed(tagSequence, encodeInt(tagInteger, c.msgID), op)
+	_, err := c.conn.Write(msg)
+	return c.msgID, err
+}
+
+// receive reads the next message for id and returns its protocol op.
+func (c *Conn) receive(id int) (*packet, error) {
+	for {
+		raw, err := readPacket(c.r)
+		if err != nil {
+			return nil, err
+		}
+		msg, _, err := decode(raw)
+		if err != nil {
+			return nil, err
+		}
+		if msg.tag != tagSequence || len(msg.children) < 2 {
+			return nil, errMalformed
+		}
+		if msg.children[0].int() != id {
+			continue
+		}
+		return msg.children[1], nil
+	}
+}
+
+func resultError(op *packet) error {
+	if len(op.children) < 3 {
+		return errMalformed
+	}
+	code := op.children[0].int()
+	if code == ResultSuccess {
+		return nil
+	}
+	return &Error{Code: code, Message: string(op.children[2].value)}
+}
+
+// Bind performs a simple bind. An empty password is refused locally because
+// servers treat it as an unauthenticated bind that always succeeds.
+func (c *Conn) Bind(dn, password string) error {
+	if dn != "" && password == "" {
+		return &Error{Code: ResultInvalidCredentials, Message: "empty password"}
+	}
+	id, err := c.send(constructed(appBindRequest,
+		encodeInt(tagInteger, 3),
+		octetString(dn),
+		element(ctxSimpleAuth, []byte(password)),
+	))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != appBindResponse {
+		return errMalformed
+	}
+	return resultError(op)
+}
+
+// Search scopes.
+const (
+	ScopeBase    = 0
+	ScopeSubtree = 2
+)
+
+// Search runs a search and returns at most sizeLimit entries.
+func (c *Conn) Search(baseDN string, scope int, filter string, attrs []string, sizeLimit int) ([]*Entry, error) {
+	f, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var attrList [][]byte
+	for _, a := range attrs {
+		attrList = append(attrList, octetString(a))
+	}
+	id, err := c.send(constructed(appSearchRequest,
+		octetString(baseDN),
+		encodeInt(tagEnumerated, scope),
+		encodeInt(tagEnumerated, 0), // never deref aliases
+		encodeInt(tagInteger, sizeLimit),
+		encodeInt(tagInteger, 0),
+		boolean(false),
+		f,
+		constructed(tagSequence, attrList...),
+	))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Entry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case appSearchEntry:
+			if len(op.children) < 2 {
+				return nil, errMalformed
+			}
+			e := &Entry{DN: string(op.children[0].value), Attributes: make(map[string][]string)}
+			for _, a := range op.children[1].children {
+				if len(a.children) < 2 {
+					continue
+				}
+				name := string(a.children[0].value)
+				for _, v := range a.children[1].children {
+					e.Attributes[name] = append(e.Attributes[name], string(v.value))
+				}
+			}
+			entries = append(entries, e)
+		case appSearchReference:
+			// Referrals are not followed.
+		case appSearchDone:
+			return entries, resultError(op)
+		default:
+			return nil, errMalformed
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// EscapeFilter escapes a value for safe use inside a search filter (RFC 4515).
+func EscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// compileFilter turns the string form of a filter into BER. It supports
+// the subset chatlocal needs: &, |, !, equality and presence.
+func compileFilter(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		s = "(" + s + ")"
+	}
+	out, rest, err := parseFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("ldap: trailing data in filter %q", s)
+	}
+	return out, nil
+}
+
+func parseFilter(s string) ([]byte, string, error) {
+	if len(s) < 3 || s[0] != '(' {
+		return nil, "", fmt.Errorf("ldap: bad filter %q", s)
+	}
+	switch s[1] {
+	case '&', '|':
+		tag := byte(filterAnd)
+		if s[1] == '|' {
+			tag = filterOr
+		}
+		rest := s[2:]
+		var parts [][]byte
+		for strings.HasPrefix(rest, "(") {
+			f, r, err := parseFilter(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			parts = append(parts, f)
+			rest = r
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", fmt.Errorf("ldap: unclosed filter %q", s)
+		}
+		return constructed(tag, parts...), rest[1:], nil
+	case '!':
+		f, rest, err := parseFilter(s[2:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", fmt.Errorf("ldap: unclosed filter %q", s)
+		}
+		return constructed(filterNot, f), rest[1:], nil
+	}
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("ldap: unclosed filter %q", s)
+	}
+	attr, value, ok := strings.Cut(s[1:end], "=")
+	if !ok || attr == "" {
+		return nil, "", fmt.Errorf("ldap: bad filter item %q", s[:end+1])
+	}
+	if value == "*" {
+		return element(filterPresent, []byte(attr)), s[end+1:], nil
+	}
+	raw, err := unescapeFilter(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return constructed(filterEqualityMatch, octetString(attr), octetString(raw)), s[end+1:], nil
+}
+
+func unescapeFilter(s string) (string, error) {
+	if strings.Contains(s, "*") {
+		return "", fmt.Errorf("ldap: substring filters are not supported: %q", s)
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("ldap: bad escape in %q", s)
+		}
+		v, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("ldap: bad escape in %q", s)
+		}
+		b.Write(v)
+		i += 2
+	}
+	return b.String(), nil
+}
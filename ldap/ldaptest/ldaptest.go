@@ -0,0 +1,335 @@
+// Package ldaptest runs a small in-memory LDAP server for tests. It answers
+// simple binds and searches with the filters package ldap sends, and keeps
+// the assertion values it was asked for so tests can check their escaping.
+package ldaptest
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Entry is a directory entry. Password, if set, is what binding as DN takes.
+type Entry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// Server serves Entries on a local port until Close.
+type Server struct {
+	Entries []Entry
+
+	ln     net.Listener
+	mu     sync.Mutex
+	values []string
+	wg     sync.WaitGroup
+}
+
+func NewServer(entries ...Entry) (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{Entries: entries, ln: ln}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// URL is the ldap:// URL to dial.
+func (s *Server) URL() string {
+	return "ldap://" + s.ln.Addr().String()
+}
+
+func (s *Server) Close() {
+	s.ln.Close()
+	s.wg.Wait()
+}
+
+// Values returns the equality assertion values of all searches so far.
+func (s *Server) Values() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.values...)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer c.Close()
+			s.handle(c)
+		}()
+	}
+}
+
+const (
+	resultSuccess            = 0
+	resultSizeLimitExceeded  = 4
+	resultInvalidCredentials = 49
+	resultProtocolError      = 2
+)
+
+func (s *Server) handle(c net.Conn) {
+	r := bufio.NewReader(c)
+	for {
+		msg, err := readMessage(r)
+		if err != nil || msg.tag != 0x30 || len(msg.children) < 2 {
+			return
+		}
+		id := msg.children[0].int()
+		op := msg.children[1]
+		var out []byte
+		switch op.tag {
+		case 0x60: // bind
+			out = message(id, result(0x61, s.bind(op)))
+		case 0x63: // search
+			out = s.search(id, op)
+		case 0x42: // unbind
+			return
+		default:
+			out = message(id, result(0x65, resultProtocolError))
+		}
+		if _, err := c.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) bind(op *node) int {
+	if len(op.children) < 3 {
+		return resultProtocolError
+	}
+	dn, password := string(op.children[1].value), string(op.children[2].value)
+	for _, e := range s.Entries {
+		if strings.EqualFold(e.DN, dn) && e.Password != "" && e.Password == password {
+			return resultSuccess
+		}
+	}
+	return resultInvalidCredentials
+}
+
+func (s *Server) search(id int, op *node) []byte {
+	if len(op.children) < 7 {
+		return message(id, result(0x65, resultProtocolError))
+	}
+	base := strings.ToLower(string(op.children[0].value))
+	scope := op.children[1].int()
+	limit := op.children[3].int()
+	filter := op.children[6]
+	s.record(filter)
+	var out []byte
+	n := 0
+	for _, e := range s.Entries {
+		dn := strings.ToLower(e.DN)
+		if scope == 0 && dn != base || scope != 0 && dn != base && !strings.HasSuffix(dn, ","+base) {
+			continue
+		}
+		if !matches(filter, e) {
+			continue
+		}
+		if limit > 0 && n == limit {
+			return append(out, message(id, result(0x65, resultSizeLimitExceeded))...)
+		}
+		n++
+		var attrs [][]byte
+		for name, values := range e.Attributes {
+			var vs [][]byte
+			for _, v := range values {
+				vs = append(vs, element(0x04, []byte(v)))
+			}
+			attrs = append(attrs, constructed(0x30, element(0x04, []byte(name)), constructed(0x31, vs...)))
+		}
+		out = append(out, message(id, constructed(0x64, element(0x04, []byte(e.DN)), constructed(0x30, attrs...)))...)
+	}
+	return append(out, message(id, result(0x65, resultSuccess))...)
+}
+
+func (s *Server) record(f *node) {
+	if f.tag == 0xa3 {
+		if len(f.children) == 2 {
+			s.mu.Lock()
+			s.values = append(s.values, string(f.children[1].value))
+			s.mu.Unlock()
+		}
+		return
+	}
+	for _, c := range f.children {
+		s.record(c)
+	}
+}
+
+func matches(f *node, e Entry) bool {
+	switch f.tag {
+	case 0xa0: // and
+		for _, c := range f.children {
+			if !matches(c, e) {
+				return false
+			}
+		}
+		return true
+	case 0xa1: // or
+		for _, c := range f.children {
+			if matches(c, e) {
+				return true
+			}
+		}
+		return false
+	case 0xa2: // not
+		return len(f.children) == 1 && !matches(f.children[0], e)
+	case 0xa3: // equality
+		if len(f.children) != 2 {
+			return false
+		}
+		for _, v := range attr(e, string(f.children[0].value)) {
+			if strings.EqualFold(v, string(f.children[1].value)) {
+				return true
+			}
+		}
+		return false
+	case 0x87: // present
+		return len(attr(e, string(f.value))) > 0
+	}
+	return false
+}
+
+func attr(e Entry, name string) []string {
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// A minimal BER codec, enough for the messages above.
+
+type node struct {
+	tag      byte
+	value    []byte
+	children []*node
+}
+
+func (n *node) int() int {
+	v := 0
+	for _, b := range n.value {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+var errMalformed = errors.New("ldaptest: malformed message")
+
+func readMessage(r *bufio.Reader) (*node, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		length = 0
+		for i := 0; i < int(first&0x7f); i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > 1<<20 {
+		return nil, errMalformed
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return parse(tag, body)
+}
+
+func parse(tag byte, value []byte) (*node, error) {
+	n := &node{tag: tag, value: value}
+	if tag&0x20 == 0 {
+		return n, nil
+	}
+	for rest := value; len(rest) > 0; {
+		if len(rest) < 2 {
+			return nil, errMalformed
+		}
+		t, length, off := rest[0], int(rest[1]), 2
+		if rest[1]&0x80 != 0 {
+			k := int(rest[1] & 0x7f)
+			if len(rest) < 2+k {
+				return nil, errMalformed
+			}
+			length = 0
+			for _, b := range rest[2 : 2+k] {
+				length = length<<8 | int(b)
+			}
+			off += k
+		}
+		if len(rest) < off+length {
+			return nil, errMalformed
+		}
+		c, err := parse(t, rest[off:off+length])
+		if err != nil {
+			return nil, err
+		}
+		n.children = append(n.children, c)
+		rest = rest[off+length:]
+	}
+	return n, nil
+}
+
+func element(tag byte, content []byte) []byte {
+	n := len(content)
+	if n < 0x80 {
+		return append([]byte{tag, byte(n)}, content...)
+	}
+	var l []byte
+	for v := n; v > 0; v >>= 8 {
+		l = append([]byte{byte(v)}, l...)
+	}
+	out := append([]byte{tag, 0x80 | byte(len(l))}, l...)
+	return append(out, content...)
+}
+
+func constructed(tag byte, parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return element(tag, b)
+}
+
+func integer(tag byte, v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return element(tag, b)
+}
+
+func message(id int, op []byte) []byte {
+	return constructed(0x30, integer(0x02, id), op)
+}
+
+func result(tag byte, code int) []byte {
+	return constructed(tag, integer(0x0a, code), element(0x04, nil), element(0x04, nil))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/ldap"
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// ldapAuthenticator checks passwords against a directory with the usual
+// search-then-bind: find the user's DN with a service account, optionally
+// check group membership, then bind as the user. Local accounts are created
+// on first successful login.
+type ldapAuthenticator struct {
+	URL          string
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	UserFilter   string // %s is replaced with the escaped login name
+	GroupDN      string
+	MailAttr     string
+	Timeout      time.Duration
+	// LinkAccounts lets a directory login take over a local account with
+	// the same email that has its own password. Without it only accounts
+	// without a password are linked, and the others keep logging in locally.
+	LinkAccounts bool
+
+	users *store.UserStore
+}
+
+func (a *ldapAuthenticator) Authenticate(ctx context.Context, username, password string) (*store.User, error) {
+	conn, err := ldap.Dial(a.URL, a.Timeout)
+	if err != nil {
+		slog.ErrorContext(ctx, "ldap dial", "err", err)
+		return nil, store.ErrUnavailable
+	}
+	defer conn.Close()
+	if err := conn.Bind(a.BindDN, a.BindPassword); err != nil {
+		slog.ErrorContext(ctx, "ldap service bind", "err", err)
+		return nil, store.ErrUnavailable
+	}
+	filter := strings.ReplaceAll(a.UserFilter, "%s", ldap.EscapeFilter(username))
+	// A limit of 2 is enough to tell an ambiguous filter; servers report
+	// that as sizeLimitExceeded rather than returning both entries.
+	entries, err := conn.Search(a.BaseDN, ldap.ScopeSubtree, filter, []string{a.MailAttr}, 2)
+	if err != nil && !ldap.IsSizeLimitExceeded(err) {
+		slog.ErrorContext(ctx, "ldap search", "err", err)
+		return nil, store.ErrUnavailable
+	}
+	if err != nil || len(entries) > 1 {
+		// Not ErrUserNotFound: the local password store must not get a
+		// chance at a name the directory cannot resolve.
+		slog.WarnContext(ctx, "ldap filter matches more than one entry", "filter", filter)
+		return nil, store.ErrInvalidCredentials
+	}
+	if len(entries) == 0 {
+		return nil, store.ErrUserNotFound
+	}
+	entry := entries[0]
+	email := strings.TrimSpace(strings.ToLower(entry.Get(a.MailAttr)))
+	if email == "" {
+		email = username
+	}
+	if _, err := mail.ParseAddress(email); err != nil {
+		slog.WarnContext(ctx, "ldap user has no usable mail attribute", "dn", entry.DN, "attribute", a.MailAttr)
+		return nil, store.ErrInvalidCredentials
+	}
+	link := store.LinkPasswordless
+	if a.LinkAccounts {
+		link = store.LinkAny
+	}
+	// Checked before the bind, so the owner of a local account that the
+	// directory may not take over can still log in with the local password.
+	if a.users.CheckLink(email, "ldap", entry.DN, link) == store.ErrNotLinked {
+		slog.WarnContext(ctx, "ldap user matches a local account with a password; not linking", "dn", entry.DN, "email", email)
+		return nil, store.ErrUserNotFound
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsInvalidCredentials(err) {
+			return nil, store.ErrInvalidCredentials
+		}
+		slog.ErrorContext(ctx, "ldap user bind", "err", err)
+		return nil, store.ErrUnavailable
+	}
+	if a.GroupDN != "" {
+		dn := ldap.EscapeFilter(entry.DN)
+		members, err := conn.Search(a.GroupDN, ldap.ScopeBase, fmt.Sprintf("(|(member=%s)(uniqueMember=%s))", dn, dn), []string{"cn"}, 1)
+		if err != nil {
+			slog.ErrorContext(ctx, "ldap group search", "err", err)
+			return nil, store.ErrUnavailable
+		}
+		if len(members) == 0 {
+			slog.InfoContext(ctx, "ldap user not in group", "dn", entry.DN, "group", a.GroupDN)
+			return nil, store.ErrInvalidCredentials
+		}
+	}
+	u, created, err := a.users.External(email, "ldap", entry.DN, true, link)
+	if err != nil {
+		switch err {
+		case store.ErrIdentityMismatch:
+			return nil, store.ErrInvalidCredentials
+		case store.ErrNotLinked:
+			// A local password was set after the check above.
+			return nil, store.ErrUserNotFound
+		}
+		return nil, err
+	}
+	if created {
+		slog.InfoContext(ctx, "ldap created user", "email", email)
+	}
+	if a.users.IsDisabled(u.ID) {
+		return nil, store.ErrAccountDisabled
+	}
+	return u, nil
+}
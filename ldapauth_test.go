@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/ldap/ldaptest"
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+const (
+	ldapPeople = "ou=people,dc=example,dc=com"
+	ldapGroup  = "cn=chat,ou=groups,dc=example,dc=com"
+)
+
+func ldapPerson(uid, password, mail string) ldaptest.Entry {
+	return ldaptest.Entry{
+		DN:         "uid=" + uid + "," + ldapPeople,
+		Password:   password,
+		Attributes: map[string][]string{"uid": {uid}, "mail": {mail}},
+	}
+}
+
+func newLDAPTest(t *testing.T) (*ldaptest.Server, *ldapAuthenticator) {
+	t.Helper()
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=svc,dc=example,dc=com", Password: "svc-secret"},
+		ldapPerson("alice", "alice-pw", "alice@example.com"),
+		ldapPerson("bob", "bob-pw", "bob@example.com"),
+		ldapPerson("carol", "carol-pw", "carol@example.com"),
+		ldapPerson("twin1", "twin-pw", "twin@example.com"),
+		ldapPerson("twin2", "twin-pw", "twin@example.com"),
+		ldaptest.Entry{DN: ldapGroup, Attributes: map[string][]string{"member": {
+			"uid=alice," + ldapPeople,
+			"uid=carol," + ldapPeople,
+			"uid=twin1," + ldapPeople,
+			"uid=twin2," + ldapPeople,
+		}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	users, err := store.NewUserStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, &ldapAuthenticator{
+		URL:          srv.URL(),
+		BindDN:       "cn=svc,dc=example,dc=com",
+		BindPassword: "svc-secret",
+		BaseDN:       ldapPeople,
+		UserFilter:   "(mail=%s)",
+		GroupDN:      ldapGroup,
+		MailAttr:     "mail",
+		Timeout:      5 * time.Second,
+		users:        users,
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	_, a := newLDAPTest(t)
+	for _, tc := range []struct {
+		name, username, password string
+		want                     error
+	}{
+		{"wrong password", "alice@example.com", "nope", store.ErrInvalidCredentials},
+		{"empty password", "alice@example.com", "", store.ErrInvalidCredentials},
+		{"not in group", "bob@example.com", "bob-pw", store.ErrInvalidCredentials},
+		{"no entry", "nobody@example.com", "whatever", store.ErrUserNotFound},
+		{"more than one entry", "twin@example.com", "twin-pw", store.ErrInvalidCredentials},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := a.Authenticate(context.Background(), tc.username, tc.password)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("got %v, %v; want %v", u, err, tc.want)
+			}
+			if a.users.ByUsername(tc.username) != nil {
+				t.Errorf("local account created for %s", tc.username)
+			}
+		})
+	}
+
+	u, err := a.Authenticate(context.Background(), "alice@example.com", "alice-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "alice@example.com" || u.Source != "ldap" || u.ExternalID != "uid=alice,"+ldapPeople {
+		t.Errorf("provisioned %+v", u)
+	}
+}
+
+func TestLDAPAmbiguousDoesNotFallBack(t *testing.T) {
+	_, a := newLDAPTest(t)
+	if _, err := a.users.Register("twin@example.com", "local password"); err != nil {
+		t.Fatal(err)
+	}
+	chain := store.Chain{a, a.users}
+	if _, err := chain.Authenticate(context.Background(), "twin@example.com", "local password"); !errors.Is(err, store.ErrInvalidCredentials) {
+		t.Errorf("ambiguous directory entry: got %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestLDAPFilterEscaping(t *testing.T) {
+	srv, a := newLDAPTest(t)
+	for _, name := range []string{"*", "*)(mail=*", `alice@example.com)(|(uid=*`, `a\b(c)*@example.com`} {
+		if _, err := a.Authenticate(context.Background(), name, "alice-pw"); !errors.Is(err, store.ErrUserNotFound) {
+			t.Errorf("%q: got %v, want ErrUserNotFound", name, err)
+		}
+		// The server must see the name as one literal value.
+		if values := srv.Values(); !slices.Contains(values, name) {
+			t.Errorf("%q: server got assertion values %q", name, values)
+		}
+	}
+}
+
+func TestLDAPDoesNotTakeOverPasswordAccounts(t *testing.T) {
+	_, a := newLDAPTest(t)
+	local, err := a.users.Register("carol@example.com", "local password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(context.Background(), "carol@example.com", "carol-pw"); !errors.Is(err, store.ErrUserNotFound) {
+		t.Fatalf("got %v, want ErrUserNotFound", err)
+	}
+	if u := a.users.ByID(local.ID); u.ExternalID != "" {
+		t.Fatalf("account linked to %s", u.ExternalID)
+	}
+	// The local password still works through the chain, the directory's does not.
+	chain := store.Chain{a, a.users}
+	if _, err := chain.Authenticate(context.Background(), "carol@example.com", "carol-pw"); err == nil {
+		t.Error("directory password opened the local account")
+	}
+	if u, err := chain.Authenticate(context.Background(), "carol@example.com", "local password"); err != nil || u.ID != local.ID {
+		t.Errorf("local password: got %v, %v", u, err)
+	}
+
+	a.LinkAccounts = true
+	u, err := a.Authenticate(context.Background(), "carol@example.com", "carol-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != local.ID || u.Source != "ldap" {
+		t.Errorf("with -ldap-link-accounts: got %+v", u)
+	}
+}
+
+func TestLDAPUnavailable(t *testing.T) {
+	srv, a := newLDAPTest(t)
+	srv.Close()
+	if _, err := a.Authenticate(context.Background(), "alice@example.com", "alice-pw"); !errors.Is(err, store.ErrUnavailable) {
+		t.Errorf("got %v, want ErrUnavailable", err)
+	}
+}
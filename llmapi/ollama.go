@@ -3,12 +3,22 @@ package ollama
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 )
 
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose requests to Ollama carry id in the
+// X-Request-Id header, so they can be matched with the request that caused them.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
 // Request Ollama JSON request
 type Request struct {
 	Model  string `json:"model"`
@@ -16,22 +26,43 @@ type Request struct {
 }
 
 func (request Request) SendRequest(url string) (*http.Response, error) {
+	return request.SendRequestContext(context.Background(), url)
+}
+
+// SendRequestContext is SendRequest with a context; cancelling ctx aborts
+// the request and any stream still being read from the response.
+func (request Request) SendRequestContext(ctx context.Context, url string) (*http.Response, error) {
 	data, err := json.Marshal(request)
 	if err != nil {
 		return nil, err
 	}
 
-	httpRequest, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	httpRequest, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
 	if err != nil {
 		return nil, err
 	}
 	httpRequest.Header.Set("Content-Type", "application/json")
+	if id, _ := ctx.Value(requestIDKey{}).(string); id != "" {
+		httpRequest.Header.Set("X-Request-Id", id)
+	}
+	slog.DebugContext(ctx, "ollama request", "url", url, "model", request.Model)
 
 	client := &http.Client{}
 	httpResponse, err := client.Do(httpRequest)
 	if err != nil {
 		return nil, err
 	}
+	if httpResponse.StatusCode != http.StatusOK {
+		defer httpResponse.Body.Close()
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(io.LimitReader(httpResponse.Body, 4096)).Decode(&e)
+		if e.Error == "" {
+			e.Error = httpResponse.Status
+		}
+		return nil, fmt.Errorf("ollama: %s", e.Error)
+	}
 
 	return httpResponse, nil
 }
@@ -41,32 +72,145 @@ type Response struct {
 	Response  string `json:"response"`
 	Done      bool   `json:"done"`
 	CreatedAt string `json:"created_at"`
+
+	// Set instead of a response when generation fails part way.
+	Error string `json:"error,omitempty"`
+
+	// Set on the final chunk only. Durations are in nanoseconds.
+	PromptEvalCount    int   `json:"prompt_eval_count"`
+	EvalCount          int   `json:"eval_count"`
+	TotalDuration      int64 `json:"total_duration"`
+	LoadDuration       int64 `json:"load_duration"`
+	PromptEvalDuration int64 `json:"prompt_eval_duration"`
+	EvalDuration       int64 `json:"eval_duration"`
 }
 
 func GetResponse(httpResponse *http.Response, writer http.ResponseWriter) error {
+	_, err := Stream(httpResponse, func(paragraph string) error {
+		if _, err := fmt.Fprintf(writer, "%s\n\n", paragraph); err != nil {
+			slog.ErrorContext(httpResponse.Request.Context(), "write response", "err", err)
+			return err
+		}
+		writer.(http.Flusher).Flush()
+		return nil
+	})
+	return err
+}
+
+// StreamError is an error Ollama reported in place of a chunk, after
+// generation had started.
+type StreamError struct {
+	Message string
+}
+
+func (e *StreamError) Error() string {
+	return "ollama: " + e.Message
+}
+
+// Stream reads a streamed generation and calls emit with the text up to
+// each line break, so callers can show whole paragraphs as they complete.
+// It returns the final chunk, which carries the generation statistics.
+// If the stream breaks off, is malformed or reports an error, the text so
+// far is emitted before the error is returned.
+func Stream(httpResponse *http.Response, emit func(paragraph string) error) (*Response, error) {
 	var sentence string
+	fail := func(err error) (*Response, error) {
+		// Keep what was generated before the stream broke off.
+		if sentence != "" {
+			_ = emit(sentence)
+		}
+		return nil, err
+	}
 	scanner := bufio.NewScanner(httpResponse.Body)
 	for scanner.Scan() {
 		line := scanner.Text()
 
 		var data Response
-		err := json.Unmarshal([]byte(line), &data)
-		if err != nil {
-			return err
+		if err := json.Unmarshal([]byte(line), &data); err != nil {
+			return fail(fmt.Errorf("ollama: bad stream line: %w", err))
+		}
+		if data.Error != "" {
+			return fail(&StreamError{Message: data.Error})
 		}
 		if data.Response == "\n\n" || data.Response == "\n" || data.Done {
-			_, err := fmt.Fprintf(writer, "%s\n\n", sentence)
-			if err != nil {
-				log.Println(err)
-				return err
+			if err := emit(sentence); err != nil {
+				return nil, err
 			}
-			writer.(http.Flusher).Flush()
 			sentence = ""
 		} else {
 			sentence += data.Response
 		}
-		// fmt.Print(data.Response)
+		if data.Done {
+			return &data, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fail(err)
 	}
+	return fail(io.ErrUnexpectedEOF)
+}
+
+// Models returns the names of the models installed on the Ollama server
+// at baseURL, such as "gemma3:latest".
+func Models(ctx context.Context, baseURL string) ([]string, error) {
+	return listModels(ctx, baseURL+"/api/tags")
+}
 
-	return nil
+// Loaded returns the names of the models Ollama currently holds in memory.
+func Loaded(ctx context.Context, baseURL string) ([]string, error) {
+	return listModels(ctx, baseURL+"/api/ps")
+}
+
+// Load asks the Ollama server at baseURL to load model into memory, and
+// returns once it has. A generate request without a prompt does that.
+func Load(ctx context.Context, baseURL, model string) error {
+	resp, err := Request{Model: model}.SendRequestContext(ctx, baseURL+"/api/generate")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+func listModels(ctx context.Context, url string) ([]string, error) {
+	httpRequest, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if id, _ := ctx.Value(requestIDKey{}).(string); id != "" {
+		httpRequest.Header.Set("X-Request-Id", id)
+	}
+	httpResponse, err := http.DefaultClient.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama: %s", httpResponse.Status)
+	}
+	var list struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(httpResponse.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(list.Models))
+	for i, m := range list.Models {
+		names[i] = m.Name
+	}
+	return names, nil
+}
+
+// HasModel reports whether model is among names. A model without a tag
+// matches its "latest" tag, as it does when prompting.
+func HasModel(names []string, model string) bool {
+	for _, n := range names {
+		if n == model || n == model+":latest" {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,88 @@
+package ollama
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	const hello = `{"response":"Hello"}` + "\n" + `{"response":" world"}` + "\n"
+	for _, tc := range []struct {
+		name, body string
+		emitted    []string
+		err        string // substring of the error, "" for none
+	}{
+		{
+			name:    "complete",
+			body:    hello + `{"response":"\n"}` + "\n" + `{"response":"Bye"}` + "\n" + `{"done":true,"eval_count":4}` + "\n",
+			emitted: []string{"Hello world", "Bye"},
+		},
+		{
+			name:    "truncated",
+			body:    hello,
+			emitted: []string{"Hello world"},
+			err:     io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:    "malformed line",
+			body:    hello + `{"response":` + "\n",
+			emitted: []string{"Hello world"},
+			err:     "bad stream line",
+		},
+		{
+			name:    "error line",
+			body:    hello + `{"error":"model runner has unexpectedly stopped"}` + "\n",
+			emitted: []string{"Hello world"},
+			err:     "ollama: model runner has unexpectedly stopped",
+		},
+		{
+			name: "error before any text",
+			body: `{"error":"out of memory"}` + "\n",
+			err:  "out of memory",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{Body: io.NopCloser(strings.NewReader(tc.body))}
+			var emitted []string
+			final, err := Stream(resp, func(p string) error {
+				emitted = append(emitted, p)
+				return nil
+			})
+			if !slices.Equal(emitted, tc.emitted) {
+				t.Errorf("emitted %q, want %q", emitted, tc.emitted)
+			}
+			if tc.err == "" {
+				if err != nil || final == nil || final.EvalCount != 4 {
+					t.Errorf("final %+v, %v", final, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error %v, want %q", err, tc.err)
+			}
+			if final != nil {
+				t.Errorf("final chunk %+v on error", final)
+			}
+			var se *StreamError
+			if isErrorLine := strings.Contains(tc.body, `"error"`); errors.As(err, &se) != isErrorLine {
+				t.Errorf("error %#v: StreamError is %v, want %v", err, !isErrorLine, isErrorLine)
+			}
+		})
+	}
+}
+
+func TestStreamStopsWhenEmitFails(t *testing.T) {
+	stop := errors.New("client gone")
+	resp := &http.Response{Body: io.NopCloser(strings.NewReader(`{"response":"a"}` + "\n" + `{"response":"\n"}` + "\n" + `{"response":"b"}` + "\n"))}
+	calls := 0
+	if _, err := Stream(resp, func(string) error { calls++; return stop }); err != stop {
+		t.Errorf("error %v, want %v", err, stop)
+	}
+	if calls != 1 {
+		t.Errorf("emit called %d times after failing", calls)
+	}
+}
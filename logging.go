@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// logLevelVar holds the log level, so that it can change while the
+// server runs.
+var logLevelVar slog.LevelVar
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("%q: use debug, info, warn or error", s)
+	}
+	return l, nil
+}
+
+// newLogger returns a logger writing to w at logLevelVar in format ("text"
+// or "json"). Records logged with a request context carry its request and
+// user ID.
+func newLogger(w io.Writer, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: &logLevelVar}
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("%q: use text or json", format)
+	}
+	return slog.New(contextHandler{h}), nil
+}
+
+// contextHandler adds the request and user ID from the context to records.
+type contextHandler struct{ slog.Handler }
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if info := store.RequestFromContext(ctx); info != nil {
+		r.AddAttrs(slog.String("request_id", info.ID))
+		if info.UserID != "" {
+			r.AddAttrs(slog.String("user_id", info.UserID))
+		}
+	} else if id := store.UserIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("user_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal logs an error and exits, for problems found while starting up.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// validRequestID reports whether an incoming X-Request-Id is safe to reuse:
+// short and made of characters that cannot break a log line.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID gives every request an ID, taken from a well-formed
+// X-Request-Id header or generated, and returns it in X-Request-Id. The
+// ID travels in the request context to the logs and to the LLM backend.
+func requestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-Id", id)
+		ctx := store.ContextWithRequest(r.Context(), &store.RequestInfo{ID: id})
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
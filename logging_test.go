@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = ""
+		if info := store.RequestFromContext(r.Context()); info != nil {
+			seen = info.ID
+		}
+	}))
+	get := func(incoming string) string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if incoming != "" {
+			req.Header.Set("X-Request-Id", incoming)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if got := rec.Header().Get("X-Request-Id"); got != seen {
+			t.Errorf("%q: the response has ID %q, the handler saw %q", incoming, got, seen)
+		}
+		return seen
+	}
+
+	for _, id := range []string{"abc-123", "1-5f84c7a1:span_2.x", strings.Repeat("a", 64)} {
+		if got := get(id); got != id {
+			t.Errorf("well-formed %q was replaced by %q", id, got)
+		}
+	}
+	generated := map[string]bool{}
+	for _, id := range []string{"", "has space", "line\nbreak", `"quoted"`, "a=b", "é", strings.Repeat("a", 65)} {
+		got := get(id)
+		if len(got) != 16 || strings.Trim(got, "0123456789abcdef") != "" {
+			t.Errorf("%q: generated ID %q", id, got)
+		}
+		generated[got] = true
+	}
+	if len(generated) != 7 {
+		t.Errorf("generated IDs repeat: %v", generated)
+	}
+}
+
+func TestRequestIDReachesLogsAndOllama(t *testing.T) {
+	var backendID string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendID = r.Header.Get("X-Request-Id")
+		json.NewEncoder(w).Encode(map[string]any{"response": "hi", "done": true})
+	}))
+	t.Cleanup(backend.Close)
+
+	var logs bytes.Buffer
+	logger, err := newLogger(&logs, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := store.ContextWithUserID(r.Context(), "u1")
+		resp, err := promptLLM(ctx, backend.URL, "gemma3", "hello")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		logger.InfoContext(ctx, "answered")
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/prompt", nil)
+	req.Header.Set("X-Request-Id", "trace-42")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if backendID != "trace-42" {
+		t.Errorf("Ollama got request ID %q", backendID)
+	}
+	var line map[string]any
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatalf("%v: %s", err, logs.Bytes())
+	}
+	if line["request_id"] != "trace-42" || line["user_id"] != "u1" {
+		t.Errorf("log line %s", logs.Bytes())
+	}
+
+	// Outside a request only the user is known, if anyone.
+	logs.Reset()
+	logger.InfoContext(store.ContextWithUserID(t.Context(), "u2"), "background")
+	if s := logs.String(); strings.Contains(s, "request_id") || !strings.Contains(s, `"user_id":"u2"`) {
+		t.Errorf("log line %s", s)
+	}
+	logs.Reset()
+	logger.With(slog.String("job", "j1")).InfoContext(t.Context(), "plain")
+	if s := logs.String(); strings.Contains(s, "_id") || !strings.Contains(s, `"job":"j1"`) {
+		t.Errorf("log line %s", s)
+	}
+}
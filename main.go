@@ -1,63 +1,98 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"html/template"
-	"log"
-	"net/mail"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/mail"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/agerasimovski/chatlocal/llmapi"
+	"github.com/agerasimovski/chatlocal/metrics"
+	"github.com/agerasimovski/chatlocal/oidc"
 	"github.com/agerasimovski/chatlocal/store"
 )
 
 var (
-	web  = flag.String("web", "localhost:8080", "Web server")
-	data = flag.String("data", "data", "Data directory for users and chats")
-	llm  = flag.String("llm", "localhost:11434/api/generate", "LLM server")
-	model = flag.String("model", "gemma3", "LLM model")
+	web            = flag.String("web", "localhost:8080", "Web server")
+	data           = flag.String("data", "data", "Data directory for users and chats")
+	llm            = flag.String("llm", "http://localhost:11434", "Ollama server URL, e.g. https://gpu.example.com/ollama")
+	model          = flag.String("model", "gemma3", "LLM model")
+	registration   = flag.String("registration", "open", "Registration mode: open, closed, invite or domain")
+	allowedDomains = flag.String("allowed-domains", "", "Comma-separated email domains allowed to register in domain mode")
+	require2FA     = flag.Bool("require-2fa", false, "Require every user to enable two-factor authentication")
+	passwordLogin  = flag.Bool("password-login", true, "Allow logging in and registering with local passwords")
+	oidcIssuer     = flag.String("oidc-issuer", "", "OpenID Connect issuer URL; enables single sign-on")
+	oidcClientID   = flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcSecret     = flag.String("oidc-client-secret", "", "OpenID Connect client secret (optional with PKCE)")
+	oidcRedirect   = flag.String("oidc-redirect-url", "", "Callback URL registered with the provider, ending in /login/oidc/callback")
+	ldapURL        = flag.String("ldap-url", "", "LDAP server, ldap://host or ldaps://host; enables directory logins")
+	ldapBindDN     = flag.String("ldap-bind-dn", "", "DN of the service account used to look up users")
+	ldapBindPass   = flag.String("ldap-bind-password", "", "Password of the LDAP service account")
+	ldapBaseDN     = flag.String("ldap-base-dn", "", "Base DN to search for users")
+	ldapFilter     = flag.String("ldap-user-filter", "(mail=%s)", "Search filter for users; %s is the login name")
+	ldapGroupDN    = flag.String("ldap-group-dn", "", "Only allow members of this group (member or uniqueMember)")
+	ldapLink       = flag.Bool("ldap-link-accounts", false, "Let directory logins take over local accounts that have a password")
+	tlsCert        = flag.String("tls-cert", "", "TLS certificate file; serves HTTPS together with -tls-key")
+	tlsKey         = flag.String("tls-key", "", "TLS private key file")
+	tlsSelfSigned  = flag.Bool("tls-self-signed", false, "Serve HTTPS with a self-signed certificate generated in the data directory")
+	trustedProxies = flag.String("trusted-proxies", "", "Comma-separated proxy IPs or CIDRs whose X-Forwarded-For/-Proto headers are trusted")
+	maxGenerations = flag.Int("max-generations", 2, "Maximum generations running at once; 0 for no limit")
+	modelLimit     = flag.String("model-concurrency", "", "Per-model limits on running generations, e.g. llama3:70b=1,gemma3=2")
+	maxQueue       = flag.Int("max-queue", 50, "Maximum generations waiting for a slot; 0 for no limit")
+	ratePerMinute  = flag.Int("rate-limit", 0, "Prompts each user may send per minute; 0 for no limit")
+	dailyTokens    = flag.Int("daily-token-quota", 0, "Prompt plus completion tokens each user may use per day; 0 for no limit")
+	monthlyTokens  = flag.Int("monthly-token-quota", 0, "Prompt plus completion tokens each user may use per calendar month; 0 for no limit")
+	shutdownWait   = flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for running generations on shutdown before saving them as interrupted")
+	metricsListen  = flag.String("metrics-listen", "", "Separate address serving /metrics without authentication, e.g. localhost:9100")
+	metricsToken   = flag.String("metrics-token", "", "Serve /metrics on the web server to callers with this bearer token")
+	logLevel       = flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	logFormat      = flag.String("log-format", "text", "Log format: text or json")
+	logPrompts     = flag.Bool("log-prompts", false, "Log the text of every prompt; off by default for privacy")
+	devMode        = flag.Bool("dev", false, "Read pages and static files from the working directory on every request and reload open pages when they change")
+	trustedOrigins = flag.String("trusted-origins", "", "Comma-separated extra origins (scheme://host[:port]) allowed to send state-changing requests")
+	publicURL      = flag.String("public-url", "", "URL users reach the server at, e.g. https://chat.example.com; used in links the commands print")
 )
 
 type promptBody struct {
 	Text   string `json:"text"`
 	ChatID string `json:"chatId"`
+	// Retry answers the last prompt of ChatID again instead of Text.
+	Retry bool `json:"retry"`
 }
 
-func promptLLM(text string) (*http.Response, error) {
-	request := ollama.Request{Model: *model, Prompt: text}
-	return request.SendRequest("http://" + *llm)
-}
-
-func responseStream(w http.ResponseWriter, httpResponse *http.Response) error {
-	return ollama.GetResponse(httpResponse, w)
-}
-
-// teeResponseWriter writes to both the client and a buffer (for saving the full response).
-type teeResponseWriter struct {
-	http.ResponseWriter
-	buf *bytes.Buffer
-}
-
-func (t *teeResponseWriter) Write(p []byte) (n int, err error) {
-	t.buf.Write(p)
-	return t.ResponseWriter.Write(p)
-}
-
-func (t *teeResponseWriter) Flush() {
-	if f, ok := t.ResponseWriter.(http.Flusher); ok {
-		f.Flush()
+func promptLLM(ctx context.Context, llm, model, text string) (*http.Response, error) {
+	request := ollama.Request{Model: model, Prompt: text}
+	if info := store.RequestFromContext(ctx); info != nil {
+		ctx = ollama.WithRequestID(ctx, info.ID)
 	}
+	return request.SendRequestContext(ctx, llm+"/api/generate")
 }
 
-func registerHandler(users *store.UserStore, sessions *store.SessionStore) http.HandlerFunc {
+func registerHandler(users *store.UserStore, sessions *store.SessionStore, invites *store.InviteStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		policy := current().Policy
+		if r.Method == http.MethodGet {
+			// Lets the login page know which fields to show.
+			w.Header().Set("Content-Type", "application/json")
+			mode := policy.Mode
+			if !*passwordLogin {
+				mode = regClosed
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"mode": mode, "domains": policy.Domains})
+			return
+		}
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -65,11 +100,16 @@ func registerHandler(users *store.UserStore, sessions *store.SessionStore) http.
 		var body struct {
 			Username string `json:"username"`
 			Password string `json:"password"`
+			Invite   string `json:"invite"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
+		if !*passwordLogin {
+			jsonError(w, http.StatusForbidden, "accounts are created through single sign-on")
+			return
+		}
 		email := strings.TrimSpace(strings.ToLower(body.Username))
 		if _, err := mail.ParseAddress(email); err != nil {
 			w.Header().Set("Content-Type", "application/json")
@@ -83,8 +123,16 @@ func registerHandler(users *store.UserStore, sessions *store.SessionStore) http.
 			json.NewEncoder(w).Encode(map[string]string{"error": "password must be at least 8 characters long"})
 			return
 		}
+		used, status, msg := policy.admit(invites, email, body.Invite)
+		if status != 0 {
+			jsonError(w, status, msg)
+			return
+		}
 		u, err := users.Register(email, body.Password)
 		if err != nil {
+			if used != "" {
+				invites.Release(used)
+			}
 			if err == store.ErrUserExists {
 				w.Header().Set("Content-Type", "application/json")
 				w.WriteHeader(http.StatusConflict)
@@ -97,30 +145,49 @@ func registerHandler(users *store.UserStore, sessions *store.SessionStore) http.
 				json.NewEncoder(w).Encode(map[string]string{"error": "invalid credentials"})
 				return
 			}
-			log.Println("register:", err)
+			slog.ErrorContext(r.Context(), "register", "err", err)
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		sid, err := sessions.Create(u.ID)
-		if err != nil {
-			log.Println("session create:", err)
-			http.Error(w, "internal error", http.StatusInternalServerError)
+		if !startSession(w, r, sessions, u.ID) {
 			return
 		}
-		http.SetCookie(w, &http.Cookie{
-			Name:     store.SessionCookieName,
-			Value:    sid,
-			Path:     "/",
-			MaxAge:   7 * 24 * 3600,
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-		})
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(map[string]string{"username": u.Username})
 	}
 }
 
-func loginHandler(users *store.UserStore, sessions *store.SessionStore) http.HandlerFunc {
+// startSession creates a session for userID and sets its cookie. On failure
+// it writes the error response and returns false.
+func startSession(w http.ResponseWriter, r *http.Request, sessions *store.SessionStore, userID string) bool {
+	sid, err := sessions.Create(userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "session create", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     store.SessionCookieName,
+		Value:    sid,
+		Path:     "/",
+		MaxAge:   7 * 24 * 3600,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return true
+}
+
+// clientIP returns the address of the peer that sent the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func loginHandler(users *store.UserStore, auth store.Authenticator, sessions *store.SessionStore, throttle *store.LoginThrottle, pending *store.PendingLogins) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -134,26 +201,50 @@ func loginHandler(users *store.UserStore, sessions *store.SessionStore) http.Han
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
+		if !*passwordLogin {
+			http.Error(w, "password login is disabled, use single sign-on", http.StatusForbidden)
+			return
+		}
 		email := strings.TrimSpace(strings.ToLower(body.Username))
-		u, err := users.Login(email, body.Password)
+		keys := []string{"user:" + email, "ip:" + clientIP(r)}
+		if wait := throttle.Reserve(keys...); wait > 0 {
+			secs := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, fmt.Sprintf("too many failed attempts, try again in %d seconds", secs), http.StatusTooManyRequests)
+			return
+		}
+		u, err := auth.Authenticate(r.Context(), email, body.Password)
 		if err != nil {
+			switch err {
+			case store.ErrInvalidCredentials:
+				// Reserve counted the failure.
+			case store.ErrAccountDisabled:
+				throttle.Refund(keys...)
+				http.Error(w, "account disabled", http.StatusForbidden)
+				return
+			default:
+				throttle.Refund(keys...)
+				slog.ErrorContext(r.Context(), "login", "err", err)
+			}
 			http.Error(w, "invalid credentials", http.StatusUnauthorized)
 			return
 		}
-		sid, err := sessions.Create(u.ID)
-		if err != nil {
-			log.Println("session create:", err)
-			http.Error(w, "internal error", http.StatusInternalServerError)
+		throttle.Succeed(keys[0])
+		throttle.Refund(keys[1:]...)
+		if users.HasTOTP(u.ID) {
+			token, err := pending.Create(u.ID)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "pending login", "err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"twoFactorRequired": true, "pendingToken": token})
+			return
+		}
+		if !startSession(w, r, sessions, u.ID) {
 			return
 		}
-		http.SetCookie(w, &http.Cookie{
-			Name:     store.SessionCookieName,
-			Value:    sid,
-			Path:     "/",
-			MaxAge:   7 * 24 * 3600,
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-		})
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{"username": u.Username})
 	}
@@ -169,30 +260,22 @@ func logoutHandler(sessions *store.SessionStore) http.HandlerFunc {
 		if cookie != nil {
 			_ = sessions.Delete(cookie.Value)
 		}
-		http.SetCookie(w, &http.Cookie{
-			Name:     store.SessionCookieName,
-			Value:    "",
-			Path:     "/",
-			MaxAge:   -1,
-			HttpOnly: true,
-		})
+		clearSessionCookie(w, r)
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
 func loginPageHandler(w http.ResponseWriter, r *http.Request) {
-	t, err := template.ParseFiles("login.html")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	_ = t.Execute(w, nil)
+	ui.render(w, r, "login.html", map[string]bool{
+		"Password": *passwordLogin,
+		"SSO":      *oidcIssuer != "",
+	})
 }
 
-func promptHandler(chats *store.ChatStore) http.HandlerFunc {
+func promptHandler(chats *store.ChatStore, jobs *jobManager, q *quota) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "", http.StatusBadRequest)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 		var body promptBody
@@ -200,7 +283,7 @@ func promptHandler(chats *store.ChatStore) http.HandlerFunc {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
-		if body.Text == "" {
+		if body.Text == "" && !body.Retry {
 			http.Error(w, "text required", http.StatusBadRequest)
 			return
 		}
@@ -210,40 +293,61 @@ func promptHandler(chats *store.ChatStore) http.HandlerFunc {
 			return
 		}
 		chatID := strings.TrimSpace(body.ChatID)
+		if chatID == "" && body.Retry {
+			http.Error(w, "chatId required", http.StatusBadRequest)
+			return
+		}
+		le, err := q.admit(userID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "quota", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if le != nil {
+			writeLimitError(w, le)
+			return
+		}
 		if chatID == "" {
-			var err error
 			chatID, err = chats.Create(userID)
 			if err != nil {
-				log.Println("chat create:", err)
+				q.refund(userID)
+				slog.ErrorContext(r.Context(), "chat create", "err", err)
 				http.Error(w, "internal error", http.StatusInternalServerError)
 				return
 			}
 		}
-		httpResponse, err := promptLLM(body.Text)
+		j, err := jobs.reserve(r.Context(), userID, chatID, func() (string, error) {
+			if body.Retry {
+				return chats.TakeRetry(userID, chatID)
+			}
+			// Save the prompt first so it survives a failed generation.
+			return body.Text, chats.Append(userID, chatID,
+				store.ChatMessage{Sender: "You", Text: body.Text, Type: "sent", Time: time.Now().Format("3:04 PM")})
+		})
 		if err != nil {
-			log.Println("prompt:", err)
-			http.Error(w, "", http.StatusInternalServerError)
+			// No answer was started, so the request does not count.
+			q.refund(userID)
+		}
+		switch {
+		case errors.Is(err, errDraining), errors.Is(err, errQueueFull):
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		case errors.Is(err, errJobRunning), errors.Is(err, store.ErrNothingToRetry):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, os.ErrNotExist):
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		case err != nil:
+			slog.ErrorContext(r.Context(), "prompt", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		defer httpResponse.Body.Close()
-		// Set headers before any write (first Write sends headers)
 		w.Header().Set("X-Chat-Id", chatID)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		buf := new(bytes.Buffer)
-		tee := &teeResponseWriter{ResponseWriter: w, buf: buf}
-		if err := responseStream(tee, httpResponse); err != nil {
-			log.Println("response:", err)
-			return
-		}
-		now := time.Now().Format("3:04 PM")
-		assistantText := strings.TrimSpace(buf.String())
-		err = chats.Append(userID, chatID,
-			store.ChatMessage{Sender: "You", Text: body.Text, Type: "sent", Time: now},
-			store.ChatMessage{Sender: "LLM", Text: assistantText, Type: "received", Time: now},
-		)
-		if err != nil {
-			log.Println("chat append:", err)
-		}
+		// The job keeps running if the client goes away; it can reattach
+		// through /chats/{id}/stream.
+		streamJob(w, r, j, 0)
 	}
 }
 
@@ -255,22 +359,22 @@ func meHandler(users *store.UserStore) http.HandlerFunc {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
+		twoFactor := users.HasTOTP(userID)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"username": u.Username})
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"username":             u.Username,
+			"role":                 u.Role,
+			"twoFactor":            twoFactor,
+			"twoFactorSetupNeeded": current().Require2FA && !twoFactor,
+		})
 	}
 }
 
 func viewHandler(w http.ResponseWriter, req *http.Request) {
-	t, err := template.ParseFiles("view.html")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Println(err)
-		return
-	}
-	_ = t.Execute(w, nil)
+	ui.render(w, req, "view.html", nil)
 }
 
-func chatsHandler(chats *store.ChatStore) http.HandlerFunc {
+func chatsHandler(chats *store.ChatStore, jobs *jobManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := store.UserIDFromContext(r.Context())
 		if userID == "" {
@@ -283,7 +387,7 @@ func chatsHandler(chats *store.ChatStore) http.HandlerFunc {
 			case http.MethodGet:
 				infos, err := chats.ListWithTitles(userID)
 				if err != nil {
-					log.Println("chats list:", err)
+					slog.ErrorContext(r.Context(), "chats list", "err", err)
 					http.Error(w, "internal error", http.StatusInternalServerError)
 					return
 				}
@@ -293,7 +397,7 @@ func chatsHandler(chats *store.ChatStore) http.HandlerFunc {
 			case http.MethodPost:
 				chatID, err := chats.Create(userID)
 				if err != nil {
-					log.Println("chats create:", err)
+					slog.ErrorContext(r.Context(), "chats create", "err", err)
 					http.Error(w, "internal error", http.StatusInternalServerError)
 					return
 				}
@@ -306,6 +410,34 @@ func chatsHandler(chats *store.ChatStore) http.HandlerFunc {
 				return
 			}
 		}
+		if chatID, ok := strings.CutSuffix(path, "/stream"); ok && strings.HasPrefix(chatID, "/chats/") && len(chatID) > 7 {
+			chatID = chatID[7:]
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			j := jobs.get(userID, chatID)
+			if j == nil {
+				// Nothing is being generated; the chat holds the full answer.
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			offset := r.URL.Query().Get("from")
+			if offset == "" {
+				offset = r.Header.Get("Last-Event-ID")
+			}
+			from := 0
+			if offset != "" {
+				n, err := strconv.Atoi(offset)
+				if err != nil || n < 0 {
+					jsonError(w, http.StatusBadRequest, "from must be a byte offset")
+					return
+				}
+				from = n
+			}
+			streamJob(w, r, j, from)
+			return
+		}
 		if strings.HasPrefix(path, "/chats/") && len(path) > 7 {
 			chatID := path[7:]
 			if chatID == "" {
@@ -320,20 +452,24 @@ func chatsHandler(chats *store.ChatStore) http.HandlerFunc {
 						http.Error(w, "not found", http.StatusNotFound)
 						return
 					}
-					log.Println("chats get:", err)
+					slog.ErrorContext(r.Context(), "chats get", "err", err)
 					http.Error(w, "internal error", http.StatusInternalServerError)
 					return
 				}
 				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]interface{}{"messages": msgs})
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"messages":   msgs,
+					"generating": jobs.running(userID, chatID),
+				})
 				return
 			case http.MethodDelete:
+				jobs.cancel(userID, chatID)
 				if err := chats.Delete(userID, chatID); err != nil {
 					if errors.Is(err, os.ErrNotExist) {
 						http.Error(w, "not found", http.StatusNotFound)
 						return
 					}
-					log.Println("chats delete:", err)
+					slog.ErrorContext(r.Context(), "chats delete", "err", err)
 					http.Error(w, "internal error", http.StatusInternalServerError)
 					return
 				}
@@ -348,8 +484,8 @@ func chatsHandler(chats *store.ChatStore) http.HandlerFunc {
 	}
 }
 
-func loginHandlerCombined(users *store.UserStore, sessions *store.SessionStore) http.HandlerFunc {
-	loginAPI := loginHandler(users, sessions)
+func loginHandlerCombined(users *store.UserStore, auth store.Authenticator, sessions *store.SessionStore, throttle *store.LoginThrottle, pending *store.PendingLogins) http.HandlerFunc {
+	loginAPI := loginHandler(users, auth, sessions, throttle, pending)
 	loginPage := loginPageHandler
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
@@ -365,31 +501,233 @@ func loginHandlerCombined(users *store.UserStore, sessions *store.SessionStore)
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
-	fmt.Println("Web:", *web)
-	fmt.Println("LLM:", *llm, *model)
-	fmt.Println("Data:", *data)
+	if flag.Arg(0) == "serve" {
+		// Flags may also follow the command.
+		flag.CommandLine.Parse(flag.Args()[1:])
+		if flag.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, "usage: chatlocal [flags] serve [flags]")
+			os.Exit(2)
+		}
+	}
+	if err := errors.Join(loadConfig(), validateConfig()); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *printConfig {
+		fmt.Print(effectiveConfig())
+		return
+	}
+	logger, err := newLogger(os.Stderr, *logFormat)
+	if err != nil {
+		fatal(err.Error())
+	}
+	slog.SetDefault(logger)
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+	logConfig()
+	slog.Info("starting", "web", *web, "llm", current().LLM, "model", current().Model, "data", *data)
+	if *logPrompts {
+		slog.Warn("prompt contents are logged (-log-prompts)")
+	}
+	ui, err = newSite(*devMode)
+	if err != nil {
+		fatal("load pages", "err", err)
+	}
+	if *devMode {
+		slog.Warn("serving pages from disk with live reload (-dev); not for production")
+	}
 
+	// Commands that would conflict with the server refuse to run while it
+	// holds the lock.
+	lock, err := store.LockDataDir(*data, "the server on "+*web)
+	if err != nil {
+		fatal("cannot use the data directory", "dir", *data, "err", err)
+	}
+	defer lock.Unlock()
+	if err := store.CheckDataVersion(*data); err != nil {
+		fatal(err.Error())
+	}
 	users, err := store.NewUserStore(*data)
 	if err != nil {
-		log.Fatal("user store:", err)
+		fatal("open user store", "err", err)
 	}
 	sessions, err := store.NewSessionStore(*data)
 	if err != nil {
-		log.Fatal("session store:", err)
+		fatal("open session store", "err", err)
 	}
 	chats, err := store.NewChatStore(*data)
 	if err != nil {
-		log.Fatal("chat store:", err)
+		fatal("open chat store", "err", err)
+	}
+	resets, err := store.NewResetStore(*data)
+	if err != nil {
+		fatal("open reset store", "err", err)
+	}
+	invites, err := store.NewInviteStore(*data)
+	if err != nil {
+		fatal("open invite store", "err", err)
+	}
+	tokens, err := store.NewTokenStore(*data)
+	if err != nil {
+		fatal("open token store", "err", err)
+	}
+	usage, err := store.NewUsageStore(*data)
+	if err != nil {
+		fatal("open usage store", "err", err)
 	}
 
-	http.HandleFunc("/register", registerHandler(users, sessions))
-	http.HandleFunc("/login", loginHandlerCombined(users, sessions))
+	throttle := store.NewLoginThrottle()
+	pending := store.NewPendingLogins()
+	var auth store.Authenticator = users
+	if *ldapURL != "" {
+		auth = store.Chain{&ldapAuthenticator{
+			URL:          *ldapURL,
+			BindDN:       *ldapBindDN,
+			BindPassword: *ldapBindPass,
+			BaseDN:       *ldapBaseDN,
+			UserFilter:   *ldapFilter,
+			GroupDN:      *ldapGroupDN,
+			LinkAccounts: *ldapLink,
+			MailAttr:     "mail",
+			Timeout:      5 * time.Second,
+			users:        users,
+		}, users}
+	}
+
+	if *oidcIssuer != "" {
+		provider := oidc.NewProvider(oidc.Config{
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: *oidcSecret,
+			RedirectURL:  *oidcRedirect,
+		})
+		logins := &oidcLogins{pending: make(map[string]oidcPending)}
+		http.HandleFunc("/login/oidc", oidcLoginHandler(provider, logins))
+		http.HandleFunc("/login/oidc/callback", oidcCallbackHandler(provider, logins, users, sessions, pending))
+	}
+
+	http.HandleFunc("/healthz", allowMethods(healthzHandler, http.MethodGet, http.MethodHead))
+	http.HandleFunc("/readyz", allowMethods(readyzHandler(*data, users, sessions), http.MethodGet, http.MethodHead))
+	http.HandleFunc("/static/", allowMethods(ui.staticHandler, http.MethodGet, http.MethodHead))
+	if *devMode {
+		http.HandleFunc("/dev/reload", allowMethods(ui.devReloadHandler, http.MethodGet))
+	}
+	http.HandleFunc("/register", registerHandler(users, sessions, invites))
+	http.HandleFunc("/login", loginHandlerCombined(users, auth, sessions, throttle, pending))
+	http.HandleFunc("/login/2fa", login2FAHandler(users, sessions, pending, throttle))
 	http.HandleFunc("/logout", logoutHandler(sessions))
-	http.HandleFunc("/me", store.RequireAuth(users, sessions, meHandler(users)))
-	http.HandleFunc("/chats", store.RequireAuth(users, sessions, chatsHandler(chats)))
-	http.HandleFunc("/chats/", store.RequireAuth(users, sessions, chatsHandler(chats)))
-	http.HandleFunc("/", store.RequireAuth(users, sessions, viewHandler))
-	http.HandleFunc("/prompt", store.RequireAuth(users, sessions, promptHandler(chats)))
-	log.Fatal(http.ListenAndServe(*web, nil))
+	http.HandleFunc("/reset", resetHandler(users, sessions, resets, tokens))
+	http.HandleFunc("/2fa", store.RequireAuth(users, sessions, tokens, allowMethods(twoFactorPageHandler, http.MethodGet, http.MethodHead)))
+	http.HandleFunc("/account", store.RequireAuth(users, sessions, tokens, need2FA(users, deleteAccountHandler(users, sessions, chats, resets, tokens, usage, throttle))))
+	http.HandleFunc("/account/password", store.RequireAuth(users, sessions, tokens, changePasswordHandler(users, sessions, tokens)))
+	http.HandleFunc("/account/2fa", store.RequireAuth(users, sessions, tokens, account2FAHandler(users, sessions, throttle)))
+	http.HandleFunc("/account/2fa/", store.RequireAuth(users, sessions, tokens, account2FAHandler(users, sessions, throttle)))
+	http.HandleFunc("/account/tokens", store.RequireAuth(users, sessions, tokens, need2FA(users, tokensHandler(tokens))))
+	http.HandleFunc("/account/tokens/", store.RequireAuth(users, sessions, tokens, need2FA(users, tokensHandler(tokens))))
+	http.HandleFunc("/admin/users", store.RequireAdmin(users, sessions, need2FA(users, adminUsersHandler(users, sessions, chats, resets))))
+	http.HandleFunc("/admin/users/", store.RequireAdmin(users, sessions, need2FA(users, adminUsersHandler(users, sessions, chats, resets))))
+	http.HandleFunc("/admin/usage", store.RequireAdmin(users, sessions, need2FA(users, allowMethods(adminUsageHandler(users, usage), http.MethodGet))))
+	http.HandleFunc("/admin/invites", store.RequireAdmin(users, sessions, need2FA(users, adminInvitesHandler(invites))))
+	http.HandleFunc("/admin/invites/", store.RequireAdmin(users, sessions, need2FA(users, adminInvitesHandler(invites))))
+	http.HandleFunc("/me", store.RequireAuth(users, sessions, tokens, allowMethods(meHandler(users), http.MethodGet, http.MethodHead)))
+	gens := newGenerations()
+	rl := &reloader{sched: newScheduler(0, nil, 0), rate: store.NewRateLimiter(0, time.Minute)}
+	rl.install(current())
+	warmModel(current().LLM, current().Model)
+	jobs := newJobManager(chats, usage, gens, rl.sched)
+	q := &quota{rate: rl.rate, usage: usage}
+	http.HandleFunc("/admin/config/reload", store.RequireAdmin(users, sessions, need2FA(users, allowMethods(adminReloadHandler(rl), http.MethodPost))))
+	metrics.NewGaugeFunc("chatlocal_generations_running", "Generations currently running.", func() float64 {
+		running, _ := jobs.sched.stats()
+		return float64(running)
+	})
+	metrics.NewGaugeFunc("chatlocal_queue_depth", "Generations waiting for a slot.", func() float64 {
+		_, waiting := jobs.sched.stats()
+		return float64(waiting)
+	})
+	if *metricsToken != "" {
+		http.HandleFunc("/metrics", allowMethods(metricsHandler(*metricsToken), http.MethodGet, http.MethodHead))
+	}
+	http.HandleFunc("/chats", store.RequireAuth(users, sessions, tokens, need2FA(users, chatsHandler(chats, jobs))))
+	http.HandleFunc("/chats/", store.RequireAuth(users, sessions, tokens, need2FA(users, chatsHandler(chats, jobs))))
+	http.HandleFunc("/", store.RequireAuth(users, sessions, tokens, need2FA(users, allowMethods(viewHandler, http.MethodGet, http.MethodHead))))
+	http.HandleFunc("/prompt", store.RequireAuth(users, sessions, tokens, need2FA(users, promptHandler(chats, jobs, q))))
+	http.HandleFunc("/account/usage", store.RequireAuth(users, sessions, tokens, need2FA(users, allowMethods(usageHandler(q), http.MethodGet))))
+	http.HandleFunc("/account/usage/report", store.RequireAuth(users, sessions, tokens, need2FA(users, allowMethods(usageReportHandler(users, usage), http.MethodGet))))
+	csrf, err := newCSRFProtection(*trustedOrigins)
+	if err != nil {
+		fatal("trusted origins", "err", err)
+	}
+	proxies, err := parseCIDRs(*trustedProxies)
+	if err != nil {
+		fatal(err.Error())
+	}
+	handler := serverHandler(http.DefaultServeMux, proxies, csrf)
+
+	certFile, keyFile := *tlsCert, *tlsKey
+	if *tlsSelfSigned && certFile == "" {
+		certFile, keyFile, err = selfSignedCert(*data, *web)
+		if err != nil {
+			fatal("self-signed certificate", "err", err)
+		}
+		slog.Info("using self-signed TLS certificate", "file", certFile)
+	}
+
+	srv := &http.Server{Addr: *web, Handler: handler, ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn)}
+	srv.RegisterOnShutdown(ui.close)
+	serveErr := make(chan error, 1)
+	if *metricsListen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", metricsHandler(""))
+		go func() {
+			serveErr <- http.ListenAndServe(*metricsListen, mux)
+		}()
+	}
+	go func() {
+		if certFile != "" {
+			serveErr <- srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			rl.reloadAndLog()
+		}
+	}()
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		fatal(err.Error())
+	case <-sigCtx.Done():
+	}
+	stop() // a second signal kills the process
+	shutdown(srv, gens, *shutdownWait)
+}
+
+// shutdown stops accepting requests and waits up to timeout for running
+// generations. Generations still running after that are interrupted and
+// given a moment to save their partial answers.
+func shutdown(srv *http.Server, gens *generations, timeout time.Duration) {
+	gens.drain()
+	slog.Info("shutting down", "timeout", timeout, "generations", gens.count())
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	// Generations outlive their requests, so wait for both.
+	_ = srv.Shutdown(ctx)
+	if !gens.wait(time.Until(deadline)) {
+		slog.Warn("interrupting generations", "generations", gens.count())
+		gens.interrupt()
+		if !gens.wait(5 * time.Second) {
+			slog.Error("gave up waiting for interrupted generations")
+		}
+	}
+	srv.Close()
 }
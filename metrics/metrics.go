@@ -0,0 +1,301 @@
+// Package metrics implements counters, gauges and histograms with labels
+// and exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are latency buckets in seconds, from 5ms to 10s.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics to expose. Metrics created with the New
+// functions are registered in Default.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+var Default = &Registry{}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, o := range r.metrics {
+		if o.name() == m.name() {
+			panic("metrics: duplicate metric " + m.name())
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.mu.Lock()
+	ms := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	sort.Slice(ms, func(i, j int) bool { return ms[i].name() < ms[j].name() })
+	bw := bufio.NewWriter(w)
+	for _, m := range ms {
+		m.write(bw)
+	}
+	bw.Flush()
+}
+
+// vec holds the children of a metric by label values.
+type vec[T any] struct {
+	fqName, help, kind string
+	labels             []string
+	newChild           func() *T
+
+	mu       sync.Mutex
+	children map[string]*T
+	values   map[string][]string
+}
+
+func newVec[T any](name, help, kind string, labels []string, newChild func() *T) *vec[T] {
+	return &vec[T]{fqName: name, help: help, kind: kind, labels: labels, newChild: newChild,
+		children: make(map[string]*T), values: make(map[string][]string)}
+}
+
+func (v *vec[T]) name() string { return v.fqName }
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", v.fqName, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c := v.children[key]
+	if c == nil {
+		c = v.newChild()
+		v.children[key] = c
+		v.values[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+// each calls fn for every child in a stable order.
+func (v *vec[T]) each(fn func(labels string, c *T)) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	v.mu.Unlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		v.mu.Lock()
+		c, vals := v.children[k], v.values[k]
+		v.mu.Unlock()
+		fn(formatLabels(v.labels, vals), c)
+	}
+}
+
+func (v *vec[T]) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.fqName, escapeHelp(v.help), v.fqName, v.kind)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	var parts []string
+	for i, n := range names {
+		parts = append(parts, n+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// value is a float64 that can be updated concurrently.
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (v *value) add(d float64) {
+	v.mu.Lock()
+	v.v += d
+	v.mu.Unlock()
+}
+
+func (v *value) set(f float64) {
+	v.mu.Lock()
+	v.v = f
+	v.mu.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.v
+}
+
+// Counter is a value that only goes up.
+type Counter struct{ value }
+
+func (c *Counter) Inc()          { c.add(1) }
+func (c *Counter) Add(d float64) { c.add(d) }
+
+// CounterVec is a family of counters distinguished by label values.
+type CounterVec struct{ *vec[Counter] }
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+	Default.register(c)
+	return c
+}
+
+func (c *CounterVec) With(values ...string) *Counter { return c.with(values) }
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.header(w)
+	c.each(func(labels string, ch *Counter) {
+		fmt.Fprintf(w, "%s%s %s\n", c.fqName, labels, formatFloat(ch.get()))
+	})
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct{ value }
+
+func (g *Gauge) Set(f float64) { g.set(f) }
+func (g *Gauge) Add(d float64) { g.add(d) }
+func (g *Gauge) Inc()          { g.add(1) }
+func (g *Gauge) Dec()          { g.add(-1) }
+
+// GaugeVec is a family of gauges distinguished by label values.
+type GaugeVec struct{ *vec[Gauge] }
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+	Default.register(g)
+	return g
+}
+
+func (g *GaugeVec) With(values ...string) *Gauge { return g.with(values) }
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.header(w)
+	g.each(func(labels string, ch *Gauge) {
+		fmt.Fprintf(w, "%s%s %s\n", g.fqName, labels, formatFloat(ch.get()))
+	})
+}
+
+// GaugeFunc is a gauge whose value is read when metrics are collected.
+type GaugeFunc struct {
+	fqName, help string
+	fn           func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{fqName: name, help: help, fn: fn}
+	Default.register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string { return g.fqName }
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.fqName, escapeHelp(g.help), g.fqName, g.fqName, formatFloat(g.fn()))
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// HistogramVec is a family of histograms distinguished by label values.
+type HistogramVec struct {
+	*vec[Histogram]
+	buckets []float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{buckets: buckets}
+	h.vec = newVec(name, help, "histogram", labels, func() *Histogram {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	})
+	Default.register(h)
+	return h
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram { return h.with(values) }
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.header(w)
+	h.vec.mu.Lock()
+	keys := make([]string, 0, len(h.children))
+	for k := range h.children {
+		keys = append(keys, k)
+	}
+	h.vec.mu.Unlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.vec.mu.Lock()
+		ch, vals := h.children[k], h.values[k]
+		h.vec.mu.Unlock()
+		ch.mu.Lock()
+		for i, b := range ch.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.fqName, formatLabels(h.labels, vals, "le", formatFloat(b)), ch.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.fqName, formatLabels(h.labels, vals, "le", "+Inf"), ch.count)
+		labels := formatLabels(h.labels, vals)
+		fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.fqName, labels, formatFloat(ch.sum), h.fqName, labels, ch.count)
+		ch.mu.Unlock()
+	}
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useRegistry makes the New functions register in a fresh Default.
+func useRegistry(t *testing.T) {
+	old := Default
+	Default = &Registry{}
+	t.Cleanup(func() { Default = old })
+}
+
+func TestExposition(t *testing.T) {
+	useRegistry(t)
+	requests := NewCounterVec("test_requests_total", "Requests by path and code.", "path", "code")
+	requests.With("/a", "200").Inc()
+	requests.With("/a", "200").Add(2.5)
+	requests.With(`quote " back \ new`+"\n"+`line`, "500").Inc()
+	temps := NewGaugeVec("test_temperature", "Help with a \\ backslash\nand a second line.")
+	temps.With().Set(math.Inf(1))
+	queued := NewGaugeVec("test_queued", "Waiting.", "queue")
+	queued.With("b").Inc()
+	queued.With("a").Add(3)
+	queued.With("a").Dec()
+	NewGaugeFunc("test_up", "Always 1.", func() float64 { return 1 })
+	latency := NewHistogramVec("test_latency_seconds", "Latency.", []float64{1, 0.5}, "route")
+	for _, v := range []float64{0.25, 0.5, 0.75, 2} {
+		latency.With("/x").Observe(v)
+	}
+	latency.With(`/"y"`)
+
+	rec := httptest.NewRecorder()
+	Default.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	want := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{route="/\"y\"",le="0.5"} 0
+test_latency_seconds_bucket{route="/\"y\"",le="1"} 0
+test_latency_seconds_bucket{route="/\"y\"",le="+Inf"} 0
+test_latency_seconds_sum{route="/\"y\""} 0
+test_latency_seconds_count{route="/\"y\""} 0
+test_latency_seconds_bucket{route="/x",le="0.5"} 2
+test_latency_seconds_bucket{route="/x",le="1"} 3
+test_latency_seconds_bucket{route="/x",le="+Inf"} 4
+test_latency_seconds_sum{route="/x"} 3.5
+test_latency_seconds_count{route="/x"} 4
+# HELP test_queued Waiting.
+# TYPE test_queued gauge
+test_queued{queue="a"} 2
+test_queued{queue="b"} 1
+# HELP test_requests_total Requests by path and code.
+# TYPE test_requests_total counter
+test_requests_total{path="/a",code="200"} 3.5
+test_requests_total{path="quote \" back \\ new\nline",code="500"} 1
+# HELP test_temperature Help with a \\ backslash\nand a second line.
+# TYPE test_temperature gauge
+test_temperature +Inf
+# HELP test_up Always 1.
+# TYPE test_up gauge
+test_up 1
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRegistryPanics(t *testing.T) {
+	useRegistry(t)
+	c := NewCounterVec("test_total", "Test.", "a")
+	for name, fn := range map[string]func(){
+		"duplicate name":     func() { NewGaugeFunc("test_total", "Again.", func() float64 { return 0 }) },
+		"wrong label values": func() { c.With("x", "y") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: no panic", name)
+				}
+			}()
+			fn()
+		}()
+	}
+}
@@ -0,0 +1,187 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type keySet struct {
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// keyRefetchInterval limits how often an unknown kid triggers a JWKS refetch.
+const keyRefetchInterval = time.Minute
+
+func b64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("point not on curve")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func (p *Provider) fetchKeys(ctx context.Context, jwksURI string) (*keySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, jwksURI, &doc); err != nil {
+		return nil, err
+	}
+	ks := &keySet{keys: make(map[string]crypto.PublicKey), fetched: time.Now()}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		ks.keys[k.Kid] = pub
+	}
+	return ks, nil
+}
+
+// key returns the signing key for kid, refetching the JWKS when the
+// provider may have rotated its keys.
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	ks := p.keys
+	p.mu.Unlock()
+	if ks != nil {
+		if k, ok := ks.keys[kid]; ok {
+			return k, nil
+		}
+		if time.Since(ks.fetched) < keyRefetchInterval {
+			return nil, fmt.Errorf("oidc: unknown key %q", kid)
+		}
+	}
+	ks, err = p.fetchKeys(ctx, m.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.keys = ks
+	p.mu.Unlock()
+	if k, ok := ks.keys[kid]; ok {
+		return k, nil
+	}
+	// Providers with a single key often omit kid from the token header.
+	if kid == "" && len(ks.keys) == 1 {
+		for _, k := range ks.keys {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("oidc: unknown key %q", kid)
+}
+
+// verifySignature checks a compact JWS and returns its payload.
+func (p *Provider) verifySignature(ctx context.Context, raw string) ([]byte, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed token")
+	}
+	hb, err := b64(parts[0])
+	if err != nil {
+		return nil, errors.New("oidc: malformed token header")
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(hb, &hdr); err != nil {
+		return nil, errors.New("oidc: malformed token header")
+	}
+	sig, err := b64(parts[2])
+	if err != nil {
+		return nil, errors.New("oidc: malformed token signature")
+	}
+	pub, err := p.key(ctx, hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch hdr.Alg {
+	case "RS256":
+		k, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("oidc: key type does not match alg")
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, errors.New("oidc: bad token signature")
+		}
+	case "ES256":
+		k, ok := pub.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return nil, errors.New("oidc: key type does not match alg")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, errors.New("oidc: bad token signature")
+		}
+	default:
+		return nil, fmt.Errorf("oidc: unsupported alg %q", hdr.Alg)
+	}
+	payload, err := b64(parts[1])
+	if err != nil {
+		return nil, errors.New("oidc: malformed token payload")
+	}
+	return payload, nil
+}
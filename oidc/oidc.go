@@ -0,0 +1,266 @@
+// Package oidc implements the parts of OpenID Connect needed to sign users in
+// with an external identity provider: discovery, the authorization code flow
+// with PKCE, and ID token validation against the provider's JWKS.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config describes a relying party registered with the provider.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to one OpenID Connect provider. Metadata and keys are
+// fetched on first use and cached.
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu   sync.Mutex
+	meta *metadata
+	keys *keySet
+}
+
+func NewProvider(cfg Config) *Provider {
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &Provider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *Provider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	meta := p.meta
+	p.mu.Unlock()
+	if meta != nil {
+		return meta, nil
+	}
+	// Not under p.mu: a slow provider must not hold up key lookups. Logins
+	// racing here may each fetch the document once.
+	var m metadata
+	if err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", &m); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(m.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc: discovery issuer %q does not match %q", m.Issuer, p.cfg.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, errors.New("oidc: incomplete provider metadata")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta == nil {
+		p.meta = &m
+	}
+	return p.meta, nil
+}
+
+// AuthRequest holds the per-login secrets that must survive the redirect
+// to the provider and back.
+type AuthRequest struct {
+	State    string
+	Nonce    string
+	Verifier string
+	URL      string
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewAuthRequest builds the authorization URL with fresh state, nonce and
+// PKCE verifier.
+func (p *Provider) NewAuthRequest(ctx context.Context) (*AuthRequest, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ar := &AuthRequest{}
+	for _, s := range []*string{&ar.State, &ar.Nonce, &ar.Verifier} {
+		if *s, err = randomString(); err != nil {
+			return nil, err
+		}
+	}
+	challenge := sha256.Sum256([]byte(ar.Verifier))
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.cfg.ClientID)
+	v.Set("redirect_uri", p.cfg.RedirectURL)
+	v.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	v.Set("state", ar.State)
+	v.Set("nonce", ar.Nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	ar.URL = m.AuthorizationEndpoint + sep + v.Encode()
+	return ar, nil
+}
+
+// Claims are the ID token claims chatlocal uses.
+type Claims struct {
+	Issuer        string      `json:"iss"`
+	Subject       string      `json:"sub"`
+	Audience      audience    `json:"aud"`
+	AuthorizedBy  string      `json:"azp"`
+	Expiry        json.Number `json:"exp"`
+	IssuedAt      json.Number `json:"iat"`
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified *bool       `json:"email_verified"`
+	Name          string      `json:"name"`
+}
+
+// audience accepts both the string and the array form of "aud".
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Exchange redeems the authorization code and returns the validated ID token claims.
+func (p *Provider) Exchange(ctx context.Context, code string, ar *AuthRequest) (*Claims, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", ar.Verifier)
+	if p.cfg.ClientSecret != "" {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("oidc: token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tok.Error != "" {
+		return nil, fmt.Errorf("oidc: token endpoint: %s %s %s", resp.Status, tok.Error, tok.ErrorDescription)
+	}
+	if tok.IDToken == "" {
+		return nil, errors.New("oidc: token response has no id_token")
+	}
+	return p.Verify(ctx, tok.IDToken, ar.Nonce)
+}
+
+// Verify checks the ID token signature and standard claims.
+func (p *Provider) Verify(ctx context.Context, rawToken, nonce string) (*Claims, error) {
+	payload, err := p.verifySignature(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, fmt.Errorf("oidc: claims: %w", err)
+	}
+	if strings.TrimSuffix(c.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc: unexpected issuer %q", c.Issuer)
+	}
+	found := false
+	for _, a := range c.Audience {
+		if a == p.cfg.ClientID {
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New("oidc: token not issued for this client")
+	}
+	if len(c.Audience) > 1 && c.AuthorizedBy != "" && c.AuthorizedBy != p.cfg.ClientID {
+		return nil, errors.New("oidc: unexpected authorized party")
+	}
+	const skew = time.Minute
+	now := time.Now()
+	exp, err := c.Expiry.Int64()
+	if err != nil {
+		return nil, errors.New("oidc: missing exp claim")
+	}
+	if now.After(time.Unix(exp, 0).Add(skew)) {
+		return nil, errors.New("oidc: token expired")
+	}
+	if iat, err := c.IssuedAt.Int64(); err == nil && time.Unix(iat, 0).After(now.Add(skew)) {
+		return nil, errors.New("oidc: token issued in the future")
+	}
+	if c.Nonce != nonce {
+		return nil, errors.New("oidc: nonce mismatch")
+	}
+	if c.Subject == "" {
+		return nil, errors.New("oidc: missing sub claim")
+	}
+	return &c, nil
+}
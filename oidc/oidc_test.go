@@ -0,0 +1,138 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/oidc"
+	"github.com/agerasimovski/chatlocal/oidc/oidctest"
+)
+
+func newProvider(is *oidctest.Issuer) *oidc.Provider {
+	return oidc.NewProvider(oidc.Config{
+		Issuer:      is.URL,
+		ClientID:    "chatlocal",
+		RedirectURL: "https://chat.example/login/oidc/callback",
+	})
+}
+
+func TestExchange(t *testing.T) {
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		claims  map[string]any
+		signer  *ecdsa.PrivateKey
+		badPKCE bool
+		wantErr string // empty if the login must succeed
+	}{
+		{name: "valid", claims: map[string]any{"email": "a@example.com", "email_verified": true}},
+		{name: "audience list", claims: map[string]any{"aud": []string{"other", "chatlocal"}, "azp": "chatlocal"}},
+		{name: "bad signature", signer: otherKey, wantErr: "bad token signature"},
+		{name: "wrong audience", claims: map[string]any{"aud": "someone-else"}, wantErr: "not issued for this client"},
+		{name: "wrong authorized party", claims: map[string]any{"aud": []string{"other", "chatlocal"}, "azp": "other"}, wantErr: "authorized party"},
+		{name: "wrong issuer", claims: map[string]any{"iss": "https://evil.example"}, wantErr: "unexpected issuer"},
+		{name: "wrong nonce", claims: map[string]any{"nonce": "replayed"}, wantErr: "nonce mismatch"},
+		{name: "missing nonce", claims: map[string]any{"nonce": nil}, wantErr: "nonce mismatch"},
+		{name: "expired", claims: map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}, wantErr: "token expired"},
+		{name: "missing exp", claims: map[string]any{"exp": nil}, wantErr: "missing exp"},
+		{name: "issued in the future", claims: map[string]any{"iat": time.Now().Add(time.Hour).Unix()}, wantErr: "in the future"},
+		{name: "missing sub", claims: map[string]any{"sub": nil}, wantErr: "missing sub"},
+		{name: "PKCE mismatch", badPKCE: true, wantErr: "invalid_grant"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			is := oidctest.NewIssuer()
+			defer is.Close()
+			is.Signer = tc.signer
+			p := newProvider(is)
+			ctx := context.Background()
+			ar, err := p.NewAuthRequest(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, err := is.Authorize(ar.URL, tc.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.badPKCE {
+				other, err := p.NewAuthRequest(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ar.Verifier = other.Verifier
+			}
+			claims, err := p.Exchange(ctx, code, ar)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Exchange: %v", err)
+				}
+				if claims.Subject != "subject-1" {
+					t.Errorf("subject %q, want subject-1", claims.Subject)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Exchange accepted the token, want error containing %q", tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Exchange error %q, want it to contain %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestEmailVerifiedClaim(t *testing.T) {
+	is := oidctest.NewIssuer()
+	defer is.Close()
+	p := newProvider(is)
+	ctx := context.Background()
+	yes, no := true, false
+	for _, tc := range []struct {
+		value any
+		want  *bool
+	}{
+		{nil, nil},
+		{true, &yes},
+		{false, &no},
+	} {
+		ar, err := p.NewAuthRequest(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, err := is.Authorize(ar.URL, map[string]any{"email_verified": tc.value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := p.Exchange(ctx, code, ar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := claims.EmailVerified
+		if (got == nil) != (tc.want == nil) || got != nil && *got != *tc.want {
+			t.Errorf("email_verified %v: got %v", tc.value, got)
+		}
+	}
+}
+
+func TestConcurrentDiscovery(t *testing.T) {
+	is := oidctest.NewIssuer()
+	defer is.Close()
+	p := newProvider(is)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			if _, err := p.NewAuthRequest(context.Background()); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+}
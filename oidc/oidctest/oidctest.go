@@ -0,0 +1,169 @@
+// Package oidctest runs a minimal OpenID Connect provider for tests. It
+// serves discovery, a JWKS with one ES256 key and a token endpoint that
+// checks the PKCE verifier; the authorization step is skipped by calling
+// Authorize with the URL the relying party redirected to.
+package oidctest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const KeyID = "test-key"
+
+// Issuer is the fake provider. Its URL is the issuer to configure.
+type Issuer struct {
+	*httptest.Server
+	Key *ecdsa.PrivateKey
+	// Signer, if set, signs ID tokens instead of Key, which stays in the JWKS.
+	Signer *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+type grant struct {
+	challenge   string
+	redirectURI string
+	claims      map[string]any
+}
+
+func NewIssuer() *Issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	is := &Issuer{Key: key, grants: make(map[string]grant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", is.discovery)
+	mux.HandleFunc("/jwks", is.jwks)
+	mux.HandleFunc("/token", is.token)
+	is.Server = httptest.NewServer(mux)
+	return is
+}
+
+func (is *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 is.URL,
+		"authorization_endpoint": is.URL + "/authorize",
+		"token_endpoint":         is.URL + "/token",
+		"jwks_uri":               is.URL + "/jwks",
+	})
+}
+
+func (is *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := is.Key.PublicKey
+	json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+		"kty": "EC",
+		"kid": KeyID,
+		"use": "sig",
+		"alg": "ES256",
+		"crv": "P-256",
+		"x":   b64(pub.X.FillBytes(make([]byte, 32))),
+		"y":   b64(pub.Y.FillBytes(make([]byte, 32))),
+	}}})
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Authorize plays the user approving the request at authURL and returns the
+// authorization code. The ID token gets the standard claims for the
+// request, overridden by claims; a nil value removes a claim.
+func (is *Issuer) Authorize(authURL string, claims map[string]any) (string, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		return "", fmt.Errorf("authorization request without S256 PKCE: %s", authURL)
+	}
+	now := time.Now()
+	all := map[string]any{
+		"iss":   is.URL,
+		"sub":   "subject-1",
+		"aud":   q.Get("client_id"),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"iat":   now.Unix(),
+		"nonce": q.Get("nonce"),
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(all, k)
+		} else {
+			all[k] = v
+		}
+	}
+	code := b64(random())
+	is.mu.Lock()
+	is.grants[code] = grant{challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri"), claims: all}
+	is.mu.Unlock()
+	return code, nil
+}
+
+func random() []byte {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b
+}
+
+func (is *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Method != http.MethodPost {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	is.mu.Lock()
+	g, ok := is.grants[r.PostForm.Get("code")]
+	delete(is.grants, r.PostForm.Get("code"))
+	is.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || b64(sum[:]) != g.challenge || r.PostForm.Get("redirect_uri") != g.redirectURI {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	idToken, err := is.Sign(g.claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "unused", "token_type": "Bearer", "id_token": idToken})
+}
+
+// Sign returns claims as a compact ES256 JWS.
+func (is *Issuer) Sign(claims map[string]any) (string, error) {
+	key := is.Key
+	if is.Signer != nil {
+		key = is.Signer
+	}
+	hdr, err := json.Marshal(map[string]string{"alg": "ES256", "kid": KeyID, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := b64(hdr) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + b64(sig), nil
+}
@@ -0,0 +1,493 @@
+// Package qr encodes text as a QR code (ISO/IEC 18004) in byte mode with
+// error correction level M, for provisioning URIs that authenticator apps
+// scan. It picks the smallest version that fits and the mask with the
+// lowest penalty score.
+package qr
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// ErrTooLong is returned for text that does not fit in a version 40 code.
+var ErrTooLong = errors.New("qr: text too long")
+
+// Error correction codewords per block and number of blocks at level M,
+// indexed by version.
+var (
+	eccPerBlock = [41]int{0,
+		10, 16, 26, 18, 24, 16, 18, 22, 22, 26,
+		30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+		26, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+		28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	eccBlocks = [41]int{0,
+		1, 1, 1, 2, 2, 4, 4, 4, 5, 5,
+		5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+		17, 17, 18, 20, 21, 23, 25, 26, 28, 29,
+		31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+// Code is an encoded QR code.
+type Code struct {
+	Version int
+	Size    int // modules per side
+	Mask    int
+
+	dark     []bool
+	function []bool // finder, timing, alignment, format and version modules
+}
+
+// Encode returns the QR code for text.
+func Encode(text string) (*Code, error) {
+	version := 0
+	for v := 1; v <= 40; v++ {
+		if 4+countBits(v)+8*len(text) <= 8*dataCodewords(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+	data := dataBits(version, text)
+	c := newCode(version)
+	c.place(interleave(version, data))
+
+	best := -1
+	for mask := range 8 {
+		c.apply(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); best < 0 || p < best {
+			best, c.Mask = p, mask
+		}
+		c.apply(mask) // undo
+	}
+	c.apply(c.Mask)
+	c.drawFormat(c.Mask)
+	return c, nil
+}
+
+// Dark reports whether the module in column x, row y is dark.
+func (c *Code) Dark(x, y int) bool {
+	return c.dark[y*c.Size+x]
+}
+
+// PNG renders the code with scale pixels per module and the four module
+// quiet zone the standard asks for.
+func (c *Code) PNG(scale int) []byte {
+	const quiet = 4
+	side := (c.Size + 2*quiet) * scale
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{color.White, color.Black})
+	for y := range c.Size {
+		for x := range c.Size {
+			if !c.Dark(x, y) {
+				continue
+			}
+			for dy := range scale {
+				row := img.Pix[((y+quiet)*scale+dy)*img.Stride:]
+				for dx := range scale {
+					row[(x+quiet)*scale+dx] = 1
+				}
+			}
+		}
+	}
+	var b bytes.Buffer
+	png.Encode(&b, img) // writes to memory, cannot fail
+	return b.Bytes()
+}
+
+// DataURL returns the code as a PNG data: URL, for an <img> src.
+func (c *Code) DataURL(scale int) string {
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(c.PNG(scale))
+}
+
+func countBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// rawModules is the number of modules of a version left for data and
+// error correction once the function patterns are drawn.
+func rawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+func dataCodewords(version int) int {
+	return rawModules(version)/8 - eccPerBlock[version]*eccBlocks[version]
+}
+
+// dataBits returns the data codewords: mode, count, the text, a
+// terminator and padding.
+func dataBits(version int, text string) []byte {
+	var w bitWriter
+	w.write(0b0100, 4)
+	w.write(len(text), countBits(version))
+	for i := range len(text) {
+		w.write(int(text[i]), 8)
+	}
+	capacity := 8 * dataCodewords(version)
+	w.write(0, min(4, capacity-w.n))
+	w.write(0, (8-w.n%8)%8)
+	for pad := 0xec; w.n < capacity; pad ^= 0xec ^ 0x11 {
+		w.write(pad, 8)
+	}
+	return w.b
+}
+
+type bitWriter struct {
+	b []byte
+	n int
+}
+
+func (w *bitWriter) write(v, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>i&1) << (7 - w.n%8)
+		w.n++
+	}
+}
+
+// interleave splits data into blocks, adds each block's error correction
+// codewords and interleaves the result.
+func interleave(version int, data []byte) []byte {
+	blocks, eccLen := eccBlocks[version], eccPerBlock[version]
+	total := rawModules(version) / 8
+	short := blocks - total%blocks // blocks with one data codeword fewer
+	shortLen := total/blocks - eccLen
+	gen := generator(eccLen)
+	var parts, eccs [][]byte
+	for i, off := 0, 0; i < blocks; i++ {
+		n := shortLen
+		if i >= short {
+			n++
+		}
+		parts = append(parts, data[off:off+n])
+		eccs = append(eccs, remainder(data[off:off+n], gen))
+		off += n
+	}
+	out := make([]byte, 0, total)
+	for i := range shortLen + 1 {
+		for _, p := range parts {
+			if i < len(p) {
+				out = append(out, p[i])
+			}
+		}
+	}
+	for i := range eccLen {
+		for _, e := range eccs {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+// Reed-Solomon arithmetic over GF(256) with the polynomial 0x11d.
+
+func mul(a, b byte) byte {
+	var p byte
+	for ; b != 0; b >>= 1 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1d
+		}
+	}
+	return p
+}
+
+// generator returns the coefficients of (x-α⁰)(x-α¹)…(x-αⁿ⁻¹) after the
+// leading 1, highest power first.
+func generator(n int) []byte {
+	g := make([]byte, n)
+	g[n-1] = 1
+	root := byte(1)
+	for range n {
+		for j := range n {
+			g[j] = mul(g[j], root)
+			if j+1 < n {
+				g[j] ^= g[j+1]
+			}
+		}
+		root = mul(root, 2)
+	}
+	return g
+}
+
+// remainder returns data·xⁿ mod the generator.
+func remainder(data, gen []byte) []byte {
+	r := make([]byte, len(gen))
+	for _, b := range data {
+		factor := b ^ r[0]
+		copy(r, r[1:])
+		r[len(r)-1] = 0
+		for i, g := range gen {
+			r[i] ^= mul(g, factor)
+		}
+	}
+	return r
+}
+
+// alignment returns the row and column centres of the alignment patterns.
+func alignment(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := (version*4 + n*2 + 1) / (n*2 - 2) * 2
+	if version == 32 {
+		step = 26
+	}
+	pos := make([]int, n)
+	pos[0] = 6
+	for i, p := n-1, version*4+10; i >= 1; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+func newCode(version int) *Code {
+	size := version*4 + 17
+	c := &Code{Version: version, Size: size, dark: make([]bool, size*size), function: make([]bool, size*size)}
+	for i := range size {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+	for _, p := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := p[0]+dx, p[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					d := max(abs(dx), abs(dy))
+					c.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	pos := alignment(version)
+	last := len(pos) - 1
+	for i, y := range pos {
+		for j, x := range pos {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue // a finder pattern is there
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	c.drawFormat(0) // reserve the modules; Encode draws the real bits
+	if version >= 7 {
+		bits := versionBits(version)
+		for i := range 18 {
+			dark := bits>>i&1 != 0
+			a, b := size-11+i%3, i/3
+			c.set(a, b, dark)
+			c.set(b, a, dark)
+		}
+	}
+	return c
+}
+
+func (c *Code) set(x, y int, dark bool) {
+	c.dark[y*c.Size+x] = dark
+	c.function[y*c.Size+x] = true
+}
+
+// versionBits returns the 18 version bits, for versions 7 and up.
+func versionBits(version int) int {
+	rem := version
+	for range 12 {
+		rem = rem<<1 ^ (rem>>11)*0x1f25
+	}
+	return version<<12 | rem
+}
+
+// formatBits returns the 15 format bits for level M and mask.
+func formatBits(mask int) int {
+	data := mask // level M is 00
+	rem := data
+	for range 10 {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (c *Code) drawFormat(mask int) {
+	bits := formatBits(mask)
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+	size := c.Size
+	for i := range 6 {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+	for i := range 8 {
+		c.set(size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, size-15+i, bit(i))
+	}
+	c.set(8, size-8, true)
+}
+
+// place fills the non-function modules with codewords in the zigzag
+// order, two columns at a time from the bottom right.
+func (c *Code) place(codewords []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := range c.Size {
+			y := vert
+			if upward {
+				y = c.Size - 1 - vert
+			}
+			for x := right; x >= right-1; x-- {
+				if c.function[y*c.Size+x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.dark[y*c.Size+x] = codewords[i/8]>>(7-i%8)&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+func masked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// apply flips the data modules under mask. Applying it twice undoes it.
+func (c *Code) apply(mask int) {
+	for y := range c.Size {
+		for x := range c.Size {
+			if !c.function[y*c.Size+x] && masked(mask, x, y) {
+				c.dark[y*c.Size+x] = !c.dark[y*c.Size+x]
+			}
+		}
+	}
+}
+
+// penalty scores the code by the four rules of the standard: runs of one
+// colour, 2×2 blocks, finder-like patterns and the dark/light balance.
+func (c *Code) penalty() int {
+	score, darkCount := 0, 0
+	line := make([]bool, c.Size)
+	for _, vertical := range []bool{false, true} {
+		for a := range c.Size {
+			for b := range c.Size {
+				if vertical {
+					line[b] = c.Dark(a, b)
+				} else {
+					line[b] = c.Dark(b, a)
+				}
+			}
+			score += linePenalty(line)
+		}
+	}
+	for y := range c.Size {
+		for x := range c.Size {
+			d := c.Dark(x, y)
+			if d {
+				darkCount++
+			}
+			if x+1 < c.Size && y+1 < c.Size && d == c.Dark(x+1, y) && d == c.Dark(x, y+1) && d == c.Dark(x+1, y+1) {
+				score += 3
+			}
+		}
+	}
+	total := c.Size * c.Size
+	k := (abs(darkCount*20-total*10)+total-1)/total - 1
+	return score + max(k, 0)*10
+}
+
+// linePenalty scores one row or column for runs of five or more modules
+// of one colour and for 1:1:3:1:1 patterns with four light modules on
+// either side, counting the area outside the code as light.
+func linePenalty(line []bool) int {
+	score, run := 0, 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			score += run - 2
+		}
+		run = 1
+	}
+	at := func(i int) bool { return i >= 0 && i < len(line) && line[i] }
+	finder := []bool{true, false, true, true, true, false, true}
+	for i := -4; i < len(line)+4-6; i++ {
+		match := true
+		for j, d := range finder {
+			if at(i+j) != d {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		before, after := true, true
+		for j := 1; j <= 4; j++ {
+			before = before && !at(i-j)
+			after = after && !at(i+6+j)
+		}
+		if before || after {
+			score += 40
+		}
+	}
+	return score
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,231 @@
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFormatAndVersionBits(t *testing.T) {
+	// Values from the tables of the standard.
+	if got := formatBits(0); got != 0b101010000010010 {
+		t.Errorf("format bits for M, mask 0: %015b", got)
+	}
+	if got := formatBits(7); got != 0b100101010100000 {
+		t.Errorf("format bits for M, mask 7: %015b", got)
+	}
+	if got := versionBits(7); got != 0x07c94 {
+		t.Errorf("version 7 bits: %#x", got)
+	}
+	if got := versionBits(40); got != 0x28c69 {
+		t.Errorf("version 40 bits: %#x", got)
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+	// The 1-M encoding of "HELLO WORLD".
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := remainder(data, generator(10)); !bytes.Equal(got, want) {
+		t.Errorf("error correction codewords %v, want %v", got, want)
+	}
+}
+
+func TestTables(t *testing.T) {
+	for v, want := range map[int][]int{1: nil, 2: {6, 18}, 7: {6, 22, 38}, 14: {6, 26, 46, 66}, 32: {6, 34, 60, 86, 112, 138}, 40: {6, 30, 58, 86, 114, 142, 170}} {
+		if got := alignment(v); !slices.Equal(got, want) {
+			t.Errorf("version %d alignment %v, want %v", v, got, want)
+		}
+	}
+	for v, want := range map[int]int{1: 16, 5: 86, 10: 216, 20: 669, 40: 2334} {
+		if got := dataCodewords(v); got != want {
+			t.Errorf("version %d has %d data codewords, want %d", v, got, want)
+		}
+	}
+	if _, err := Encode(strings.Repeat("a", 2331)); err != nil {
+		t.Errorf("2331 bytes: %v", err)
+	}
+	if _, err := Encode(strings.Repeat("a", 2332)); err != ErrTooLong {
+		t.Errorf("2332 bytes: %v, want ErrTooLong", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	uri := "otpauth://totp/chatlocal:alice%40example.com?digits=6&issuer=chatlocal&period=30&secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+	for _, text := range []string{"", "a", strings.Repeat("x", 14), strings.Repeat("x", 15), uri, strings.Repeat(uri, 3), strings.Repeat("\xff\x00", 600), strings.Repeat("z", 2331)} {
+		c, err := Encode(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decode(c)
+		if err != nil {
+			t.Errorf("version %d, %d bytes: %v", c.Version, len(text), err)
+			continue
+		}
+		if got != text {
+			t.Errorf("version %d: decoded %q, want %q", c.Version, got, text)
+		}
+	}
+}
+
+func TestPNG(t *testing.T) {
+	c, err := Encode("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(c.PNG(3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if side := (c.Size + 8) * 3; img.Bounds().Dx() != side || img.Bounds().Dy() != side {
+		t.Errorf("size %v, want %d", img.Bounds(), side)
+	}
+	// The top left finder starts after the quiet zone.
+	if r, _, _, _ := img.At(13, 13).RGBA(); r != 0 {
+		t.Error("finder module is not dark")
+	}
+	if r, _, _, _ := img.At(13, 10).RGBA(); r == 0 {
+		t.Error("quiet zone is not light")
+	}
+	if !strings.HasPrefix(c.DataURL(3), "data:image/png;base64,") {
+		t.Error("bad data URL")
+	}
+}
+
+// decode reads c back the way a scanner would once it has found the
+// modules: format bits, unmasking, codewords, error correction and data.
+func decode(c *Code) (string, error) {
+	version := (c.Size - 17) / 4
+	var bits, bits2 int
+	for i := range 6 {
+		bits |= b2i(c.Dark(8, i)) << i
+	}
+	bits |= b2i(c.Dark(8, 7))<<6 | b2i(c.Dark(8, 8))<<7 | b2i(c.Dark(7, 8))<<8
+	for i := 9; i < 15; i++ {
+		bits |= b2i(c.Dark(14-i, 8)) << i
+	}
+	for i := range 8 {
+		bits2 |= b2i(c.Dark(c.Size-1-i, 8)) << i
+	}
+	for i := 8; i < 15; i++ {
+		bits2 |= b2i(c.Dark(8, c.Size-15+i)) << i
+	}
+	if bits != bits2 {
+		return "", fmt.Errorf("format copies differ: %015b, %015b", bits, bits2)
+	}
+	mask := -1
+	for m := range 8 {
+		if formatBits(m) == bits {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		return "", fmt.Errorf("format bits %015b are not level M", bits)
+	}
+	if !c.Dark(8, c.Size-8) {
+		return "", fmt.Errorf("dark module missing")
+	}
+
+	// Read the codewords in the zigzag order, unmasking as we go.
+	layout := newCode(version)
+	var codewords []byte
+	n := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := range c.Size {
+			y := vert
+			if upward {
+				y = c.Size - 1 - vert
+			}
+			for x := right; x >= right-1; x-- {
+				if layout.function[y*c.Size+x] {
+					continue
+				}
+				if n%8 == 0 {
+					codewords = append(codewords, 0)
+				}
+				if c.Dark(x, y) != masked(mask, x, y) {
+					codewords[len(codewords)-1] |= 1 << (7 - n%8)
+				}
+				n++
+			}
+		}
+	}
+	total := rawModules(version) / 8
+	if n != rawModules(version) {
+		return "", fmt.Errorf("%d data modules, want %d", n, rawModules(version))
+	}
+	codewords = codewords[:total]
+
+	// Undo the interleaving and check each block's error correction.
+	blocks, eccLen := eccBlocks[version], eccPerBlock[version]
+	short := blocks - total%blocks
+	shortLen := total/blocks - eccLen
+	parts := make([][]byte, blocks)
+	i := 0
+	for k := range shortLen + 1 {
+		for b := range blocks {
+			if k < shortLen || b >= short {
+				parts[b] = append(parts[b], codewords[i])
+				i++
+			}
+		}
+	}
+	var data []byte
+	gen := generator(eccLen)
+	for b := range blocks {
+		ecc := make([]byte, eccLen)
+		for k := range eccLen {
+			ecc[k] = codewords[i+k*blocks+b]
+		}
+		if want := remainder(parts[b], gen); !bytes.Equal(ecc, want) {
+			return "", fmt.Errorf("block %d: error correction %v, want %v", b, ecc, want)
+		}
+		data = append(data, parts[b]...)
+	}
+
+	r := bitReader{b: data}
+	if mode := r.read(4); mode != 0b0100 {
+		return "", fmt.Errorf("mode %04b", mode)
+	}
+	length := r.read(countBits(version))
+	out := make([]byte, length)
+	for k := range out {
+		out[k] = byte(r.read(8))
+	}
+	if r.read(4) != 0 {
+		return "", fmt.Errorf("no terminator")
+	}
+	return string(out), nil
+}
+
+type bitReader struct {
+	b []byte
+	n int
+}
+
+func (r *bitReader) read(bits int) int {
+	v := 0
+	for range bits {
+		bit := 0
+		if r.n/8 < len(r.b) {
+			bit = int(r.b[r.n/8] >> (7 - r.n%8) & 1)
+		}
+		v = v<<1 | bit
+		r.n++
+	}
+	return v
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
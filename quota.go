@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// quota enforces the per-user request rate and token quotas. Token usage
+// is taken from the statistics Ollama reports at the end of each answer,
+// so a quota is checked when a prompt is sent and may be overrun by the
+// answers already running.
+// The limits themselves come from the current settings.
+type quota struct {
+	rate  *store.RateLimiter
+	usage *store.UsageStore
+}
+
+// limitError tells a client which limit it hit and when it resets.
+type limitError struct {
+	Error    string    `json:"error"`
+	Limit    string    `json:"limit"`
+	Max      int       `json:"max"`
+	Used     int       `json:"used"`
+	ResetsAt time.Time `json:"resetsAt"`
+}
+
+func nextDay(now time.Time) time.Time {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+}
+
+func nextMonth(now time.Time) time.Time {
+	y, m, _ := now.Date()
+	return time.Date(y, m+1, 1, 0, 0, 0, 0, now.Location())
+}
+
+// admit checks userID against the quotas and counts the request towards
+// the rate limit. It returns nil when the prompt may go ahead; if it then
+// does not, refund takes the request back.
+func (q *quota) admit(userID string) (*limitError, error) {
+	now := time.Now()
+	s := current()
+	if s.DailyTokens > 0 {
+		u, err := q.usage.Sum(userID, store.DayKey(now))
+		if err != nil {
+			return nil, err
+		}
+		if u.Tokens() >= s.DailyTokens {
+			return &limitError{Error: "daily token quota used up", Limit: "daily_tokens", Max: s.DailyTokens, Used: u.Tokens(), ResetsAt: nextDay(now)}, nil
+		}
+	}
+	if s.MonthlyTokens > 0 {
+		u, err := q.usage.Sum(userID, now.Format("2006-01"))
+		if err != nil {
+			return nil, err
+		}
+		if u.Tokens() >= s.MonthlyTokens {
+			return &limitError{Error: "monthly token quota used up", Limit: "monthly_tokens", Max: s.MonthlyTokens, Used: u.Tokens(), ResetsAt: nextMonth(now)}, nil
+		}
+	}
+	if ok, wait := q.rate.Allow(userID); !ok {
+		return &limitError{Error: "too many requests", Limit: "requests_per_minute", Max: s.RatePerMinute, Used: s.RatePerMinute, ResetsAt: now.Add(wait)}, nil
+	}
+	return nil, nil
+}
+
+// refund takes back a request admit counted, for a prompt that was turned
+// away before its answer started.
+func (q *quota) refund(userID string) {
+	q.rate.Refund(userID)
+}
+
+func writeLimitError(w http.ResponseWriter, le *limitError) {
+	secs := math.Ceil(time.Until(le.ResetsAt).Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(secs, 1))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(le)
+}
+
+// usagePeriod is one row of the usage report.
+type usagePeriod struct {
+	store.Usage
+	Limit    int       `json:"limit"`
+	ResetsAt time.Time `json:"resetsAt"`
+}
+
+// usageHandler shows the signed-in user their usage against the limits.
+func usageHandler(q *quota) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := store.UserIDFromContext(r.Context())
+		if userID == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		now := time.Now()
+		s := current()
+		day, err := q.usage.Sum(userID, store.DayKey(now))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "usage", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		month, err := q.usage.Sum(userID, now.Format("2006-01"))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "usage", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"requestsPerMinute": map[string]int{"limit": s.RatePerMinute, "used": q.rate.Used(userID)},
+			"daily":             usagePeriod{Usage: day, Limit: s.DailyTokens, ResetsAt: nextDay(now)},
+			"monthly":           usagePeriod{Usage: month, Limit: s.MonthlyTokens, ResetsAt: nextMonth(now)},
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+func TestRejectedPromptsDoNotCountTowardsRateLimit(t *testing.T) {
+	jobs, chatID := newTestJobs(t)
+	useSettings(t, map[string]string{"llm": current().LLM, "rate-limit": "1"})
+	q := &quota{rate: store.NewRateLimiter(1, time.Minute), usage: jobs.usage}
+	h := promptHandler(jobs.chats, jobs, q)
+	prompt := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/prompt", strings.NewReader(body))
+		req = req.WithContext(store.ContextWithUserID(req.Context(), "u"))
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+
+	// Nothing failed in the chat, so there is nothing to retry.
+	retry := `{"chatId":"` + chatID + `","retry":true}`
+	for range 3 {
+		if code := prompt(retry); code != http.StatusConflict {
+			t.Fatalf("retry: status %d, want 409", code)
+		}
+	}
+	if n := q.rate.Used("u"); n != 0 {
+		t.Errorf("%d requests counted for turned away prompts", n)
+	}
+
+	jobs.gens.drain()
+	if code := prompt(`{"chatId":"` + chatID + `","text":"hi"}`); code != http.StatusServiceUnavailable {
+		t.Fatalf("while draining: status %d, want 503", code)
+	}
+	if n := q.rate.Used("u"); n != 0 {
+		t.Errorf("%d requests counted while draining", n)
+	}
+}
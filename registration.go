@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// Registration modes accepted by -registration.
+const (
+	regOpen   = "open"
+	regClosed = "closed"
+	regInvite = "invite"
+	regDomain = "domain"
+)
+
+// regPolicy decides who may create an account through /register.
+type regPolicy struct {
+	Mode    string
+	Domains []string
+}
+
+func parseRegPolicy(mode, domains string) (regPolicy, error) {
+	p := regPolicy{Mode: strings.ToLower(strings.TrimSpace(mode))}
+	for _, d := range strings.Split(domains, ",") {
+		d = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@"))
+		if d != "" {
+			p.Domains = append(p.Domains, d)
+		}
+	}
+	switch p.Mode {
+	case regOpen, regClosed, regInvite:
+	case regDomain:
+		if len(p.Domains) == 0 {
+			return p, fmt.Errorf("registration mode %q needs -allowed-domains", p.Mode)
+		}
+	default:
+		return p, fmt.Errorf("unknown registration mode %q", mode)
+	}
+	return p, nil
+}
+
+func (p regPolicy) domainAllowed(email string) bool {
+	_, domain, ok := strings.Cut(email, "@")
+	if !ok {
+		return false
+	}
+	for _, d := range p.Domains {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// admit checks email and invite against the policy. When it returns a
+// non-empty used invite code, the caller must release it if registration
+// fails afterwards.
+func (p regPolicy) admit(invites *store.InviteStore, email, invite string) (used string, status int, msg string) {
+	switch p.Mode {
+	case regClosed:
+		return "", http.StatusForbidden, "registration is closed; ask an administrator for an account"
+	case regDomain:
+		if !p.domainAllowed(email) {
+			return "", http.StatusForbidden, "registration is limited to addresses at " + strings.Join(p.Domains, ", ")
+		}
+	case regInvite:
+		if strings.TrimSpace(invite) == "" {
+			return "", http.StatusForbidden, "an invite code is required to register"
+		}
+		if err := invites.Use(invite); err != nil {
+			switch err {
+			case store.ErrInviteInvalid, store.ErrInviteExpired, store.ErrInviteUsedUp:
+				return "", http.StatusForbidden, err.Error()
+			}
+			slog.Error("use invite", "err", err)
+			return "", http.StatusInternalServerError, "internal error"
+		}
+		return invite, 0, ""
+	}
+	return "", 0, ""
+}
+
+func adminInvitesHandler(invites *store.InviteStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		if path == "/admin/invites" {
+			switch r.Method {
+			case http.MethodGet:
+				list, err := invites.List()
+				if err != nil {
+					slog.ErrorContext(r.Context(), "invites list", "err", err)
+					http.Error(w, "internal error", http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{"invites": list})
+			case http.MethodPost:
+				var body struct {
+					MaxUses        int `json:"maxUses"`
+					ExpiresInHours int `json:"expiresInHours"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					http.Error(w, "bad request", http.StatusBadRequest)
+					return
+				}
+				if body.MaxUses <= 0 {
+					body.MaxUses = 1
+				}
+				if body.ExpiresInHours < 0 {
+					jsonError(w, http.StatusBadRequest, "expiresInHours must not be negative")
+					return
+				}
+				inv, err := invites.Create(store.UserIDFromContext(r.Context()), body.MaxUses, time.Duration(body.ExpiresInHours)*time.Hour)
+				if err != nil {
+					slog.ErrorContext(r.Context(), "invites create", "err", err)
+					http.Error(w, "internal error", http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(inv)
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		code := strings.TrimPrefix(path, "/admin/invites/")
+		if code == path || code == "" || strings.Contains(code, "/") {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := invites.Delete(code); err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// regServer serves /register under the given policy.
+type regServer struct {
+	t       *testing.T
+	users   *store.UserStore
+	invites *store.InviteStore
+	h       http.HandlerFunc
+}
+
+func newRegistration(t *testing.T, mode, domains string) *regServer {
+	t.Helper()
+	useSettings(t, map[string]string{"registration": mode, "allowed-domains": domains})
+	dir := t.TempDir()
+	users, err := store.NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := store.NewSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invites, err := store.NewInviteStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &regServer{t, users, invites, registerHandler(users, sessions, invites)}
+}
+
+// register posts a registration and returns the status and error message.
+func (rg *regServer) register(email, invite string) (int, string) {
+	rg.t.Helper()
+	body, _ := json.Marshal(map[string]string{"username": email, "password": "correct horse battery", "invite": invite})
+	rec := httptest.NewRecorder()
+	rg.h(rec, httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(string(body))))
+	var resp struct{ Error string }
+	json.NewDecoder(rec.Body).Decode(&resp)
+	exists := rg.users.ByUsername(strings.ToLower(email)) != nil
+	if rec.Code == http.StatusCreated && !exists || rec.Code == http.StatusForbidden && exists {
+		rg.t.Errorf("%s: status %d, but the account exists: %v", email, rec.Code, exists)
+	}
+	return rec.Code, resp.Error
+}
+
+func (rg *regServer) mode() string {
+	rg.t.Helper()
+	rec := httptest.NewRecorder()
+	rg.h(rec, httptest.NewRequest(http.MethodGet, "/register", nil))
+	var resp struct{ Mode string }
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		rg.t.Fatal(err)
+	}
+	return resp.Mode
+}
+
+func TestRegistrationClosed(t *testing.T) {
+	rg := newRegistration(t, "closed", "")
+	if m := rg.mode(); m != regClosed {
+		t.Errorf("mode %q", m)
+	}
+	if code, msg := rg.register("alice@example.com", ""); code != http.StatusForbidden || !strings.Contains(msg, "closed") {
+		t.Errorf("closed registration: %d %q", code, msg)
+	}
+}
+
+func TestRegistrationDomains(t *testing.T) {
+	rg := newRegistration(t, "domain", " @Example.com, example.org ")
+	for email, want := range map[string]int{
+		"alice@example.com":     http.StatusCreated,
+		"bob@EXAMPLE.org":       http.StatusCreated,
+		"carol@sub.example.com": http.StatusForbidden,
+		"dave@example.com.evil": http.StatusForbidden,
+		"erin@notexample.com":   http.StatusForbidden,
+		"frank@example.net":     http.StatusForbidden,
+	} {
+		code, msg := rg.register(email, "")
+		if code != want {
+			t.Errorf("%s: %d %q, want %d", email, code, msg, want)
+		}
+		if code == http.StatusForbidden && !strings.Contains(msg, "example.com, example.org") {
+			t.Errorf("%s: message %q does not name the domains", email, msg)
+		}
+	}
+}
+
+func TestRegistrationInvites(t *testing.T) {
+	rg := newRegistration(t, "invite", "")
+	once, err := rg.invites.Create("admin", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := rg.invites.Create("admin", 5, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	for _, tc := range []struct {
+		email, invite, err string
+	}{
+		{"a@example.com", "", "an invite code is required to register"},
+		{"b@example.com", "NOTACODE", store.ErrInviteInvalid.Error()},
+		{"c@example.com", "../users", store.ErrInviteInvalid.Error()},
+		{"d@example.com", expired.Code, store.ErrInviteExpired.Error()},
+	} {
+		if code, msg := rg.register(tc.email, tc.invite); code != http.StatusForbidden || msg != tc.err {
+			t.Errorf("invite %q: %d %q, want %q", tc.invite, code, msg, tc.err)
+		}
+	}
+
+	// Codes are case-insensitive; each use of a single-use invite is spent.
+	if code, msg := rg.register("alice@example.com", " "+strings.ToLower(once.Code)); code != http.StatusCreated {
+		t.Fatalf("first use: %d %q", code, msg)
+	}
+	if code, msg := rg.register("bob@example.com", once.Code); code != http.StatusForbidden || msg != store.ErrInviteUsedUp.Error() {
+		t.Errorf("second use: %d %q", code, msg)
+	}
+
+	// A registration that fails gives its use back.
+	again, err := rg.invites.Create("admin", 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := rg.register("alice@example.com", again.Code); code != http.StatusConflict {
+		t.Errorf("existing email: %d", code)
+	}
+	if code, msg := rg.register("bob@example.com", again.Code); code != http.StatusCreated {
+		t.Errorf("invite after a failed registration: %d %q", code, msg)
+	}
+}
+
+func TestParseRegPolicy(t *testing.T) {
+	for _, tc := range []struct{ mode, domains, err string }{
+		{"open", "", ""},
+		{" Invite ", "", ""},
+		{"domain", "example.com", ""},
+		{"domain", " , ", "needs -allowed-domains"},
+		{"public", "", "unknown registration mode"},
+	} {
+		_, err := parseRegPolicy(tc.mode, tc.domains)
+		if (err == nil) != (tc.err == "") || err != nil && !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q, %q: %v, want %q", tc.mode, tc.domains, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// settings are the parts of the configuration that can change while the
+// server runs. They are replaced as a whole, so every request and job sees
+// either the old or the new settings, never a mix.
+type settings struct {
+	LLM            string // Ollama base URL
+	Model          string
+	Policy         regPolicy
+	MaxGenerations int
+	MaxQueue       int
+	ModelLimits    map[string]int
+	RatePerMinute  int
+	DailyTokens    int
+	MonthlyTokens  int
+	LogLevel       slog.Level
+	Require2FA     bool
+}
+
+// reloadable lists the flags behind settings. Changes to any other flag
+// only take effect after a restart.
+var reloadable = map[string]bool{
+	"llm": true, "model": true, "registration": true, "allowed-domains": true,
+	"max-generations": true, "max-queue": true, "model-concurrency": true,
+	"rate-limit": true, "daily-token-quota": true, "monthly-token-quota": true,
+	"log-level": true, "require-2fa": true,
+}
+
+var live atomic.Pointer[settings]
+
+// current returns the settings in effect.
+func current() *settings {
+	return live.Load()
+}
+
+// newSettings parses and checks the reloadable settings, taking the value
+// of each flag from get.
+func newSettings(get func(name string) string) (*settings, error) {
+	var errs []error
+	check := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %w", name, err))
+		}
+	}
+	number := func(name string) int {
+		n, err := strconv.Atoi(get(name))
+		if err == nil && n < 0 {
+			err = errors.New("must not be negative")
+		}
+		check(name, err)
+		return n
+	}
+	s := &settings{
+		Model:          strings.TrimSpace(get("model")),
+		MaxGenerations: number("max-generations"),
+		MaxQueue:       number("max-queue"),
+		RatePerMinute:  number("rate-limit"),
+		DailyTokens:    number("daily-token-quota"),
+		MonthlyTokens:  number("monthly-token-quota"),
+	}
+	var err error
+	s.LLM, err = parseLLMURL(get("llm"))
+	check("llm", err)
+	if s.Model == "" {
+		check("model", errors.New("must not be empty"))
+	}
+	s.Policy, err = parseRegPolicy(get("registration"), get("allowed-domains"))
+	check("registration", err)
+	s.ModelLimits, err = parseModelLimits(get("model-concurrency"))
+	check("model-concurrency", err)
+	s.LogLevel, err = parseLogLevel(get("log-level"))
+	check("log-level", err)
+	s.Require2FA, err = strconv.ParseBool(get("require-2fa"))
+	check("require-2fa", err)
+	return s, errors.Join(errs...)
+}
+
+// reloader applies new settings to the parts of the server that hold on
+// to them.
+type reloader struct {
+	mu    sync.Mutex
+	sched *scheduler
+	rate  *store.RateLimiter
+}
+
+func (rl *reloader) install(s *settings) {
+	live.Store(s)
+	rl.sched.setLimits(s.MaxGenerations, s.ModelLimits, s.MaxQueue)
+	rl.rate.SetLimit(s.RatePerMinute)
+	logLevelVar.Set(s.LogLevel)
+}
+
+// reloadResult tells what a reload changed. RestartRequired lists changed
+// settings that are not reloadable and were left as they are.
+type reloadResult struct {
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// reload reads the config file again and applies the reloadable settings.
+// Values come from the same places as at startup, so command-line flags
+// still win. If anything is invalid nothing changes.
+func (rl *reloader) reload() (reloadResult, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	res := reloadResult{Changed: []string{}, RestartRequired: []string{}}
+	var file map[string]string
+	if *configFile != "" {
+		b, err := os.ReadFile(*configFile)
+		if err != nil {
+			return res, err
+		}
+		if file, err = parseConfigFile(string(b)); err != nil {
+			return res, fmt.Errorf("%s: %w", *configFile, err)
+		}
+	}
+	var errs []error
+	for key := range file {
+		if f := flag.Lookup(key); f == nil || key == "config" || key == "print-config" {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", *configFile, key))
+		}
+	}
+	values := make(map[string]string)
+	sources := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		v, src := f.DefValue, ""
+		if configSources[f.Name] == "flag" {
+			v, src = f.Value.String(), "flag"
+		} else if e, ok := os.LookupEnv(envName(f.Name)); ok {
+			v, src = e, "env"
+		} else if fv, ok := file[f.Name]; ok {
+			v, src = fv, "file"
+		}
+		values[f.Name], sources[f.Name] = v, src
+		if normalize(f, v) == f.Value.String() || f.Name == "config" {
+			return
+		}
+		if reloadable[f.Name] {
+			res.Changed = append(res.Changed, f.Name)
+		} else {
+			res.RestartRequired = append(res.RestartRequired, f.Name)
+		}
+	})
+	s, err := newSettings(func(name string) string { return values[name] })
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return res, err
+	}
+	// Keep the flags in step, so the printed configuration stays true.
+	for _, name := range res.Changed {
+		flag.Set(name, values[name])
+	}
+	for name := range reloadable {
+		configSources[name] = sources[name]
+	}
+	old := current()
+	rl.install(s)
+	if s.LLM != old.LLM || s.Model != old.Model {
+		warmModel(s.LLM, s.Model)
+	}
+	sort.Strings(res.Changed)
+	sort.Strings(res.RestartRequired)
+	return res, nil
+}
+
+// normalize returns v as f would print it once set, so that "1m" and
+// "1m0s" compare equal.
+func normalize(f *flag.Flag, v string) string {
+	g, ok := f.Value.(flag.Getter)
+	if !ok {
+		return v
+	}
+	switch g.Get().(type) {
+	case time.Duration:
+		if d, err := time.ParseDuration(v); err == nil {
+			return d.String()
+		}
+	case bool:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return strconv.FormatBool(b)
+		}
+	case int:
+		if n, err := strconv.Atoi(v); err == nil {
+			return strconv.Itoa(n)
+		}
+	}
+	return v
+}
+
+// reloadAndLog reloads and logs the outcome, for SIGHUP.
+func (rl *reloader) reloadAndLog() {
+	res, err := rl.reload()
+	if err != nil {
+		slog.Error("configuration not reloaded, keeping the old one", "err", err)
+		return
+	}
+	slog.Info("configuration reloaded", "changed", res.Changed)
+	if len(res.RestartRequired) > 0 {
+		slog.Warn("some changes need a restart", "settings", res.RestartRequired)
+	}
+}
+
+// adminReloadHandler serves POST /admin/config/reload.
+func adminReloadHandler(rl *reloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := rl.reload()
+		if err != nil {
+			slog.WarnContext(r.Context(), "configuration not reloaded", "err", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":  "configuration not reloaded; the old one stays in effect",
+				"errors": strings.Split(err.Error(), "\n"),
+			})
+			return
+		}
+		slog.InfoContext(r.Context(), "configuration reloaded", "changed", res.Changed, "restart_required", res.RestartRequired)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// defaultReportDays is the period a usage report covers when no dates are given.
+const defaultReportDays = 30
+
+// reportQuery is the parsed query string of a usage report:
+// from and to (YYYY-MM-DD, inclusive), group (a comma-separated subset of
+// user, model and day) and format (json or csv).
+type reportQuery struct {
+	From, To string
+	Group    store.UsageGroup
+	CSV      bool
+}
+
+func parseReportQuery(r *http.Request, defaultGroup string) (reportQuery, error) {
+	var q reportQuery
+	v := r.URL.Query()
+	now := time.Now()
+	q.To = v.Get("to")
+	if q.To == "" {
+		q.To = store.DayKey(now)
+	}
+	q.From = v.Get("from")
+	if q.From == "" {
+		q.From = store.DayKey(now.AddDate(0, 0, 1-defaultReportDays))
+	}
+	for _, d := range []string{q.From, q.To} {
+		if _, err := time.Parse("2006-01-02", d); err != nil {
+			return q, fmt.Errorf("dates must look like 2006-01-02, got %q", d)
+		}
+	}
+	group := v.Get("group")
+	if group == "" {
+		group = defaultGroup
+	}
+	for _, g := range strings.Split(group, ",") {
+		switch strings.TrimSpace(g) {
+		case "user":
+			q.Group.User = true
+		case "model":
+			q.Group.Model = true
+		case "day":
+			q.Group.Day = true
+		case "", "none":
+		default:
+			return q, fmt.Errorf("unknown group %q; use user, model or day", g)
+		}
+	}
+	switch v.Get("format") {
+	case "", "json":
+	case "csv":
+		q.CSV = true
+	default:
+		return q, fmt.Errorf("unknown format %q; use json or csv", v.Get("format"))
+	}
+	return q, nil
+}
+
+// reportRow is a store.UsageRow as shown to people: with the username and
+// with durations in seconds.
+type reportRow struct {
+	Day              string  `json:"day,omitempty"`
+	UserID           string  `json:"userId,omitempty"`
+	Username         string  `json:"username,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"promptTokens"`
+	CompletionTokens int     `json:"completionTokens"`
+	TotalSeconds     float64 `json:"totalSeconds"`
+	LoadSeconds      float64 `json:"loadSeconds"`
+	EvalRate         float64 `json:"evalRate"` // completion tokens per second
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+func newReportRow(row store.UsageRow, users *store.UserStore) reportRow {
+	rr := reportRow{
+		Day:              row.Day,
+		UserID:           row.UserID,
+		Model:            row.Model,
+		Requests:         row.Requests,
+		PromptTokens:     row.PromptTokens,
+		CompletionTokens: row.CompletionTokens,
+		TotalSeconds:     round2(row.TotalDuration.Seconds()),
+		LoadSeconds:      round2(row.LoadDuration.Seconds()),
+		EvalRate:         round2(row.EvalRate()),
+	}
+	if row.UserID != "" {
+		if u := users.ByID(row.UserID); u != nil {
+			rr.Username = u.Username
+		}
+	}
+	return rr
+}
+
+// writeUsageReport runs the report for userID ("" for everyone) and writes
+// it as JSON or CSV.
+func writeUsageReport(w http.ResponseWriter, r *http.Request, users *store.UserStore, usage *store.UsageStore, userID, defaultGroup string) {
+	q, err := parseReportQuery(r, defaultGroup)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rows, err := usage.Report(userID, q.From, q.To, q.Group)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "usage report", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]reportRow, len(rows))
+	for i, row := range rows {
+		out[i] = newReportRow(row, users)
+	}
+	if !q.CSV {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"from": q.From, "to": q.To, "rows": out})
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s-%s.csv"`, q.From, q.To))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"day", "user_id", "username", "model", "requests", "prompt_tokens", "completion_tokens", "total_seconds", "load_seconds", "eval_rate"})
+	for _, rr := range out {
+		cw.Write([]string{
+			rr.Day, rr.UserID, rr.Username, rr.Model,
+			strconv.Itoa(rr.Requests), strconv.Itoa(rr.PromptTokens), strconv.Itoa(rr.CompletionTokens),
+			strconv.FormatFloat(rr.TotalSeconds, 'f', 2, 64),
+			strconv.FormatFloat(rr.LoadSeconds, 'f', 2, 64),
+			strconv.FormatFloat(rr.EvalRate, 'f', 2, 64),
+		})
+	}
+	cw.Flush()
+}
+
+// adminUsageHandler serves GET /admin/usage: usage of all users, by user,
+// model and day unless grouped otherwise.
+func adminUsageHandler(users *store.UserStore, usage *store.UsageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeUsageReport(w, r, users, usage, "", "user,model,day")
+	}
+}
+
+// usageReportHandler serves GET /account/usage/report: the signed-in
+// user's own usage by model and day.
+func usageReportHandler(users *store.UserStore, usage *store.UsageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := store.UserIDFromContext(r.Context())
+		if userID == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		writeUsageReport(w, r, users, usage, userID, "model,day")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+func TestUsageReportCSV(t *testing.T) {
+	dir := t.TempDir()
+	users, err := store.NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := store.NewUsageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := users.Register("alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+	for _, u := range []store.Usage{
+		{Requests: 1, PromptTokens: 10, CompletionTokens: 30, TotalDuration: 1500 * time.Millisecond, EvalDuration: time.Second},
+		{Requests: 1, PromptTokens: 5, CompletionTokens: 10, TotalDuration: 1001 * time.Millisecond, LoadDuration: 250 * time.Millisecond, EvalDuration: 2 * time.Second},
+	} {
+		if err := usage.Record(alice.ID, "llama3", day, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A deleted user's usage has no username.
+	if err := usage.Record("gone", "gemma3", day.AddDate(0, 0, 1), store.Usage{Requests: 1, PromptTokens: 1, CompletionTokens: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(h http.HandlerFunc, query string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/usage?"+query, nil)
+		req = req.WithContext(store.ContextWithUserID(req.Context(), alice.ID))
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+	admin := adminUsageHandler(users, usage)
+	rec := get(admin, "from=2026-03-01&to=2026-03-31&format=csv")
+	if ct := rec.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="usage-2026-03-01-2026-03-31.csv"` {
+		t.Errorf("Content-Disposition %q", cd)
+	}
+	want := "day,user_id,username,model,requests,prompt_tokens,completion_tokens,total_seconds,load_seconds,eval_rate\n" +
+		"2026-03-01," + alice.ID + ",alice@example.com,llama3,2,15,40,2.50,0.25,13.33\n" +
+		"2026-03-02,gone,,gemma3,1,1,1,0.00,0.00,0.00\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("CSV\n%s\nwant\n%s", got, want)
+	}
+
+	// The user's own report defaults to model and day, and only has theirs.
+	rec = get(usageReportHandler(users, usage), "from=2026-03-01&to=2026-03-31")
+	var resp struct {
+		From, To string
+		Rows     []reportRow
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rows) != 1 || resp.Rows[0] != (reportRow{Day: "2026-03-01", Model: "llama3", Requests: 2, PromptTokens: 15, CompletionTokens: 40, TotalSeconds: 2.5, LoadSeconds: 0.25, EvalRate: 13.33}) {
+		t.Errorf("own report %+v", resp.Rows)
+	}
+	rec = get(admin, "from=2026-03-01&to=2026-03-31&group=none&format=csv")
+	if got := strings.Split(rec.Body.String(), "\n")[1]; got != ",,,,3,16,41,2.50,0.25,13.67" {
+		t.Errorf("ungrouped row %q", got)
+	}
+
+	for query, msg := range map[string]string{
+		"from=1.3.2026": "dates must look like 2006-01-02",
+		"group=week":    "unknown group",
+		"format=xml":    "unknown format",
+		"to=2026-02-30": "dates must look like 2006-01-02",
+	} {
+		rec := get(admin, query)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), msg) {
+			t.Errorf("%s: %d %s", query, rec.Code, rec.Body)
+		}
+	}
+}
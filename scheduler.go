@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errQueueFull = errors.New("too many requests are waiting for the model, try again shortly")
+
+// ticket is a generation waiting for, or holding, a slot.
+type ticket struct {
+	user, model string
+	ready       chan struct{}
+	granted     bool
+	position    func(int)
+}
+
+// scheduler limits how many generations run at once, overall and per
+// model. Waiting generations are served round-robin across users, so one
+// user with many chats cannot starve the others.
+type scheduler struct {
+	maxRunning int            // 0 means unlimited
+	perModel   map[string]int // model -> limit; missing means no extra limit
+	maxQueue   int            // 0 means unlimited
+
+	mu      sync.Mutex
+	running int
+	byModel map[string]int
+	queues  map[string][]*ticket // user -> waiting tickets, oldest first
+	order   []string             // users with waiting tickets, next to serve first
+}
+
+func newScheduler(maxRunning int, perModel map[string]int, maxQueue int) *scheduler {
+	return &scheduler{
+		maxRunning: maxRunning,
+		perModel:   perModel,
+		maxQueue:   maxQueue,
+		byModel:    make(map[string]int),
+		queues:     make(map[string][]*ticket),
+	}
+}
+
+// parseModelLimits parses "model=n,model=n".
+func parseModelLimits(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, n, ok := strings.Cut(part, "=")
+		limit, err := strconv.Atoi(strings.TrimSpace(n))
+		if !ok || strings.TrimSpace(name) == "" || err != nil || limit < 1 {
+			return nil, fmt.Errorf("model limit %q: want model=n with n >= 1", part)
+		}
+		limits[strings.TrimSpace(name)] = limit
+	}
+	return limits, nil
+}
+
+// enqueue adds a generation to the queue, or gives it a slot right away.
+// position is called with the 1-based queue position whenever it changes
+// and with 0 once the slot is granted.
+func (s *scheduler) enqueue(user, model string, position func(int)) (*ticket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	waiting := 0
+	for _, q := range s.queues {
+		waiting += len(q)
+	}
+	if s.maxQueue > 0 && waiting >= s.maxQueue && !s.free(model) {
+		return nil, errQueueFull
+	}
+	t := &ticket{user: user, model: model, ready: make(chan struct{}), position: position}
+	if len(s.queues[user]) == 0 {
+		s.order = append(s.order, user)
+	}
+	s.queues[user] = append(s.queues[user], t)
+	s.dispatch()
+	return t, nil
+}
+
+// setLimits changes the limits. Lowering them lets running generations
+// finish; raising them starts waiting ones right away.
+func (s *scheduler) setLimits(maxRunning int, perModel map[string]int, maxQueue int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxRunning, s.perModel, s.maxQueue = maxRunning, perModel, maxQueue
+	s.dispatch()
+}
+
+// stats returns how many generations are running and how many are waiting.
+func (s *scheduler) stats() (running, waiting int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range s.queues {
+		waiting += len(q)
+	}
+	return s.running, waiting
+}
+
+// wait blocks until t holds a slot. If ctx ends first, t leaves the queue.
+func (s *scheduler) wait(ctx context.Context, t *ticket) error {
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if t.granted {
+			return nil // lost the race; the caller releases the slot
+		}
+		s.remove(t)
+		s.dispatch()
+		return ctx.Err()
+	}
+}
+
+// release frees the slot held by t, or drops t from the queue.
+func (s *scheduler) release(t *ticket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.granted {
+		t.granted = false
+		s.running--
+		s.byModel[t.model]--
+	} else {
+		s.remove(t)
+	}
+	s.dispatch()
+}
+
+// free reports whether a generation for model could start now. s.mu must be held.
+func (s *scheduler) free(model string) bool {
+	if s.maxRunning > 0 && s.running >= s.maxRunning {
+		return false
+	}
+	if limit, ok := s.perModel[model]; ok && s.byModel[model] >= limit {
+		return false
+	}
+	return true
+}
+
+// remove drops a waiting ticket. s.mu must be held.
+func (s *scheduler) remove(t *ticket) {
+	q := s.queues[t.user]
+	for i, w := range q {
+		if w == t {
+			s.queues[t.user] = append(q[:i:i], q[i+1:]...)
+			break
+		}
+	}
+	if len(s.queues[t.user]) == 0 {
+		delete(s.queues, t.user)
+		for i, u := range s.order {
+			if u == t.user {
+				s.order = append(s.order[:i:i], s.order[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// dispatch grants free slots to waiting tickets, taking users in turn,
+// then tells the rest where they stand. s.mu must be held.
+func (s *scheduler) dispatch() {
+	for granted := true; granted; {
+		granted = false
+		for i, user := range s.order {
+			t := s.first(user)
+			if t == nil {
+				continue
+			}
+			s.remove(t)
+			t.granted = true
+			s.running++
+			s.byModel[t.model]++
+			close(t.ready)
+			if t.position != nil {
+				t.position(0)
+			}
+			// Move the user to the back of the line.
+			if len(s.queues[user]) > 0 {
+				s.order = append(append(s.order[:i:i], s.order[i+1:]...), user)
+			}
+			granted = true
+			break
+		}
+	}
+	// Positions follow the round-robin order: everyone's first ticket,
+	// then everyone's second, and so on.
+	pos := 0
+	for round := 0; ; round++ {
+		more := false
+		for _, user := range s.order {
+			q := s.queues[user]
+			if round < len(q) {
+				pos++
+				more = true
+				if q[round].position != nil {
+					q[round].position(pos)
+				}
+			}
+		}
+		if !more {
+			break
+		}
+	}
+}
+
+// first returns the oldest ticket of user that could start now. Only the
+// user's own order is kept per model: a ticket for a busy model does not
+// hold back the user's tickets for other models. s.mu must be held.
+func (s *scheduler) first(user string) *ticket {
+	seen := make(map[string]bool)
+	for _, t := range s.queues[user] {
+		if seen[t.model] {
+			continue
+		}
+		seen[t.model] = true
+		if s.free(t.model) {
+			return t
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func granted(t *ticket) bool {
+	select {
+	case <-t.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func mustEnqueue(t *testing.T, s *scheduler, user, model string, position func(int)) *ticket {
+	t.Helper()
+	tk, err := s.enqueue(user, model, position)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tk
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	s := newScheduler(1, nil, 0)
+	running := mustEnqueue(t, s, "first", "m", nil)
+	if !granted(running) {
+		t.Fatal("first ticket waits with a free slot")
+	}
+	var order []string
+	var lightPos int
+	enqueue := func(user string) *ticket {
+		return mustEnqueue(t, s, user, "m", func(pos int) {
+			if pos == 0 {
+				order = append(order, user)
+			}
+			if user == "light" {
+				lightPos = pos
+			}
+		})
+	}
+	var tickets []*ticket
+	for range 5 {
+		tickets = append(tickets, enqueue("heavy"))
+	}
+	tickets = append(tickets, enqueue("light"))
+	// heavy's first, then light's first, then the rest of heavy's.
+	if lightPos != 2 {
+		t.Errorf("light user is at position %d, want 2", lightPos)
+	}
+	if r, w := s.stats(); r != 1 || w != 6 {
+		t.Errorf("%d running, %d waiting; want 1 and 6", r, w)
+	}
+
+	for range tickets {
+		s.release(running)
+		running = nil
+		for _, tk := range tickets {
+			if granted(tk) && tk.granted {
+				running = tk
+			}
+		}
+		if running == nil {
+			t.Fatal("releasing a slot started nothing")
+		}
+	}
+	if want := []string{"heavy", "light", "heavy", "heavy", "heavy", "heavy"}; !slices.Equal(order, want) {
+		t.Errorf("served %q, want %q", order, want)
+	}
+}
+
+func TestSchedulerModelLimits(t *testing.T) {
+	s := newScheduler(0, map[string]int{"big": 1}, 0)
+	big1 := mustEnqueue(t, s, "u", "big", nil)
+	big2 := mustEnqueue(t, s, "u", "big", nil)
+	small := mustEnqueue(t, s, "u", "small", nil)
+	if !granted(big1) || granted(big2) {
+		t.Fatal("the per-model limit of 1 does not hold")
+	}
+	// The user's waiting ticket for big does not hold back small.
+	if !granted(small) {
+		t.Error("a ticket for another model waits behind a busy one")
+	}
+	other := mustEnqueue(t, s, "v", "big", nil)
+	if granted(other) {
+		t.Error("another user got past the per-model limit")
+	}
+	if r, w := s.stats(); r != 2 || w != 2 {
+		t.Errorf("%d running, %d waiting; want 2 and 2", r, w)
+	}
+	s.release(big1)
+	if !granted(big2) || granted(other) {
+		t.Error("the freed slot did not go to the oldest waiting ticket")
+	}
+	s.release(big2)
+	if !granted(other) {
+		t.Error("the last ticket did not start")
+	}
+}
+
+func TestSchedulerMaxQueue(t *testing.T) {
+	s := newScheduler(1, nil, 1)
+	mustEnqueue(t, s, "u", "m", nil)
+	waiting := mustEnqueue(t, s, "u", "m", nil)
+	if _, err := s.enqueue("v", "m", nil); err != errQueueFull {
+		t.Fatalf("full queue: %v, want errQueueFull", err)
+	}
+	s.release(waiting)
+	if _, err := s.enqueue("v", "m", nil); err != nil {
+		t.Errorf("queue with room: %v", err)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	s := newScheduler(1, nil, 1)
+	running := mustEnqueue(t, s, "u", "m", nil)
+	cancelled := mustEnqueue(t, s, "u", "m", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.wait(ctx, cancelled); err != context.Canceled {
+		t.Fatalf("wait: %v, want context.Canceled", err)
+	}
+	if _, w := s.stats(); w != 0 {
+		t.Errorf("%d waiting after the cancel, want 0", w)
+	}
+
+	// Its place in the queue is free, and it is never granted.
+	next, err := s.enqueue("v", "m", nil)
+	if err != nil {
+		t.Fatalf("enqueue after the cancel: %v", err)
+	}
+	s.release(running)
+	if granted(cancelled) || !granted(next) {
+		t.Error("the slot did not go to the next ticket")
+	}
+	// Releasing the running ticket frees the slot for the next one.
+	last := mustEnqueue(t, s, "w", "m", nil)
+	s.release(next)
+	if !granted(last) {
+		t.Error("releasing a running ticket did not free its slot")
+	}
+	if r, w := s.stats(); r != 1 || w != 0 {
+		t.Errorf("%d running, %d waiting; want 1 and 0", r, w)
+	}
+}
+
+func TestSchedulerSetLimits(t *testing.T) {
+	s := newScheduler(1, nil, 0)
+	var tickets []*ticket
+	for range 3 {
+		tickets = append(tickets, mustEnqueue(t, s, "u", "m", nil))
+	}
+	s.setLimits(3, nil, 0)
+	for i, tk := range tickets {
+		if !granted(tk) {
+			t.Errorf("ticket %d waits after the limit was raised", i)
+		}
+	}
+
+	// Lowering the limit lets running generations finish.
+	s.setLimits(0, map[string]int{"m": 1}, 0)
+	late := mustEnqueue(t, s, "v", "m", nil)
+	s.release(tickets[0])
+	s.release(tickets[1])
+	if granted(late) {
+		t.Error("started while the lowered model limit was still taken")
+	}
+	s.release(tickets[2])
+	if !granted(late) {
+		t.Error("not started once the lowered limit had room")
+	}
+
+	s.setLimits(1, nil, 1)
+	mustEnqueue(t, s, "v", "m", nil)
+	if _, err := s.enqueue("v", "m", nil); err != errQueueFull {
+		t.Errorf("lowered max queue: %v, want errQueueFull", err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// newCSRFProtection rejects state-changing browser requests that come from
+// another origin, based on Sec-Fetch-Site or Origin. Scripts using API
+// tokens send neither header and are not affected.
+func newCSRFProtection(trusted string) (*http.CrossOriginProtection, error) {
+	c := http.NewCrossOriginProtection()
+	for _, o := range strings.Split(trusted, ",") {
+		if o = strings.TrimSpace(o); o == "" {
+			continue
+		}
+		if err := c.AddTrustedOrigin(o); err != nil {
+			return nil, err
+		}
+	}
+	c.SetDenyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.WarnContext(r.Context(), "cross-origin request rejected", "method", r.Method, "path", r.URL.Path, "origin", r.Header.Get("Origin"), "sec_fetch_site", r.Header.Get("Sec-Fetch-Site"))
+		http.Error(w, "cross-origin request rejected", http.StatusForbidden)
+	}))
+	return c, nil
+}
+
+// serverHandler wraps mux in the middleware every request passes through.
+// Requests the CSRF check rejects are still counted and logged.
+func serverHandler(mux *http.ServeMux, proxies []*net.IPNet, csrf *http.CrossOriginProtection) http.Handler {
+	return requestID(proxyHeaders(proxies, securityHeaders(instrument(mux, csrf.Handler(mux)))))
+}
+
+// allowMethods answers 405 with an Allow header for any other method.
+func allowMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				h(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// clearSessionCookie expires the session cookie in the browser.
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     store.SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+type ctxKey string
+
+const forwardedHTTPSKey ctxKey = "forwardedHTTPS"
+
+// isHTTPS reports whether the client reached us over HTTPS, either directly
+// or through a trusted proxy that said so in X-Forwarded-Proto.
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	v, _ := r.Context().Value(forwardedHTTPSKey).(bool)
+	return v
+}
+
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func ipIn(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyHeaders honours X-Forwarded-For and X-Forwarded-Proto when the
+// direct peer is a trusted proxy. The client address is the right-most
+// X-Forwarded-For entry that is not itself a trusted proxy, and replaces
+// r.RemoteAddr so clientIP and logging see the real client.
+func proxyHeaders(trusted []*net.IPNet, h http.Handler) http.Handler {
+	if len(trusted) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := net.ParseIP(clientIP(r))
+		if peer == nil || !ipIn(peer, trusted) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			hops := strings.Split(xff, ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				ip := net.ParseIP(strings.TrimSpace(hops[i]))
+				if ip == nil {
+					break
+				}
+				r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+				if !ipIn(ip, trusted) {
+					break
+				}
+			}
+		}
+		if strings.EqualFold(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto")), "https") {
+			r = r.WithContext(context.WithValue(r.Context(), forwardedHTTPSKey, true))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// contentSecurityPolicy allows the inline scripts and styles of the bundled
+// pages and the Inter font from Google Fonts, and nothing else.
+const contentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline'; " +
+	"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com; " +
+	"font-src https://fonts.gstatic.com; " +
+	"img-src 'self' data:; " +
+	"connect-src 'self'; " +
+	"frame-ancestors 'none'; base-uri 'none'; form-action 'self'"
+
+// securityHeaders sets browser hardening headers on every response. HSTS
+// is only sent over HTTPS, where browsers honour it.
+func securityHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr := w.Header()
+		hdr.Set("Content-Security-Policy", contentSecurityPolicy)
+		hdr.Set("X-Frame-Options", "DENY")
+		hdr.Set("X-Content-Type-Options", "nosniff")
+		// Reset links carry their token in the URL; never leak it.
+		hdr.Set("Referrer-Policy", "no-referrer")
+		if isHTTPS(r) {
+			hdr.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/agerasimovski/chatlocal/metrics"
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// csrfServer serves /chats through the same middleware as the real server
+// and returns it with the session cookie of a user who owns one chat.
+func csrfServer(t *testing.T, trusted string) (srv *httptest.Server, cookie *http.Cookie, chatID string) {
+	t.Helper()
+	useSettings(t, nil)
+	dir := t.TempDir()
+	users, err := store.NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := store.NewSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := store.NewTokenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chats, err := store.NewChatStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := store.NewUsageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := users.Register("alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, err := sessions.Create(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chatID, err = chats.Create(u.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := newJobManager(chats, usage, newGenerations(), newScheduler(0, nil, 0))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chats", store.RequireAuth(users, sessions, tokens, need2FA(users, chatsHandler(chats, jobs))))
+	mux.HandleFunc("/chats/", store.RequireAuth(users, sessions, tokens, need2FA(users, chatsHandler(chats, jobs))))
+	csrf, err := newCSRFProtection(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv = httptest.NewServer(serverHandler(mux, nil, csrf))
+	t.Cleanup(srv.Close)
+	return srv, &http.Cookie{Name: store.SessionCookieName, Value: sid}, chatID
+}
+
+func send(t *testing.T, srv *httptest.Server, cookie *http.Cookie, method, path string, header map[string]string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(cookie)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestCSRFRejectsCrossSite(t *testing.T) {
+	srv, cookie, chatID := csrfServer(t, "")
+	crossSite := map[string]string{"Origin": "https://evil.example", "Sec-Fetch-Site": "cross-site"}
+	oldBrowser := map[string]string{"Origin": "https://evil.example"}
+	for _, tc := range []struct {
+		method, path string
+		header       map[string]string
+	}{
+		{http.MethodPost, "/chats", crossSite},
+		{http.MethodDelete, "/chats/" + chatID, crossSite},
+		{http.MethodPost, "/chats", oldBrowser},
+		{http.MethodDelete, "/chats/" + chatID, oldBrowser},
+	} {
+		if code := send(t, srv, cookie, tc.method, tc.path, tc.header); code != http.StatusForbidden {
+			t.Errorf("%s %s with %v: status %d, want 403", tc.method, tc.path, tc.header, code)
+		}
+	}
+	// The chat must have survived.
+	if code := send(t, srv, cookie, http.MethodGet, "/chats/"+chatID, nil); code != http.StatusOK {
+		t.Errorf("GET /chats/%s after rejected DELETE: status %d, want 200", chatID, code)
+	}
+}
+
+// metricValue returns the value of the sample with the given name and
+// labels, as exposed, or 0 if there is none.
+func metricValue(t *testing.T, sample string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Default.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	sc := bufio.NewScanner(rec.Body)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), sample+" "); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f
+		}
+	}
+	return 0
+}
+
+func TestCSRFRejectionsAreCounted(t *testing.T) {
+	srv, cookie, chatID := csrfServer(t, "")
+	sample := `chatlocal_http_requests_total{route="/chats/",method="DELETE",code="403"}`
+	before := metricValue(t, sample)
+	crossSite := map[string]string{"Origin": "https://evil.example", "Sec-Fetch-Site": "cross-site"}
+	if code := send(t, srv, cookie, http.MethodDelete, "/chats/"+chatID, crossSite); code != http.StatusForbidden {
+		t.Fatalf("status %d, want 403", code)
+	}
+	if after := metricValue(t, sample); after != before+1 {
+		t.Errorf("%s went from %v to %v", sample, before, after)
+	}
+}
+
+func TestCSRFAllowsSameOrigin(t *testing.T) {
+	srv, cookie, chatID := csrfServer(t, "")
+	sameOrigin := map[string]string{"Origin": srv.URL, "Sec-Fetch-Site": "same-origin"}
+	if code := send(t, srv, cookie, http.MethodPost, "/chats", sameOrigin); code != http.StatusCreated {
+		t.Errorf("same-origin POST /chats: status %d, want 201", code)
+	}
+	if code := send(t, srv, cookie, http.MethodDelete, "/chats/"+chatID, sameOrigin); code != http.StatusNoContent {
+		t.Errorf("same-origin DELETE /chats/%s: status %d, want 204", chatID, code)
+	}
+	// Scripts send neither header.
+	if code := send(t, srv, cookie, http.MethodPost, "/chats", nil); code != http.StatusCreated {
+		t.Errorf("POST /chats without Origin: status %d, want 201", code)
+	}
+}
+
+func TestCSRFAllowsTrustedOrigin(t *testing.T) {
+	srv, cookie, chatID := csrfServer(t, "https://app.example, https://other.example")
+	trusted := map[string]string{"Origin": "https://app.example", "Sec-Fetch-Site": "cross-site"}
+	if code := send(t, srv, cookie, http.MethodPost, "/chats", trusted); code != http.StatusCreated {
+		t.Errorf("trusted-origin POST /chats: status %d, want 201", code)
+	}
+	if code := send(t, srv, cookie, http.MethodDelete, "/chats/"+chatID, trusted); code != http.StatusNoContent {
+		t.Errorf("trusted-origin DELETE /chats/%s: status %d, want 204", chatID, code)
+	}
+	untrusted := map[string]string{"Origin": "https://app.example.evil", "Sec-Fetch-Site": "cross-site"}
+	if code := send(t, srv, cookie, http.MethodPost, "/chats", untrusted); code != http.StatusForbidden {
+		t.Errorf("untrusted-origin POST /chats: status %d, want 403", code)
+	}
+}
+
+func TestCSRFBadTrustedOrigin(t *testing.T) {
+	if _, err := newCSRFProtection("app.example"); err == nil {
+		t.Error("origin without scheme accepted")
+	}
+}
+
+func TestProxyHeaders(t *testing.T) {
+	trusted, err := parseCIDRs("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, peer, xff, proto string
+		trusted                []*net.IPNet
+		client                 string
+		https                  bool
+	}{
+		{"untrusted peer", "203.0.113.5", "1.2.3.4", "https", trusted, "203.0.113.5", false},
+		{"no trusted proxies", "10.0.0.1", "1.2.3.4", "https", nil, "10.0.0.1", false},
+		{"trusted proxy", "10.0.0.1", "1.2.3.4", "https", trusted, "1.2.3.4", true},
+		{"single trusted address", "192.168.1.1", "1.2.3.4", "", trusted, "1.2.3.4", false},
+		{"spoofed hops before the client", "10.0.0.1", "6.6.6.6, 1.2.3.4, 10.0.0.2", "", trusted, "1.2.3.4", false},
+		{"only proxies", "10.0.0.1", "10.0.0.3, 10.0.0.2", "", trusted, "10.0.0.3", false},
+		{"garbage hop", "10.0.0.1", "1.2.3.4, not-an-ip", "", trusted, "10.0.0.1", false},
+		{"proto without https", "10.0.0.1", "", "http", trusted, "10.0.0.1", false},
+		{"IPv6 client", "10.0.0.1", "2001:db8::1", "HTTPS", trusted, "2001:db8::1", true},
+	} {
+		var client string
+		var https bool
+		h := proxyHeaders(tc.trusted, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, https = clientIP(r), isHTTPS(r)
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = net.JoinHostPort(tc.peer, "1234")
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if tc.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if client != tc.client || https != tc.https {
+			t.Errorf("%s: client %s, https %v; want %s, %v", tc.name, client, https, tc.client, tc.https)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	proxies, err := parseCIDRs("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrf, err := newCSRFProtection("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ok", func(w http.ResponseWriter, r *http.Request) {})
+	h := serverHandler(mux, proxies, csrf)
+	want := map[string]string{
+		"Content-Security-Policy": contentSecurityPolicy,
+		"X-Frame-Options":         "DENY",
+		"X-Content-Type-Options":  "nosniff",
+		"Referrer-Policy":         "no-referrer",
+	}
+	for _, tc := range []struct {
+		name, path, peer, proto string
+		tls                     bool
+		hsts                    bool
+	}{
+		{"plain HTTP", "/ok", "203.0.113.5", "", false, false},
+		{"not found", "/missing", "203.0.113.5", "", false, false},
+		{"TLS", "/ok", "203.0.113.5", "", true, true},
+		{"HTTPS at a trusted proxy", "/ok", "10.0.0.1", "https", false, true},
+		{"HTTPS claimed by anyone", "/ok", "203.0.113.5", "https", false, false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.RemoteAddr = net.JoinHostPort(tc.peer, "1234")
+		if tc.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		if tc.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		for name, v := range want {
+			if got := rec.Header().Get(name); got != v {
+				t.Errorf("%s: %s is %q, want %q", tc.name, name, got, v)
+			}
+		}
+		if hsts := rec.Header().Get("Strict-Transport-Security"); (hsts == "max-age=31536000") != tc.hsts || !tc.hsts && hsts != "" {
+			t.Errorf("%s: Strict-Transport-Security %q", tc.name, hsts)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// generations tracks in-flight LLM generations so shutdown can wait for
+// them, and interrupt them when the deadline runs out.
+type generations struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+	active   int
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func newGenerations() *generations {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &generations{ctx: ctx, cancel: cancel}
+}
+
+// begin registers a generation and returns the context it must run under.
+// It returns false once shutdown has started.
+func (g *generations) begin() (context.Context, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.draining {
+		return nil, false
+	}
+	g.active++
+	g.wg.Add(1)
+	return g.ctx, true
+}
+
+func (g *generations) end() {
+	g.mu.Lock()
+	g.active--
+	g.mu.Unlock()
+	g.wg.Done()
+}
+
+// drain stops new generations from starting.
+func (g *generations) drain() {
+	g.mu.Lock()
+	g.draining = true
+	g.mu.Unlock()
+}
+
+func (g *generations) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.active
+}
+
+// interrupted reports whether ctx, derived from a context returned by
+// begin, was cancelled by interrupt.
+func (g *generations) interrupted(ctx context.Context) bool {
+	return ctx.Err() != nil && g.ctx.Err() != nil
+}
+
+// interrupt cancels every running generation.
+func (g *generations) interrupt() {
+	g.cancel()
+}
+
+// wait blocks until all generations have ended or timeout passes and
+// reports whether they all ended.
+func (g *generations) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The pages and static files are built into the binary, so it runs from
+// any directory.
+//
+//go:embed *.html static
+var embedded embed.FS
+
+// ui serves the pages and static files; main sets it up.
+var ui *site
+
+// site renders the HTML pages and serves the files under static/. Normally
+// everything is read and parsed once from the embedded files. In dev mode
+// they are read from the working directory on every request instead, and
+// open pages reload when a file changes.
+type site struct {
+	fsys   fs.FS
+	dev    bool
+	pages  map[string]*template.Template
+	assets map[string]*asset
+	stop   chan struct{}
+}
+
+// asset is a static file with the validator browsers cache it by.
+type asset struct {
+	data    []byte
+	version string // start of the content hash
+}
+
+func (a *asset) etag() string {
+	return `"` + a.version + `"`
+}
+
+func newSite(dev bool) (*site, error) {
+	s := &site{fsys: embedded, dev: dev, stop: make(chan struct{})}
+	if dev {
+		s.fsys = os.DirFS(".")
+		if _, err := fs.Stat(s.fsys, "view.html"); err != nil {
+			return nil, fmt.Errorf("-dev reads the pages from the source directory: %w", err)
+		}
+		return s, nil
+	}
+	s.assets = make(map[string]*asset)
+	err := fs.WalkDir(s.fsys, "static", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := strings.TrimPrefix(p, "static/")
+		s.assets[name], err = s.loadAsset(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	names, err := fs.Glob(s.fsys, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	s.pages = make(map[string]*template.Template)
+	for _, name := range names {
+		if s.pages[name], err = s.parse(name); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *site) loadAsset(name string) (*asset, error) {
+	b, err := fs.ReadFile(s.fsys, "static/"+name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return &asset{data: b, version: hex.EncodeToString(sum[:8])}, nil
+}
+
+func (s *site) asset(name string) (*asset, error) {
+	if s.dev {
+		if !fs.ValidPath(name) {
+			return nil, fs.ErrNotExist
+		}
+		return s.loadAsset(name)
+	}
+	if a, ok := s.assets[name]; ok {
+		return a, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+// assetURL is the {{asset "name"}} template function. The URL carries the
+// content hash, so the file can be cached for good and a new build still
+// gets fetched.
+func (s *site) assetURL(name string) (string, error) {
+	a, err := s.asset(name)
+	if err != nil {
+		return "", err
+	}
+	return "/static/" + name + "?v=" + a.version, nil
+}
+
+func (s *site) parse(name string) (*template.Template, error) {
+	return template.New(name).Funcs(template.FuncMap{"asset": s.assetURL}).ParseFS(s.fsys, name)
+}
+
+// render writes the page name executed with data.
+func (s *site) render(w http.ResponseWriter, r *http.Request, name string, data any) {
+	var version string
+	if s.dev {
+		// Before reading the page, so that no change goes unnoticed.
+		version = s.version()
+	}
+	t, ok := s.pages[name]
+	var err error
+	if s.dev {
+		t, err = s.parse(name)
+	} else if !ok {
+		err = fmt.Errorf("no page %s", name)
+	}
+	var buf bytes.Buffer
+	if err == nil {
+		err = t.Execute(&buf, data)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "page template", "page", name, "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	b := buf.Bytes()
+	if s.dev {
+		script := fmt.Sprintf("<script>new EventSource('/dev/reload?v=%s').addEventListener('reload', () => location.reload());</script>\n", version)
+		b = bytes.Replace(b, []byte("</body>"), []byte(script+"</body>"), 1)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b)
+}
+
+// staticHandler serves /static/. Files asked for by their current hash, as
+// {{asset}} links them, are immutable; others must be revalidated with
+// their ETag.
+func (s *site) staticHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	a, err := s.asset(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case s.dev:
+		w.Header().Set("Cache-Control", "no-cache")
+	case r.URL.Query().Get("v") == a.version:
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
+	w.Header().Set("ETag", a.etag())
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(a.data))
+}
+
+// version changes whenever a page or static file on disk changes.
+func (s *site) version() string {
+	var latest time.Time
+	n := 0
+	fs.WalkDir(s.fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if p != "." && p != "static" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if path.Dir(p) != "static" && path.Ext(p) != ".html" {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		n++
+		return nil
+	})
+	return fmt.Sprintf("%d.%d", latest.UnixNano(), n)
+}
+
+// devReloadHandler serves /dev/reload, an event stream that sends "reload"
+// once the files differ from version v. It ends after a while and the
+// browser reconnects, so the server can shut down.
+func (s *site) devReloadHandler(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query().Get("v")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	rc := http.NewResponseController(w)
+	fmt.Fprint(w, "retry: 500\n\n")
+	rc.Flush()
+	tick := time.NewTicker(300 * time.Millisecond)
+	defer tick.Stop()
+	timeout := time.After(30 * time.Second)
+	for {
+		if s.version() != v {
+			fmt.Fprint(w, "event: reload\ndata:\n\n")
+			rc.Flush()
+			return
+		}
+		select {
+		case <-tick.C:
+		case <-timeout:
+			return
+		case <-r.Context().Done():
+			return
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// close ends the reload streams, so shutdown need not wait for them.
+func (s *site) close() {
+	close(s.stop)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/oidc"
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+const (
+	oidcStateCookie = "oidc_state"
+	oidcLoginWindow = 10 * time.Minute
+)
+
+// oidcLogins remembers authorization requests between the redirect to the
+// provider and the callback, keyed by state.
+type oidcLogins struct {
+	mu      sync.Mutex
+	pending map[string]oidcPending
+}
+
+type oidcPending struct {
+	req     *oidc.AuthRequest
+	expires time.Time
+}
+
+func (l *oidcLogins) put(ar *oidc.AuthRequest) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, p := range l.pending {
+		if now.After(p.expires) {
+			delete(l.pending, k)
+		}
+	}
+	l.pending[ar.State] = oidcPending{req: ar, expires: now.Add(oidcLoginWindow)}
+}
+
+func (l *oidcLogins) take(state string) *oidc.AuthRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, ok := l.pending[state]
+	delete(l.pending, state)
+	if !ok || time.Now().After(p.expires) {
+		return nil
+	}
+	return p.req
+}
+
+// ssoFail sends the browser back to the login page with a message to show.
+func ssoFail(w http.ResponseWriter, r *http.Request, msg string) {
+	http.Redirect(w, r, "/login?error="+url.QueryEscape(msg), http.StatusFound)
+}
+
+// oidcLoginHandler starts the authorization code flow.
+func oidcLoginHandler(provider *oidc.Provider, logins *oidcLogins) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ar, err := provider.NewAuthRequest(r.Context())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "oidc auth request", "err", err)
+			ssoFail(w, r, "single sign-on is unavailable right now")
+			return
+		}
+		logins.put(ar)
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    ar.State,
+			Path:     "/login/oidc",
+			MaxAge:   int(oidcLoginWindow.Seconds()),
+			HttpOnly: true,
+			Secure:   isHTTPS(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, ar.URL, http.StatusFound)
+	}
+}
+
+// oidcCallbackHandler finishes the flow, maps the ID token to a local user
+// and starts a session. An existing account is only linked when the provider
+// has verified the email address. Users who turned on two-factor
+// authentication here still have to enter their code; the provider's own
+// second factor is not visible to chatlocal.
+func oidcCallbackHandler(provider *oidc.Provider, logins *oidcLogins, users *store.UserStore, sessions *store.SessionStore, pending *store.PendingLogins) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			slog.WarnContext(r.Context(), "oidc callback error", "error", e, "description", q.Get("error_description"))
+			ssoFail(w, r, "sign-in was cancelled or refused by the identity provider")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/login/oidc", MaxAge: -1, HttpOnly: true, Secure: isHTTPS(r)})
+		cookie, err := r.Cookie(oidcStateCookie)
+		state := q.Get("state")
+		if err != nil || state == "" || cookie.Value != state {
+			ssoFail(w, r, "sign-in session expired, please try again")
+			return
+		}
+		ar := logins.take(state)
+		if ar == nil {
+			ssoFail(w, r, "sign-in session expired, please try again")
+			return
+		}
+		claims, err := provider.Exchange(r.Context(), q.Get("code"), ar)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "oidc exchange", "err", err)
+			ssoFail(w, r, "could not verify your sign-in with the identity provider")
+			return
+		}
+		email := strings.TrimSpace(strings.ToLower(claims.Email))
+		if _, err := mail.ParseAddress(email); err != nil {
+			ssoFail(w, r, "the identity provider did not share a valid email address")
+			return
+		}
+		if claims.EmailVerified != nil && !*claims.EmailVerified {
+			ssoFail(w, r, "your email address is not verified with the identity provider")
+			return
+		}
+		// Without email_verified the provider vouches for nothing but sub, so
+		// the address may not take over an account or claim a domain.
+		verified := claims.EmailVerified != nil && *claims.EmailVerified
+		link := store.LinkNever
+		if verified {
+			link = store.LinkAny
+		}
+		policy := current().Policy
+		create := policy.Mode == regOpen || (policy.Mode == regDomain && verified && policy.domainAllowed(email))
+		u, created, err := users.External(email, "oidc", claims.Subject, create, link)
+		if err != nil {
+			switch err {
+			case store.ErrUserNotFound:
+				ssoFail(w, r, "there is no chatlocal account for "+email+"; ask an administrator")
+			case store.ErrNotLinked:
+				ssoFail(w, r, "an account for "+email+" already exists, but the identity provider did not confirm that this email address is yours")
+			case store.ErrIdentityMismatch:
+				ssoFail(w, r, "this account is linked to a different identity")
+			default:
+				slog.ErrorContext(r.Context(), "oidc provision", "err", err)
+				ssoFail(w, r, "internal error")
+			}
+			return
+		}
+		if created {
+			slog.InfoContext(r.Context(), "oidc created user", "email", email)
+		}
+		if users.IsDisabled(u.ID) {
+			ssoFail(w, r, "account disabled")
+			return
+		}
+		if users.HasTOTP(u.ID) {
+			token, err := pending.Create(u.ID)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "pending login", "err", err)
+				ssoFail(w, r, "internal error")
+				return
+			}
+			// In the fragment, so that it stays out of logs and Referer headers.
+			http.Redirect(w, r, "/login#pending="+token, http.StatusFound)
+			return
+		}
+		if !startSession(w, r, sessions, u.ID) {
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
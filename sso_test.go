@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/oidc"
+	"github.com/agerasimovski/chatlocal/oidc/oidctest"
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+// useSettings makes the flag defaults, changed by overrides, the current
+// settings for the rest of the test.
+func useSettings(t *testing.T, overrides map[string]string) {
+	t.Helper()
+	s, err := newSettings(func(name string) string {
+		if v, ok := overrides[name]; ok {
+			return v
+		}
+		return flag.Lookup(name).DefValue
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := live.Swap(s)
+	t.Cleanup(func() { live.Store(old) })
+}
+
+type ssoTest struct {
+	issuer   *oidctest.Issuer
+	provider *oidc.Provider
+	logins   *oidcLogins
+	users    *store.UserStore
+	sessions *store.SessionStore
+	pending  *store.PendingLogins
+}
+
+func newSSOTest(t *testing.T) *ssoTest {
+	t.Helper()
+	is := oidctest.NewIssuer()
+	t.Cleanup(is.Close)
+	dir := t.TempDir()
+	users, err := store.NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := store.NewSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ssoTest{
+		issuer: is,
+		provider: oidc.NewProvider(oidc.Config{
+			Issuer:      is.URL,
+			ClientID:    "chatlocal",
+			RedirectURL: "https://chat.example/login/oidc/callback",
+		}),
+		logins:   &oidcLogins{pending: make(map[string]oidcPending)},
+		users:    users,
+		sessions: sessions,
+		pending:  store.NewPendingLogins(),
+	}
+}
+
+// login runs a single sign-on through the provider, which asserts claims,
+// and returns the callback's response.
+func (st *ssoTest) login(t *testing.T, claims map[string]any) *http.Response {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	oidcLoginHandler(st.provider, st.logins)(rec, httptest.NewRequest(http.MethodGet, "/login/oidc", nil))
+	authURL := rec.Header().Get("Location")
+	code, err := st.issuer.Authorize(authURL, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := url.Values{"code": {code}, "state": {u.Query().Get("state")}}
+	req := httptest.NewRequest(http.MethodGet, "/login/oidc/callback?"+q.Encode(), nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	oidcCallbackHandler(st.provider, st.logins, st.users, st.sessions, st.pending)(rec, req)
+	return rec.Result()
+}
+
+func sessionCookie(resp *http.Response) string {
+	for _, c := range resp.Cookies() {
+		if c.Name == store.SessionCookieName {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func TestSSOLinksOnlyVerifiedEmail(t *testing.T) {
+	useSettings(t, nil)
+	st := newSSOTest(t)
+	if _, err := st.users.Register("alice@example.com", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	for _, verified := range []any{nil, false} {
+		resp := st.login(t, map[string]any{"email": "alice@example.com", "email_verified": verified})
+		if loc := resp.Header.Get("Location"); !strings.HasPrefix(loc, "/login?error=") || sessionCookie(resp) != "" {
+			t.Errorf("email_verified %v: redirected to %q, want an error", verified, loc)
+		}
+		if u := st.users.ByUsername("alice@example.com"); u.ExternalID != "" {
+			t.Errorf("email_verified %v: account linked to %s", verified, u.ExternalID)
+		}
+	}
+
+	resp := st.login(t, map[string]any{"email": "alice@example.com", "email_verified": true})
+	if loc := resp.Header.Get("Location"); loc != "/" || sessionCookie(resp) == "" {
+		t.Fatalf("verified email: redirected to %q, want a session", loc)
+	}
+	if u := st.users.ByUsername("alice@example.com"); u.Source != "oidc" || u.ExternalID != "subject-1" {
+		t.Errorf("account not linked: source %q, id %q", u.Source, u.ExternalID)
+	}
+	// Once linked, the identity signs in even without the claim.
+	resp = st.login(t, map[string]any{"email": "alice@example.com"})
+	if loc := resp.Header.Get("Location"); loc != "/" {
+		t.Errorf("linked identity: redirected to %q", loc)
+	}
+}
+
+func TestSSODomainRegistrationNeedsVerifiedEmail(t *testing.T) {
+	useSettings(t, map[string]string{"registration": "domain", "allowed-domains": "example.com"})
+	st := newSSOTest(t)
+	resp := st.login(t, map[string]any{"email": "bob@example.com"})
+	if sessionCookie(resp) != "" || st.users.ByUsername("bob@example.com") != nil {
+		t.Fatal("account created for an unverified address")
+	}
+	resp = st.login(t, map[string]any{"email": "bob@example.com", "email_verified": true})
+	if sessionCookie(resp) == "" || st.users.ByUsername("bob@example.com") == nil {
+		t.Fatalf("no account for a verified address: redirected to %q", resp.Header.Get("Location"))
+	}
+}
+
+func TestSSORequiresLocalSecondFactor(t *testing.T) {
+	useSettings(t, nil)
+	st := newSSOTest(t)
+	u, err := st.users.Register("carol@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := st.users.BeginTOTP(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, err := st.users.ConfirmTOTP(u.ID, totp(t, secret, now.Add(-30*time.Second))); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := st.login(t, map[string]any{"email": "carol@example.com", "email_verified": true})
+	loc := resp.Header.Get("Location")
+	token, ok := strings.CutPrefix(loc, "/login#pending=")
+	if !ok || sessionCookie(resp) != "" {
+		t.Fatalf("redirected to %q with session %q, want a pending login", loc, sessionCookie(resp))
+	}
+
+	finish := login2FAHandler(st.users, st.sessions, st.pending, store.NewLoginThrottle())
+	body := fmt.Sprintf(`{"pendingToken":%q,"code":"000000"}`, token)
+	rec := httptest.NewRecorder()
+	finish(rec, httptest.NewRequest(http.MethodPost, "/login/2fa", bytes.NewBufferString(body)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong code: status %d", rec.Code)
+	}
+	body = fmt.Sprintf(`{"pendingToken":%q,"code":%q}`, token, totp(t, secret, now))
+	rec = httptest.NewRecorder()
+	finish(rec, httptest.NewRequest(http.MethodPost, "/login/2fa", bytes.NewBufferString(body)))
+	if rec.Code != http.StatusOK || sessionCookie(rec.Result()) == "" {
+		t.Fatalf("right code: status %d", rec.Code)
+	}
+}
+
+// totp computes the RFC 6238 code for secret at t.
+func totp(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", binary.BigEndian.Uint32(sum[off:off+4])&0x7fffffff%1000000)
+}
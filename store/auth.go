@@ -3,11 +3,34 @@ package store
 import (
 	"context"
 	"net/http"
+	"strings"
 )
 
 type contextKey string
 
-const userIDKey contextKey = "userID"
+const (
+	userIDKey  contextKey = "userID"
+	tokenKey   contextKey = "token"
+	requestKey contextKey = "request"
+)
+
+// RequestInfo identifies the request being served in logs. Middleware
+// further down the chain fills in what it learns, such as the user, so
+// that the access log written after the request sees it too.
+type RequestInfo struct {
+	ID     string
+	UserID string
+}
+
+func ContextWithRequest(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestKey, info)
+}
+
+// RequestFromContext returns the request info put into ctx, or nil.
+func RequestFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestKey).(*RequestInfo)
+	return info
+}
 
 func UserIDFromContext(ctx context.Context) string {
 	id, _ := ctx.Value(userIDKey).(string)
@@ -15,15 +38,73 @@ func UserIDFromContext(ctx context.Context) string {
 }
 
 func ContextWithUserID(ctx context.Context, userID string) context.Context {
+	if info := RequestFromContext(ctx); info != nil {
+		info.UserID = userID
+	}
 	return context.WithValue(ctx, userIDKey, userID)
 }
 
-func RequireAuth(users *UserStore, sessions *SessionStore, h http.HandlerFunc) http.HandlerFunc {
+// TokenFromContext returns the API token the request was authenticated
+// with, or nil for cookie sessions.
+func TokenFromContext(ctx context.Context) *APIToken {
+	t, _ := ctx.Value(tokenKey).(*APIToken)
+	return t
+}
+
+// tokenScope returns the scope an API token needs for r, or "" when the
+// endpoint is only available to browser sessions.
+func tokenScope(r *http.Request) string {
+	p := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case p == "/prompt":
+		return ScopePrompt
+	case (p == "/me" || p == "/account/usage" || p == "/account/usage/report") && r.Method == http.MethodGet:
+		return ScopeRead
+	case p == "/chats" || strings.HasPrefix(p, "/chats/"):
+		if r.Method == http.MethodGet {
+			return ScopeRead
+		}
+		return ScopeWrite
+	}
+	return ""
+}
+
+// bearerAuth authenticates a request carrying "Authorization: Bearer".
+func bearerAuth(users *UserStore, tokens *TokenStore, h http.HandlerFunc, w http.ResponseWriter, r *http.Request, secret string) {
+	t, ok := tokens.Lookup(secret)
+	if !ok || users.IsDisabled(t.UserID) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	scope := tokenScope(r)
+	if scope == "" || !t.HasScope(scope) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+		http.Error(w, "token does not allow this request", http.StatusForbidden)
+		return
+	}
+	ctx := ContextWithUserID(r.Context(), t.UserID)
+	ctx = context.WithValue(ctx, tokenKey, t)
+	h.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// RequireAuth lets requests through that carry a valid session cookie or
+// API bearer token, and puts the user ID into the request context.
+func RequireAuth(users *UserStore, sessions *SessionStore, tokens *TokenStore, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/login" || r.URL.Path == "/register" {
 			h.ServeHTTP(w, r)
 			return
 		}
+		if authz := r.Header.Get("Authorization"); authz != "" {
+			scheme, secret, _ := strings.Cut(authz, " ")
+			if !strings.EqualFold(scheme, "Bearer") || tokens == nil {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			bearerAuth(users, tokens, h, w, r, strings.TrimSpace(secret))
+			return
+		}
 		cookie, err := r.Cookie(SessionCookieName)
 		if err != nil || cookie == nil || cookie.Value == "" {
 			if isAPI(r) {
@@ -34,7 +115,7 @@ func RequireAuth(users *UserStore, sessions *SessionStore, h http.HandlerFunc) h
 			return
 		}
 		userID, ok := sessions.Get(cookie.Value)
-		if !ok || users.ByID(userID) == nil {
+		if !ok || users.IsDisabled(userID) {
 			if isAPI(r) {
 				http.Error(w, "unauthorized", http.StatusUnauthorized)
 				return
@@ -47,8 +128,22 @@ func RequireAuth(users *UserStore, sessions *SessionStore, h http.HandlerFunc) h
 	}
 }
 
+// RequireAdmin is RequireAuth that additionally rejects users without the admin role.
+func RequireAdmin(users *UserStore, sessions *SessionStore, h http.HandlerFunc) http.HandlerFunc {
+	return RequireAuth(users, sessions, nil, func(w http.ResponseWriter, r *http.Request) {
+		u := users.ByID(UserIDFromContext(r.Context()))
+		if u == nil || !u.IsAdmin() {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func isAPI(r *http.Request) bool {
 	return r.URL.Path == "/prompt" || r.URL.Path == "/chats" ||
 		(len(r.URL.Path) > 6 && r.URL.Path[:6] == "/chats/") ||
-		r.URL.Path == "/me"
+		r.URL.Path == "/me" || r.URL.Path == "/account" ||
+		strings.HasPrefix(r.URL.Path, "/account/") ||
+		strings.HasPrefix(r.URL.Path, "/admin/")
 }
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBearerScopes(t *testing.T) {
+	dir := t.TempDir()
+	users, err := NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := NewSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := NewTokenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := users.Register("alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets := map[string]string{}
+	for _, scope := range []string{ScopeRead, ScopeWrite, ScopePrompt} {
+		_, secret, err := tokens.Create(u.ID, scope, []string{scope}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secrets[scope] = secret
+	}
+	h := RequireAuth(users, sessions, tokens, func(w http.ResponseWriter, r *http.Request) {
+		if UserIDFromContext(r.Context()) != u.ID || TokenFromContext(r.Context()) == nil {
+			t.Errorf("%s %s: token or user missing from the context", r.Method, r.URL.Path)
+		}
+	})
+
+	for _, tc := range []struct {
+		method, path string
+		scope        string // the one scope that is let through, "" for none
+	}{
+		{http.MethodGet, "/me", ScopeRead},
+		{http.MethodGet, "/account/usage", ScopeRead},
+		{http.MethodGet, "/account/usage/report", ScopeRead},
+		{http.MethodGet, "/chats", ScopeRead},
+		{http.MethodGet, "/chats/abc", ScopeRead},
+		{http.MethodGet, "/chats/abc/stream", ScopeRead},
+		{http.MethodPost, "/chats", ScopeWrite},
+		{http.MethodDelete, "/chats/abc", ScopeWrite},
+		{http.MethodPost, "/prompt", ScopePrompt},
+		{http.MethodDelete, "/account", ""},
+		{http.MethodPost, "/account/password", ""},
+		{http.MethodGet, "/account/tokens", ""},
+		{http.MethodPost, "/account/tokens", ""},
+		{http.MethodPost, "/account/2fa/disable", ""},
+		{http.MethodGet, "/admin/users", ""},
+	} {
+		for scope, secret := range secrets {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req.Header.Set("Authorization", "Bearer "+secret)
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			want := http.StatusForbidden
+			if scope == tc.scope {
+				want = http.StatusOK
+			}
+			if rec.Code != want {
+				t.Errorf("%s %s with a %s token: status %d, want %d", tc.method, tc.path, scope, rec.Code, want)
+			}
+			if want == http.StatusForbidden && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s %s with a %s token: no WWW-Authenticate header", tc.method, tc.path, scope)
+			}
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Set("Authorization", "Bearer cl_unknown")
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unknown token: status %d", rec.Code)
+	}
+	if err := users.SetDisabled(u.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+secrets[ScopeRead])
+	rec = httptest.NewRecorder()
+	h(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("token of a disabled user: status %d", rec.Code)
+	}
+}
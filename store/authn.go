@@ -0,0 +1,33 @@
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+// Authenticator checks a username and password and returns the local user
+// they belong to. An authenticator that does not know the user, or cannot
+// reach its backend, returns ErrUserNotFound or ErrUnavailable so the next
+// one in a Chain gets a chance. ctx carries the request for logging.
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (*User, error)
+}
+
+// Authenticate implements Authenticator with the local bcrypt passwords.
+func (s *UserStore) Authenticate(_ context.Context, username, password string) (*User, error) {
+	return s.Login(username, password)
+}
+
+// Chain tries each authenticator in order.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(ctx context.Context, username, password string) (*User, error) {
+	for _, a := range c {
+		u, err := a.Authenticate(ctx, username, password)
+		if errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrUnavailable) {
+			continue
+		}
+		return u, err
+	}
+	return nil, ErrInvalidCredentials
+}
@@ -1,11 +1,14 @@
 package store
 
 import (
+	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/google/uuid"
@@ -18,10 +21,20 @@ type ChatMessage struct {
 	Text   string `json:"text"`
 	Type   string `json:"type"`
 	Time   string `json:"time"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"` // why a failed answer failed, for the user
 }
 
+// Status values of an assistant message that did not complete normally.
+const (
+	StatusFailed      = "failed"      // the backend produced no answer
+	StatusIncomplete  = "incomplete"  // the stream broke off part way
+	StatusInterrupted = "interrupted" // cut short by a server shutdown
+)
+
 type ChatStore struct {
-	dir string
+	dir   string
+	files *files
 }
 
 func NewChatStore(dataDir string) (*ChatStore, error) {
@@ -29,7 +42,7 @@ func NewChatStore(dataDir string) (*ChatStore, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
-	return &ChatStore{dir: dir}, nil
+	return &ChatStore{dir: dir, files: filesFor(dataDir)}, nil
 }
 
 func (c *ChatStore) userDir(userID string) string {
@@ -64,6 +77,7 @@ func truncateTitle(s string, max int) string {
 }
 
 func (c *ChatStore) Create(userID string) (chatID string, err error) {
+	defer observe("chats", "create", time.Now())
 	chatID = uuid.New().String()
 	dir := c.userDir(userID)
 	if err := os.MkdirAll(dir, 0700); err != nil {
@@ -74,22 +88,63 @@ func (c *ChatStore) Create(userID string) (chatID string, err error) {
 	return chatID, c.writeMessages(p, empty)
 }
 
+// Import stores msgs as a new chat of userID with the given title and
+// returns its ID.
+func (c *ChatStore) Import(userID, title string, msgs []ChatMessage) (string, error) {
+	chatID := uuid.New().String()
+	if err := os.MkdirAll(c.userDir(userID), 0700); err != nil {
+		return "", err
+	}
+	if msgs == nil {
+		msgs = []ChatMessage{}
+	}
+	if err := c.writeMessages(c.chatPath(userID, chatID), msgs); err != nil {
+		return "", err
+	}
+	if title = strings.TrimSpace(title); title != "" {
+		if err := c.writeMeta(userID, chatID, ChatMeta{Title: title}); err != nil {
+			return "", err
+		}
+	}
+	return chatID, nil
+}
+
+// RestoreFile puts a chat file of userID from a backup back in place and
+// reports whether it did; a file that exists is left alone. name is the
+// file name in the user's chat directory: {chatID}.json.gz or
+// {chatID}.meta.json.
+func (c *ChatStore) RestoreFile(userID, name string, data []byte) (bool, error) {
+	chatID, ok := strings.CutSuffix(name, ".json.gz")
+	if !ok {
+		chatID, ok = strings.CutSuffix(name, ".meta.json")
+	}
+	if _, err := uuid.Parse(chatID); !ok || err != nil {
+		return false, fmt.Errorf("not a chat file: %q", name)
+	}
+	p := filepath.Join(c.userDir(userID), name)
+	if _, err := os.Stat(p); err == nil {
+		return false, nil
+	}
+	if err := os.MkdirAll(c.userDir(userID), 0700); err != nil {
+		return false, err
+	}
+	return true, c.files.write(p, data)
+}
+
 func (c *ChatStore) writeMessages(path string, msgs []ChatMessage) error {
 	data, err := json.Marshal(msgs)
 	if err != nil {
 		return err
 	}
-	f, err := os.Create(path)
-	if err != nil {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
 		return err
 	}
-	defer f.Close()
-	gz := gzip.NewWriter(f)
-	_, err = gz.Write(data)
-	if err != nil {
+	if err := gz.Close(); err != nil {
 		return err
 	}
-	return gz.Close()
+	return c.files.write(path, buf.Bytes())
 }
 
 func (c *ChatStore) readMessages(path string) ([]ChatMessage, error) {
@@ -131,7 +186,7 @@ func (c *ChatStore) writeMeta(userID, chatID string, m ChatMeta) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(c.metaPath(userID, chatID), data, 0600)
+	return c.files.write(c.metaPath(userID, chatID), data)
 }
 
 func (c *ChatStore) List(userID string) ([]string, error) {
@@ -147,6 +202,7 @@ func (c *ChatStore) List(userID string) ([]string, error) {
 }
 
 func (c *ChatStore) ListWithTitles(userID string) ([]ChatInfo, error) {
+	defer observe("chats", "list", time.Now())
 	dir := c.userDir(userID)
 	entries, err := os.ReadDir(dir)
 	if err != nil {
@@ -178,11 +234,13 @@ func (c *ChatStore) ListWithTitles(userID string) ([]ChatInfo, error) {
 }
 
 func (c *ChatStore) Get(userID, chatID string) ([]ChatMessage, error) {
+	defer observe("chats", "get", time.Now())
 	p := c.chatPath(userID, chatID)
 	return c.readMessages(p)
 }
 
 func (c *ChatStore) Append(userID, chatID string, msgs ...ChatMessage) error {
+	defer observe("chats", "append", time.Now())
 	p := c.chatPath(userID, chatID)
 	existing, err := c.readMessages(p)
 	if err != nil && !os.IsNotExist(err) {
@@ -205,10 +263,94 @@ func (c *ChatStore) Append(userID, chatID string, msgs ...ChatMessage) error {
 	return c.writeMessages(p, existing)
 }
 
+// TakeRetry prepares the last prompt of a chat to be answered again. It
+// removes a trailing failed, incomplete or interrupted answer and returns
+// the prompt text; a prompt with no answer at all is returned as is.
+func (c *ChatStore) TakeRetry(userID, chatID string) (string, error) {
+	defer observe("chats", "take_retry", time.Now())
+	p := c.chatPath(userID, chatID)
+	msgs, err := c.readMessages(p)
+	if err != nil {
+		return "", err
+	}
+	n := len(msgs)
+	if n > 0 && msgs[n-1].Type != "sent" && msgs[n-1].Status != "" {
+		n--
+	}
+	if n == 0 || msgs[n-1].Type != "sent" {
+		return "", ErrNothingToRetry
+	}
+	if n < len(msgs) {
+		if err := c.writeMessages(p, msgs[:n]); err != nil {
+			return "", err
+		}
+	}
+	return msgs[n-1].Text, nil
+}
+
 func (c *ChatStore) Delete(userID, chatID string) error {
+	defer observe("chats", "delete", time.Now())
 	chatFile := c.chatPath(userID, chatID)
 	metaFile := c.metaPath(userID, chatID)
-	err := os.Remove(chatFile)
-	_ = os.Remove(metaFile) // best-effort
+	err := c.files.remove(chatFile)
+	_ = c.files.remove(metaFile) // best-effort
 	return err
 }
+
+// DeleteUser removes all chats of userID and returns how many were removed.
+func (c *ChatStore) DeleteUser(userID string) (int, error) {
+	ids, err := c.List(userID)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.files.change(func() error { return os.RemoveAll(c.userDir(userID)) }); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// ArchiveUser moves the chats of userID into archiveDir/{userID}-{timestamp}
+// and returns how many chats were moved and where.
+func (c *ChatStore) ArchiveUser(userID, archiveDir string) (n int, dest string, err error) {
+	ids, err := c.List(userID)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(ids) == 0 {
+		_ = c.files.change(func() error { return os.RemoveAll(c.userDir(userID)) })
+		return 0, "", nil
+	}
+	if err := os.MkdirAll(archiveDir, 0700); err != nil {
+		return 0, "", err
+	}
+	dest = filepath.Join(archiveDir, userID+"-"+time.Now().Format("20060102-150405"))
+	if err := c.files.change(func() error { return os.Rename(c.userDir(userID), dest) }); err != nil {
+		return 0, "", err
+	}
+	return len(ids), dest, nil
+}
+
+// Usage returns the number of chats and bytes on disk used by userID.
+func (c *ChatStore) Usage(userID string) (chats int, bytes int64, err error) {
+	entries, err := os.ReadDir(c.userDir(userID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		bytes += info.Size()
+		if strings.HasSuffix(e.Name(), ".json.gz") {
+			chats++
+		}
+	}
+	return chats, bytes, nil
+}
@@ -5,4 +5,16 @@ import "errors"
 var (
 	ErrInvalidCredentials = errors.New("invalid credentials")
 	ErrUserExists         = errors.New("username already exists")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrInvalidToken       = errors.New("invalid or expired token")
+	ErrAccountDisabled    = errors.New("account disabled")
+	ErrInvalidRole        = errors.New("invalid role")
+	ErrInviteInvalid      = errors.New("invite code is invalid")
+	ErrInviteExpired      = errors.New("invite code has expired")
+	ErrInviteUsedUp       = errors.New("invite code has no uses left")
+	ErrInvalidCode        = errors.New("invalid verification code")
+	ErrIdentityMismatch   = errors.New("account is linked to a different identity")
+	ErrNotLinked          = errors.New("account is not linked to this identity")
+	ErrUnavailable        = errors.New("authentication backend unavailable")
+	ErrNothingToRetry     = errors.New("the last answer in this chat did not fail")
 )
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SnapshotLockFile is the name of the lock file in the data directory that
+// lets a snapshot pause writes, even those of another process.
+const SnapshotLockFile = "chatlocal.snapshot.lock"
+
+// files makes the changes to a data directory. Every file is replaced in
+// one step, by writing a temporary file and renaming it, so readers and
+// snapshots never see half of a write. Changes hold the snapshot lock
+// shared, so a snapshot can wait for them to finish and hold off new ones.
+type files struct {
+	path string // of the snapshot lock file
+	mu   sync.Mutex
+	n    int // changes in progress
+	f    *os.File
+}
+
+var filesByDir sync.Map // cleaned data directory -> *files
+
+// filesFor returns the files of dataDir, shared by all its stores.
+func filesFor(dataDir string) *files {
+	dir := filepath.Clean(dataDir)
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	fs, _ := filesByDir.LoadOrStore(dir, &files{path: filepath.Join(dir, SnapshotLockFile)})
+	return fs.(*files)
+}
+
+// change runs fn while no snapshot is being taken. The lock file is locked
+// by the first of the changes running at once and unlocked by the last.
+func (fs *files) change(fn func() error) error {
+	fs.mu.Lock()
+	if fs.n == 0 {
+		if fs.f == nil {
+			f, err := os.OpenFile(fs.path, os.O_RDWR|os.O_CREATE, 0600)
+			if err != nil {
+				fs.mu.Unlock()
+				return err
+			}
+			fs.f = f
+		}
+		if err := lockShared(fs.f); err != nil {
+			fs.mu.Unlock()
+			return err
+		}
+	}
+	fs.n++
+	fs.mu.Unlock()
+
+	defer func() {
+		fs.mu.Lock()
+		if fs.n--; fs.n == 0 {
+			unlock(fs.f)
+		}
+		fs.mu.Unlock()
+	}()
+	return fn()
+}
+
+// write replaces the file at path with data.
+func (fs *files) write(path string, data []byte) error {
+	return fs.change(func() error { return writeAtomic(path, data) })
+}
+
+// remove removes the file at path.
+func (fs *files) remove(path string) error {
+	return fs.change(func() error { return os.Remove(path) })
+}
+
+// writeAtomic writes data to a temporary file next to path and renames it
+// over path.
+func writeAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Invite is a registration code created by an admin.
+type Invite struct {
+	Code      string    `json:"code"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+	MaxUses   int       `json:"maxUses"`
+	Uses      int       `json:"uses"`
+}
+
+type InviteStore struct {
+	dir   string
+	files *files
+	mu    sync.Mutex
+}
+
+func NewInviteStore(dataDir string) (*InviteStore, error) {
+	dir := filepath.Join(dataDir, "invites")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &InviteStore{dir: dir, files: filesFor(dataDir)}, nil
+}
+
+func (is *InviteStore) path(code string) string {
+	return filepath.Join(is.dir, code+".json")
+}
+
+func validInviteCode(code string) bool {
+	if code == "" {
+		return false
+	}
+	for _, r := range code {
+		if (r < 'A' || r > 'Z') && (r < '2' || r > '7') {
+			return false
+		}
+	}
+	return true
+}
+
+func (is *InviteStore) read(code string) (*Invite, error) {
+	data, err := os.ReadFile(is.path(code))
+	if err != nil {
+		return nil, err
+	}
+	var inv Invite
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (is *InviteStore) write(inv *Invite) error {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return is.files.write(is.path(inv.Code), data)
+}
+
+// Create makes a new invite usable maxUses times. A zero ttl never expires.
+func (is *InviteStore) Create(createdBy string, maxUses int, ttl time.Duration) (*Invite, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	inv := &Invite{
+		Code:      base32.StdEncoding.EncodeToString(b),
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		MaxUses:   maxUses,
+	}
+	if ttl > 0 {
+		inv.ExpiresAt = now.Add(ttl)
+	}
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if err := is.write(inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// Use checks the invite and counts one use of it.
+func (is *InviteStore) Use(code string) error {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if !validInviteCode(code) {
+		return ErrInviteInvalid
+	}
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	inv, err := is.read(code)
+	if err != nil {
+		return ErrInviteInvalid
+	}
+	if !inv.ExpiresAt.IsZero() && time.Now().After(inv.ExpiresAt) {
+		return ErrInviteExpired
+	}
+	if inv.Uses >= inv.MaxUses {
+		return ErrInviteUsedUp
+	}
+	inv.Uses++
+	return is.write(inv)
+}
+
+// Release gives back a use taken by Use, e.g. when registration failed afterwards.
+func (is *InviteStore) Release(code string) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if !validInviteCode(code) {
+		return
+	}
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	inv, err := is.read(code)
+	if err != nil || inv.Uses == 0 {
+		return
+	}
+	inv.Uses--
+	_ = is.write(inv)
+}
+
+// List returns all invites, newest first.
+func (is *InviteStore) List() ([]Invite, error) {
+	entries, err := os.ReadDir(is.dir)
+	if err != nil {
+		return nil, err
+	}
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	var result []Invite
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		inv, err := is.read(strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		result = append(result, *inv)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.After(result[j].CreatedAt) })
+	return result, nil
+}
+
+func (is *InviteStore) Delete(code string) error {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if !validInviteCode(code) {
+		return os.ErrNotExist
+	}
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	return is.files.remove(is.path(code))
+}
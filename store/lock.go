@@ -0,0 +1,65 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LockFile is the name of the lock file in the data directory.
+const LockFile = "chatlocal.lock"
+
+// DataLock is an exclusive lock on a data directory. The server holds it
+// while it runs, and so do commands that change what the server keeps in
+// memory, such as the user list.
+type DataLock struct {
+	f *os.File
+}
+
+// LockedError is returned by LockDataDir when another process holds the lock.
+type LockedError struct {
+	Holder string // e.g. "the server on localhost:8080 (pid 1234)"
+}
+
+func (e *LockedError) Error() string {
+	return "data directory in use by " + e.Holder
+}
+
+// LockDataDir takes the lock of dataDir for holder, a description such as
+// "the server on localhost:8080". It does not wait: if another process
+// holds the lock it returns a *LockedError. The lock also ends when the
+// process exits.
+func LockDataDir(dataDir, holder string) (*DataLock, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dataDir, LockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := tryLock(f)
+	if err != nil || !ok {
+		b, _ := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("lock data directory: %w", err)
+		}
+		h := strings.TrimSpace(string(b))
+		if h == "" {
+			h = "another process"
+		}
+		return nil, &LockedError{Holder: h}
+	}
+	// Only tells others who holds the lock, so errors do not matter.
+	_ = f.Truncate(0)
+	fmt.Fprintf(f, "%s (pid %d)\n", holder, os.Getpid())
+	return &DataLock{f: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *DataLock) Unlock() error {
+	_ = l.f.Truncate(0)
+	return l.f.Close()
+}
@@ -0,0 +1,16 @@
+package store
+
+import (
+	"time"
+
+	"github.com/agerasimovski/chatlocal/metrics"
+)
+
+var opDuration = metrics.NewHistogramVec("chatlocal_store_operation_duration_seconds",
+	"Latency of data directory operations by store and operation.", metrics.DefBuckets, "store", "op")
+
+// observe records how long an operation started at start took. Use it as
+// defer observe("chats", "get", time.Now()).
+func observe(store, op string, start time.Time) {
+	opDuration.With(store, op).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+const (
+	pendingLoginDuration = 5 * time.Minute
+	pendingLoginAttempts = 5
+)
+
+type pendingLogin struct {
+	userID    string
+	expiresAt time.Time
+	attempts  int
+}
+
+// PendingLogins holds logins that passed the password check and are waiting
+// for a second factor. They live in memory only; a restart simply means
+// logging in again.
+type PendingLogins struct {
+	mu      sync.Mutex
+	entries map[string]*pendingLogin
+}
+
+func NewPendingLogins() *PendingLogins {
+	return &PendingLogins{entries: make(map[string]*pendingLogin)}
+}
+
+func (p *PendingLogins) Create(userID string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, e := range p.entries {
+		if now.After(e.expiresAt) {
+			delete(p.entries, k)
+		}
+	}
+	p.entries[token] = &pendingLogin{userID: userID, expiresAt: now.Add(pendingLoginDuration)}
+	return token, nil
+}
+
+// Lookup returns the user waiting behind token.
+func (p *PendingLogins) Lookup(token string) (userID string, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.entries[token]
+	if e == nil {
+		return "", false
+	}
+	if time.Now().After(e.expiresAt) {
+		delete(p.entries, token)
+		return "", false
+	}
+	return e.userID, true
+}
+
+// Fail counts a wrong code and drops the pending login after too many.
+func (p *PendingLogins) Fail(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e := p.entries[token]; e != nil {
+		e.attempts++
+		if e.attempts >= pendingLoginAttempts {
+			delete(p.entries, token)
+		}
+	}
+}
+
+func (p *PendingLogins) Delete(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.entries, token)
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter allows each key at most Limit events in any Window.
+type RateLimiter struct {
+	Limit  int
+	Window time.Duration
+
+	mu     sync.Mutex
+	events map[string][]time.Time
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{Limit: limit, Window: window, events: make(map[string][]time.Time)}
+}
+
+// recent drops events of key older than the window and returns the rest.
+// rl.mu must be held.
+func (rl *RateLimiter) recent(key string, now time.Time) []time.Time {
+	ev := rl.events[key]
+	i := 0
+	for i < len(ev) && now.Sub(ev[i]) >= rl.Window {
+		i++
+	}
+	ev = ev[i:]
+	if len(ev) == 0 {
+		delete(rl.events, key)
+	} else {
+		rl.events[key] = ev
+	}
+	return ev
+}
+
+// SetLimit changes Limit. Events already recorded still count.
+func (rl *RateLimiter) SetLimit(limit int) {
+	rl.mu.Lock()
+	rl.Limit = limit
+	rl.mu.Unlock()
+}
+
+// Allow records an event for key if it is within the limit. Otherwise it
+// returns false and how long until the next event would be allowed.
+func (rl *RateLimiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.Limit <= 0 {
+		return true, 0
+	}
+	ev := rl.recent(key, now)
+	if len(ev) >= rl.Limit {
+		return false, ev[0].Add(rl.Window).Sub(now)
+	}
+	rl.events[key] = append(ev, now)
+	return true, 0
+}
+
+// Refund takes back the latest event of key, for a request that was
+// allowed but then not carried out.
+func (rl *RateLimiter) Refund(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if ev := rl.recent(key, time.Now()); len(ev) > 0 {
+		if len(ev) == 1 {
+			delete(rl.events, key)
+		} else {
+			rl.events[key] = ev[:len(ev)-1]
+		}
+	}
+}
+
+// Used returns how many events key had in the current window.
+func (rl *RateLimiter) Used(key string) int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.recent(key, time.Now()))
+}
@@ -0,0 +1,23 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefund(t *testing.T) {
+	rl := NewRateLimiter(2, time.Minute)
+	rl.Refund("k") // nothing to take back
+	for range 2 {
+		if ok, _ := rl.Allow("k"); !ok {
+			t.Fatal("not allowed")
+		}
+	}
+	if ok, _ := rl.Allow("k"); ok {
+		t.Fatal("allowed past the limit")
+	}
+	rl.Refund("k")
+	if ok, _ := rl.Allow("k"); !ok {
+		t.Error("not allowed after a refund")
+	}
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const ResetTokenDuration = time.Hour
+
+type resetEntry struct {
+	UserID    string    `json:"userId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ResetStore keeps single-use password reset tokens. Only a hash of each
+// token is written to disk, so the token itself must be handed to the user
+// out-of-band when it is issued.
+type ResetStore struct {
+	dir   string
+	files *files
+}
+
+func NewResetStore(dataDir string) (*ResetStore, error) {
+	dir := filepath.Join(dataDir, "resets")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &ResetStore{dir: dir, files: filesFor(dataDir)}, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (rs *ResetStore) path(token string) string {
+	return filepath.Join(rs.dir, hashToken(token)+".json")
+}
+
+// Issue creates a new reset token for userID that expires after ttl.
+func (rs *ResetStore) Issue(userID string, ttl time.Duration) (token string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	ent := resetEntry{
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	data, err := json.Marshal(ent)
+	if err != nil {
+		return "", err
+	}
+	if err := rs.files.write(rs.path(token), data); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Consume returns the user the token was issued for and invalidates it.
+func (rs *ResetStore) Consume(token string) (userID string, err error) {
+	if token == "" {
+		return "", ErrInvalidToken
+	}
+	p := rs.path(token)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	// Remove before checking anything else so a token can never be used twice.
+	if err := rs.files.remove(p); err != nil {
+		return "", ErrInvalidToken
+	}
+	var ent resetEntry
+	if err := json.Unmarshal(data, &ent); err != nil {
+		return "", ErrInvalidToken
+	}
+	if time.Now().After(ent.ExpiresAt) {
+		return "", ErrInvalidToken
+	}
+	return ent.UserID, nil
+}
+
+// DeleteForUser drops every outstanding reset token for userID.
+func (rs *ResetStore) DeleteForUser(userID string) (int, error) {
+	entries, err := os.ReadDir(rs.dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		p := filepath.Join(rs.dir, e.Name())
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var ent resetEntry
+		if err := json.Unmarshal(data, &ent); err != nil || ent.UserID != userID {
+			continue
+		}
+		if err := rs.files.remove(p); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,12 +16,14 @@ const sessionDuration = 24 * 7 * time.Hour
 
 type sessionEntry struct {
 	UserID    string    `json:"userId"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
 	ExpiresAt time.Time `json:"expiresAt"`
 }
 
 type SessionStore struct {
-	dir string
-	mu  sync.RWMutex
+	dir   string
+	files *files
+	mu    sync.RWMutex
 }
 
 func NewSessionStore(dataDir string) (*SessionStore, error) {
@@ -28,7 +31,7 @@ func NewSessionStore(dataDir string) (*SessionStore, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
-	return &SessionStore{dir: dir}, nil
+	return &SessionStore{dir: dir, files: filesFor(dataDir)}, nil
 }
 
 func (st *SessionStore) path(id string) string {
@@ -36,44 +39,93 @@ func (st *SessionStore) path(id string) string {
 }
 
 func (st *SessionStore) Create(userID string) (sessionID string, err error) {
+	defer observe("sessions", "create", time.Now())
 	id := uuid.New().String()
+	now := time.Now()
 	ent := sessionEntry{
 		UserID:    userID,
-		ExpiresAt: time.Now().Add(sessionDuration),
+		CreatedAt: now,
+		ExpiresAt: now.Add(sessionDuration),
 	}
 	data, err := json.Marshal(ent)
 	if err != nil {
 		return "", err
 	}
 	p := st.path(id)
-	if err := os.WriteFile(p, data, 0600); err != nil {
+	if err := st.files.write(p, data); err != nil {
 		return "", err
 	}
 	return id, nil
 }
 
 func (st *SessionStore) Get(sessionID string) (userID string, ok bool) {
+	defer observe("sessions", "get", time.Now())
+	ent, ok := st.read(sessionID)
+	return ent.UserID, ok
+}
+
+// SignedInAt returns when the user signed in to open the session. It is
+// zero for sessions created before this was recorded.
+func (st *SessionStore) SignedInAt(sessionID string) (t time.Time, ok bool) {
+	ent, ok := st.read(sessionID)
+	return ent.CreatedAt, ok
+}
+
+func (st *SessionStore) read(sessionID string) (ent sessionEntry, ok bool) {
 	if sessionID == "" {
-		return "", false
+		return ent, false
 	}
 	data, err := os.ReadFile(st.path(sessionID))
 	if err != nil {
-		return "", false
+		return ent, false
 	}
-	var ent sessionEntry
 	if err := json.Unmarshal(data, &ent); err != nil {
-		return "", false
+		return sessionEntry{}, false
 	}
 	if time.Now().After(ent.ExpiresAt) {
-		_ = os.Remove(st.path(sessionID))
-		return "", false
+		_ = st.files.remove(st.path(sessionID))
+		return sessionEntry{}, false
 	}
-	return ent.UserID, true
+	return ent, true
 }
 
 func (st *SessionStore) Delete(sessionID string) error {
 	if sessionID == "" {
 		return nil
 	}
-	return os.Remove(st.path(sessionID))
+	return st.files.remove(st.path(sessionID))
+}
+
+// DeleteForUser removes every session that belongs to userID and returns
+// how many were removed.
+func (st *SessionStore) DeleteForUser(userID string) (int, error) {
+	return st.DeleteForUserExcept(userID, "")
+}
+
+// DeleteForUserExcept is DeleteForUser that keeps the session keep, such as
+// the one the request came with.
+func (st *SessionStore) DeleteForUserExcept(userID, keep string) (int, error) {
+	entries, err := os.ReadDir(st.dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") || keep != "" && e.Name() == keep+".json" {
+			continue
+		}
+		p := filepath.Join(st.dir, e.Name())
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var ent sessionEntry
+		if err := json.Unmarshal(data, &ent); err != nil || ent.UserID != userID {
+			continue
+		}
+		if err := st.files.remove(p); err == nil {
+			n++
+		}
+	}
+	return n, nil
 }
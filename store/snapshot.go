@@ -0,0 +1,131 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const snapshotPrefix = ".snapshot-"
+
+// Snapshot takes a consistent copy of the files in dataDir while the
+// server keeps running. It waits up to wait for the writes in progress to
+// finish, holds off new ones while it hard-links every file for which keep
+// returns true into a new directory inside dataDir, and returns that
+// directory with the paths of the files relative to it. Since files are
+// only ever replaced, never changed in place, the links keep their content
+// as later writes happen. The caller removes the directory when done.
+//
+// Hidden files, such as temporary files, and the lock files are left out.
+// keep is also asked about directories, with a trailing slash.
+func Snapshot(dataDir string, keep func(rel string) bool, wait time.Duration) (dir string, paths []string, err error) {
+	removeStaleSnapshots(dataDir)
+	tmp, err := os.MkdirTemp(dataDir, snapshotPrefix+"*")
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmp)
+		}
+	}()
+
+	lf, err := os.OpenFile(filepath.Join(dataDir, SnapshotLockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return "", nil, err
+	}
+	defer lf.Close()
+	for deadline := time.Now().Add(wait); ; {
+		ok, err := tryLock(lf)
+		if err != nil {
+			return "", nil, err
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			return "", nil, fmt.Errorf("writes to %s did not pause within %s", dataDir, wait)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	defer unlock(lf)
+
+	err = filepath.WalkDir(dataDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed before the writes paused
+			}
+			return err
+		}
+		if p == dataDir {
+			return nil
+		}
+		rel, err := filepath.Rel(dataDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		name := d.Name()
+		if d.IsDir() {
+			if strings.HasPrefix(name, ".") || !keep(rel+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(name, ".") || rel == LockFile || rel == SnapshotLockFile || !d.Type().IsRegular() || !keep(rel) {
+			return nil
+		}
+		dst := filepath.Join(tmp, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return err
+		}
+		if err := os.Link(p, dst); err != nil {
+			// Some file systems have no hard links; copy, since writes are paused.
+			if err := copyFile(p, dst); err != nil {
+				return err
+			}
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return tmp, paths, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// removeStaleSnapshots removes snapshot directories left behind by
+// backups that did not finish, such as ones that were killed.
+func removeStaleSnapshots(dataDir string) {
+	entries, _ := os.ReadDir(dataDir)
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), snapshotPrefix) {
+			continue
+		}
+		if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > 24*time.Hour {
+			os.RemoveAll(filepath.Join(dataDir, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"users.json":                   "users",
+		"chats/u1/c1.json.gz":          "chat",
+		"chats/u1/.c1.json.gz.123.tmp": "half written",
+		"resets/r1.json":               "reset",
+		".cache/x":                     "hidden",
+		LockFile:                       "",
+		SnapshotLockFile:               "",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var asked []string
+	keep := func(rel string) bool {
+		asked = append(asked, rel)
+		return rel != "resets/"
+	}
+	snap, paths, err := Snapshot(dir, keep, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(snap)
+	if !strings.HasPrefix(filepath.Base(snap), snapshotPrefix) || filepath.Dir(snap) != dir {
+		t.Errorf("snapshot in %s", snap)
+	}
+	slices.Sort(paths)
+	if want := []string{"chats/u1/c1.json.gz", "users.json"}; !slices.Equal(paths, want) {
+		t.Errorf("paths %q, want %q", paths, want)
+	}
+	if !slices.Contains(asked, "resets/") || slices.Contains(asked, "resets/r1.json") {
+		t.Errorf("keep was asked about %q", asked)
+	}
+
+	// Later writes replace the file and leave the snapshot's copy alone.
+	if err := filesFor(dir).write(filepath.Join(dir, "users.json"), []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(snap, "users.json")); err != nil || string(b) != "users" {
+		t.Errorf("snapshot of users.json is %q, %v", b, err)
+	}
+}
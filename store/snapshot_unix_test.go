@@ -0,0 +1,49 @@
+//go:build unix
+
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotWaitsForWrites(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "users.json"), []byte("[]"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	started, release, done := make(chan struct{}), make(chan struct{}), make(chan error)
+	go func() {
+		done <- filesFor(dir).change(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	keep := func(string) bool { return true }
+	_, _, err := Snapshot(dir, keep, 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "did not pause") {
+		t.Errorf("snapshot during a write: %v", err)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*")); len(entries) != 0 {
+		t.Errorf("left behind %q", entries)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	snap, paths, err := Snapshot(dir, keep, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("snapshot after the write: %v", err)
+	}
+	defer os.RemoveAll(snap)
+	if len(paths) != 1 || paths[0] != "users.json" {
+		t.Errorf("paths %q", paths)
+	}
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// LoginThrottle tracks failed login attempts per key (username or client IP)
+// and locks a key out with exponential backoff once it has failed too often.
+type LoginThrottle struct {
+	FreeAttempts int           // failures allowed before lockouts start
+	BaseDelay    time.Duration // first lockout; doubles with every further failure
+	MaxDelay     time.Duration
+	Forget       time.Duration // failures older than this are forgotten
+
+	mu      sync.Mutex
+	entries map[string]*throttleEntry
+}
+
+type throttleEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func NewLoginThrottle() *LoginThrottle {
+	return &LoginThrottle{
+		FreeAttempts: 5,
+		BaseDelay:    time.Second,
+		MaxDelay:     15 * time.Minute,
+		Forget:       time.Hour,
+		entries:      make(map[string]*throttleEntry),
+	}
+}
+
+// Reserve returns how long the caller must wait before trying any of keys
+// again. If it returns 0, the attempt is already counted as a failure for
+// every key: checking and counting under one lock keeps concurrent
+// attempts from all getting past a nearly exhausted allowance while their
+// passwords are being checked. Call Succeed or Refund once the attempt
+// turns out not to have failed.
+func (t *LoginThrottle) Reserve(keys ...string) time.Duration {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var wait time.Duration
+	for _, k := range keys {
+		if e := t.entries[k]; e != nil && e.lockedUntil.After(now) {
+			if d := e.lockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	if len(t.entries) > 10000 {
+		t.prune(now)
+	}
+	for _, k := range keys {
+		e := t.entries[k]
+		if e == nil || now.Sub(e.lastFailure) > t.Forget {
+			e = &throttleEntry{}
+			t.entries[k] = e
+		}
+		e.failures++
+		e.lastFailure = now
+		e.lockedUntil = t.lockout(e)
+	}
+	return 0
+}
+
+// Refund takes back the failure Reserve counted for every key, for an
+// attempt that could not be judged, such as one that met a backend error.
+func (t *LoginThrottle) Refund(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, k := range keys {
+		e := t.entries[k]
+		if e == nil {
+			continue
+		}
+		if e.failures--; e.failures <= 0 {
+			delete(t.entries, k)
+			continue
+		}
+		e.lockedUntil = t.lockout(e)
+	}
+}
+
+// lockout returns when e's lockout ends, doubling the delay with every
+// failure past the free ones.
+func (t *LoginThrottle) lockout(e *throttleEntry) time.Time {
+	over := e.failures - t.FreeAttempts
+	if over <= 0 {
+		return time.Time{}
+	}
+	d := time.Duration(float64(t.BaseDelay) * math.Pow(2, float64(over-1)))
+	if d > t.MaxDelay || d <= 0 {
+		d = t.MaxDelay
+	}
+	return e.lastFailure.Add(d)
+}
+
+// Succeed clears the failure history of every key.
+func (t *LoginThrottle) Succeed(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, k := range keys {
+		delete(t.entries, k)
+	}
+}
+
+func (t *LoginThrottle) prune(now time.Time) {
+	for k, e := range t.entries {
+		if now.Sub(e.lastFailure) > t.Forget && !e.lockedUntil.After(now) {
+			delete(t.entries, k)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReserveCountsConcurrentAttempts(t *testing.T) {
+	th := NewLoginThrottle()
+	var passed atomic.Int32
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Go(func() {
+			if th.Reserve("user:a", "ip:1") == 0 {
+				passed.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	// The free attempts, and the one whose failure starts the lockout.
+	if n := passed.Load(); n != int32(th.FreeAttempts+1) {
+		t.Errorf("%d attempts got through, want %d", n, th.FreeAttempts+1)
+	}
+	if th.Reserve("ip:1") == 0 {
+		t.Error("the address is not locked out")
+	}
+	if th.Reserve("ip:2") != 0 {
+		t.Error("another address is locked out")
+	}
+}
+
+func TestRefundAndSucceed(t *testing.T) {
+	th := NewLoginThrottle()
+	th.BaseDelay = time.Hour
+	for range th.FreeAttempts + 1 {
+		if wait := th.Reserve("k"); wait != 0 {
+			t.Fatalf("locked out early, for %s", wait)
+		}
+	}
+	if th.Reserve("k") == 0 {
+		t.Fatal("not locked out")
+	}
+	th.Refund("k")
+	if wait := th.Reserve("k"); wait != 0 {
+		t.Fatalf("still locked out after a refund, for %s", wait)
+	}
+	th.Succeed("k")
+	th.Refund("k") // nothing left to refund
+	for range th.FreeAttempts {
+		if th.Reserve("k") != 0 {
+			t.Fatal("failures survived Succeed")
+		}
+	}
+}
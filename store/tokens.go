@@ -0,0 +1,206 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// API token scopes.
+const (
+	ScopeRead   = "read"   // GET /me, /chats, /chats/{id}
+	ScopeWrite  = "write"  // create and delete chats
+	ScopePrompt = "prompt" // POST /prompt
+)
+
+const (
+	tokenPrefix      = "cl_"
+	tokenUseInterval = time.Minute // how often LastUsedAt is written back
+)
+
+// APIToken is a personal access token. Only a hash of the secret is stored.
+type APIToken struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"userId"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt,omitzero"`
+	LastUsedAt time.Time `json:"lastUsedAt,omitzero"`
+}
+
+// HasScope reports whether the token grants scope.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func ValidScope(s string) bool {
+	return s == ScopeRead || s == ScopeWrite || s == ScopePrompt
+}
+
+type TokenStore struct {
+	dir   string
+	files *files
+	mu    sync.Mutex
+}
+
+func NewTokenStore(dataDir string) (*TokenStore, error) {
+	dir := filepath.Join(dataDir, "tokens")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &TokenStore{dir: dir, files: filesFor(dataDir)}, nil
+}
+
+func (ts *TokenStore) path(secret string) string {
+	return filepath.Join(ts.dir, hashToken(secret)+".json")
+}
+
+func (ts *TokenStore) write(p string, t *APIToken) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return ts.files.write(p, data)
+}
+
+// Create issues a new token and returns it with the secret, which cannot be
+// recovered later. A zero ttl never expires.
+func (ts *TokenStore) Create(userID, name string, scopes []string, ttl time.Duration) (*APIToken, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	t := &APIToken{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: now,
+	}
+	if ttl > 0 {
+		t.ExpiresAt = now.Add(ttl)
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.write(ts.path(secret), t); err != nil {
+		return nil, "", err
+	}
+	return t, secret, nil
+}
+
+// Lookup returns the token for secret if it exists and has not expired,
+// and records the use.
+func (ts *TokenStore) Lookup(secret string) (*APIToken, bool) {
+	defer observe("tokens", "lookup", time.Now())
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, false
+	}
+	p := ts.path(secret)
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	var t APIToken
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	if !t.ExpiresAt.IsZero() && now.After(t.ExpiresAt) {
+		return nil, false
+	}
+	if now.Sub(t.LastUsedAt) >= tokenUseInterval {
+		t.LastUsedAt = now
+		_ = ts.write(p, &t)
+	}
+	return &t, true
+}
+
+// each calls fn with every stored token and the file it lives in.
+func (ts *TokenStore) each(fn func(p string, t *APIToken)) error {
+	entries, err := os.ReadDir(ts.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		p := filepath.Join(ts.dir, e.Name())
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var t APIToken
+		if err := json.Unmarshal(data, &t); err != nil {
+			continue
+		}
+		fn(p, &t)
+	}
+	return nil
+}
+
+// List returns the user's tokens, newest first.
+func (ts *TokenStore) List(userID string) ([]APIToken, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	result := []APIToken{}
+	err := ts.each(func(_ string, t *APIToken) {
+		if t.UserID == userID {
+			result = append(result, *t)
+		}
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.After(result[j].CreatedAt) })
+	return result, err
+}
+
+// Revoke deletes the user's token with the given ID.
+func (ts *TokenStore) Revoke(userID, id string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	found := false
+	err := ts.each(func(p string, t *APIToken) {
+		if t.UserID == userID && t.ID == id {
+			if ts.files.remove(p) == nil {
+				found = true
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// DeleteForUser revokes every token of userID and returns how many there were.
+func (ts *TokenStore) DeleteForUser(userID string) (int, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	n := 0
+	err := ts.each(func(p string, t *APIToken) {
+		if t.UserID == userID && ts.files.remove(p) == nil {
+			n++
+		}
+	})
+	return n, err
+}
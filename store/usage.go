@@ -0,0 +1,237 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage counts generations, the tokens they used and how long they took.
+// Durations are as reported by Ollama.
+type Usage struct {
+	Requests         int           `json:"requests"`
+	PromptTokens     int           `json:"promptTokens"`
+	CompletionTokens int           `json:"completionTokens"`
+	TotalDuration    time.Duration `json:"totalDuration,omitempty"`
+	LoadDuration     time.Duration `json:"loadDuration,omitempty"`
+	EvalDuration     time.Duration `json:"evalDuration,omitempty"`
+}
+
+// Tokens returns prompt and completion tokens together.
+func (u Usage) Tokens() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// EvalRate returns completion tokens generated per second.
+func (u Usage) EvalRate() float64 {
+	if u.EvalDuration <= 0 {
+		return 0
+	}
+	return float64(u.CompletionTokens) / u.EvalDuration.Seconds()
+}
+
+func (u *Usage) add(o Usage) {
+	u.Requests += o.Requests
+	u.PromptTokens += o.PromptTokens
+	u.CompletionTokens += o.CompletionTokens
+	u.TotalDuration += o.TotalDuration
+	u.LoadDuration += o.LoadDuration
+	u.EvalDuration += o.EvalDuration
+}
+
+// unknownModel is the model recorded for usage that names none.
+const unknownModel = "unknown"
+
+type usageFile struct {
+	Models map[string]map[string]*Usage `json:"models"` // model -> YYYY-MM-DD -> usage
+}
+
+// UsageStore keeps per-user usage totals by model and day, one JSON file
+// per user. Days are in server local time.
+type UsageStore struct {
+	dir   string
+	files *files
+	mu    sync.Mutex
+}
+
+func NewUsageStore(dataDir string) (*UsageStore, error) {
+	dir := filepath.Join(dataDir, "usage")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &UsageStore{dir: dir, files: filesFor(dataDir)}, nil
+}
+
+// DayKey is the key under which usage at t is recorded.
+func DayKey(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+func (s *UsageStore) path(userID string) string {
+	return filepath.Join(s.dir, userID+".json")
+}
+
+func (s *UsageStore) load(userID string) (*usageFile, error) {
+	f := &usageFile{Models: make(map[string]map[string]*Usage)}
+	data, err := os.ReadFile(s.path(userID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, err
+	}
+	if f.Models == nil {
+		f.Models = make(map[string]map[string]*Usage)
+	}
+	return f, nil
+}
+
+// Record adds u to the usage of userID for model on the day of t.
+func (s *UsageStore) Record(userID, model string, t time.Time, u Usage) error {
+	defer observe("usage", "record", time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := s.load(userID)
+	if err != nil {
+		return err
+	}
+	if model == "" {
+		model = unknownModel
+	}
+	days := f.Models[model]
+	if days == nil {
+		days = make(map[string]*Usage)
+		f.Models[model] = days
+	}
+	day := DayKey(t)
+	if days[day] == nil {
+		days[day] = &Usage{}
+	}
+	days[day].add(u)
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return s.files.write(s.path(userID), data)
+}
+
+// Sum returns the usage of userID across all models on the days whose key
+// starts with prefix: a day ("2006-01-02"), a month ("2006-01") or
+// everything ("").
+func (s *UsageStore) Sum(userID, prefix string) (Usage, error) {
+	defer observe("usage", "sum", time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total Usage
+	f, err := s.load(userID)
+	if err != nil {
+		return total, err
+	}
+	for _, days := range f.Models {
+		for day, u := range days {
+			if strings.HasPrefix(day, prefix) {
+				total.add(*u)
+			}
+		}
+	}
+	return total, nil
+}
+
+// UsageRow is one line of a usage report. Fields that were not grouped
+// on are empty.
+type UsageRow struct {
+	UserID string `json:"userId,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Day    string `json:"day,omitempty"`
+	Usage
+}
+
+// UsageGroup selects the keys a report is broken down by.
+type UsageGroup struct {
+	User, Model, Day bool
+}
+
+// Report aggregates usage between the days from and to, inclusive, for
+// userID or for everyone when userID is empty. Rows are sorted by day,
+// user and model.
+func (s *UsageStore) Report(userID, from, to string, group UsageGroup) ([]UsageRow, error) {
+	defer observe("usage", "report", time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	if userID != "" {
+		ids = []string{userID}
+	} else {
+		entries, err := os.ReadDir(s.dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if id, ok := strings.CutSuffix(e.Name(), ".json"); ok && !e.IsDir() {
+				ids = append(ids, id)
+			}
+		}
+	}
+	rows := make(map[UsageRow]*Usage)
+	for _, id := range ids {
+		f, err := s.load(id)
+		if err != nil {
+			return nil, err
+		}
+		for model, days := range f.Models {
+			for day, u := range days {
+				if (from != "" && day < from) || (to != "" && day > to) {
+					continue
+				}
+				var key UsageRow
+				if group.User {
+					key.UserID = id
+				}
+				if group.Model {
+					key.Model = model
+				}
+				if group.Day {
+					key.Day = day
+				}
+				if rows[key] == nil {
+					rows[key] = &Usage{}
+				}
+				rows[key].add(*u)
+			}
+		}
+	}
+	report := make([]UsageRow, 0, len(rows))
+	for key, u := range rows {
+		key.Usage = *u
+		report = append(report, key)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		a, b := report[i], report[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.UserID != b.UserID {
+			return a.UserID < b.UserID
+		}
+		return a.Model < b.Model
+	})
+	return report, nil
+}
+
+// DeleteForUser removes the usage history of userID.
+func (s *UsageStore) DeleteForUser(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.files.remove(s.path(userID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
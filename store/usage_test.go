@@ -0,0 +1,122 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestUsageReport(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewUsageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(d int) time.Time { return time.Date(2026, 3, d, 12, 0, 0, 0, time.Local) }
+	gen := func(prompt, completion int) Usage {
+		return Usage{Requests: 1, PromptTokens: prompt, CompletionTokens: completion, EvalDuration: time.Second}
+	}
+	for _, r := range []struct {
+		user, model string
+		day         int
+		u           Usage
+	}{
+		{"alice", "llama3", 1, gen(10, 20)},
+		{"alice", "llama3", 1, gen(1, 2)},
+		{"alice", "gemma3", 2, gen(100, 200)},
+		{"bob", "llama3", 2, gen(1000, 2000)},
+		{"bob", "", 3, gen(5, 5)},
+		{"bob", "llama3", 28, gen(7, 7)},
+	} {
+		if err := s.Record(r.user, r.model, day(r.day), r.u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type row struct {
+		user, model, day string
+		requests, tokens int
+	}
+	report := func(userID, from, to string, group UsageGroup) []row {
+		t.Helper()
+		rows, err := s.Report(userID, from, to, group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []row
+		for _, r := range rows {
+			out = append(out, row{r.UserID, r.Model, r.Day, r.Requests, r.Tokens()})
+		}
+		return out
+	}
+
+	for _, tc := range []struct {
+		name         string
+		userID, from string
+		to           string
+		group        UsageGroup
+		want         []row
+	}{
+		{"everything", "", "", "", UsageGroup{}, []row{{"", "", "", 6, 3357}}},
+		{"by user", "", "", "", UsageGroup{User: true}, []row{
+			{"alice", "", "", 3, 333},
+			{"bob", "", "", 3, 3024},
+		}},
+		{"by model", "", "", "", UsageGroup{Model: true}, []row{
+			{"", "gemma3", "", 1, 300},
+			{"", "llama3", "", 4, 3047},
+			{"", unknownModel, "", 1, 10},
+		}},
+		{"by day, sorted first", "", "", "", UsageGroup{User: true, Day: true}, []row{
+			{"alice", "", "2026-03-01", 2, 33},
+			{"alice", "", "2026-03-02", 1, 300},
+			{"bob", "", "2026-03-02", 1, 3000},
+			{"bob", "", "2026-03-03", 1, 10},
+			{"bob", "", "2026-03-28", 1, 14},
+		}},
+		{"dates are inclusive", "", "2026-03-02", "2026-03-03", UsageGroup{Day: true}, []row{
+			{"", "", "2026-03-02", 2, 3300},
+			{"", "", "2026-03-03", 1, 10},
+		}},
+		{"one user", "alice", "", "", UsageGroup{Model: true}, []row{
+			{"", "gemma3", "", 1, 300},
+			{"", "llama3", "", 2, 33},
+		}},
+		{"nothing in range", "", "2027-01-01", "", UsageGroup{}, nil},
+		{"user without usage", "carol", "", "", UsageGroup{}, nil},
+	} {
+		if got := report(tc.userID, tc.from, tc.to, tc.group); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if u, err := s.Sum("alice", "2026-03"); err != nil || u.Tokens() != 333 || u.EvalDuration != 3*time.Second {
+		t.Errorf("month sum: %+v, %v", u, err)
+	}
+	if u, err := s.Sum("bob", "2026-03-02"); err != nil || u.Requests != 1 {
+		t.Errorf("day sum: %+v, %v", u, err)
+	}
+
+	// The file holds one layout: usage by model, then day.
+	b, err := os.ReadFile(filepath.Join(dir, "usage", "bob.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"models":{"llama3":{"2026-03-02":{"requests":1,"promptTokens":1000,"completionTokens":2000,"evalDuration":1000000000},` +
+		`"2026-03-28":{"requests":1,"promptTokens":7,"completionTokens":7,"evalDuration":1000000000}},` +
+		`"unknown":{"2026-03-03":{"requests":1,"promptTokens":5,"completionTokens":5,"evalDuration":1000000000}}}}`
+	if string(b) != want {
+		t.Errorf("usage file\n%s\nwant\n%s", b, want)
+	}
+
+	if err := s.DeleteForUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if got := report("", "", "", UsageGroup{User: true}); len(got) != 1 || got[0].user != "alice" {
+		t.Errorf("after deleting bob: %v", got)
+	}
+	if err := s.DeleteForUser("bob"); err != nil {
+		t.Errorf("deleting twice: %v", err)
+	}
+}
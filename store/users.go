@@ -1,23 +1,78 @@
 package store
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type User struct {
 	ID       string `json:"id"`
 	Username string `json:"username"`
 	Hash     string `json:"hash"`
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled,omitempty"`
+
+	// Source and ExternalID link accounts created or claimed through an
+	// external identity provider ("oidc"); Hash is empty for those created there.
+	Source     string `json:"source,omitempty"`
+	ExternalID string `json:"externalId,omitempty"`
+
+	TOTPSecret    string   `json:"totpSecret,omitempty"`
+	TOTPPending   string   `json:"totpPending,omitempty"` // secret awaiting first code
+	TOTPLastStep  int64    `json:"totpLastStep,omitempty"`
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"` // sha256 hashes
+}
+
+// IsAdmin reports whether the user has the admin role.
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// check reports a user record that layout 2 of the data directory does not
+// allow. Layout 1 files, written before roles existed, fail here until
+// migrated.
+func (u *User) check() error {
+	if u.Role == "" {
+		return fmt.Errorf("user %s has no role; the data directory needs upgrading with migrate", u.Username)
+	}
+	if u.Role != RoleUser && u.Role != RoleAdmin {
+		return fmt.Errorf("user %s: %w %q", u.Username, ErrInvalidRole, u.Role)
+	}
+	if (u.Source == "") != (u.ExternalID == "") {
+		return fmt.Errorf("user %s: identity source %q and ID %q must be set together", u.Username, u.Source, u.ExternalID)
+	}
+	return nil
+}
+
+// clone copies u for callers outside the store. The store changes its own
+// users under s.mu, so they must never be handed out.
+func (u *User) clone() *User {
+	if u == nil {
+		return nil
+	}
+	c := *u
+	c.RecoveryCodes = slices.Clone(u.RecoveryCodes)
+	return &c
 }
 
 type UserStore struct {
 	path string
+	files *files
 	mu   sync.RWMutex
 	byID map[string]*User
 	byName map[string]*User
@@ -27,10 +82,15 @@ func NewUserStore(dataDir string) (*UserStore, error) {
 	path := filepath.Join(dataDir, "users.json")
 	s := &UserStore{
 		path:   path,
+		files:  filesFor(dataDir),
 		byID:   make(map[string]*User),
 		byName: make(map[string]*User),
 	}
-	if err := s.load(); err != nil && !os.IsNotExist(err) {
+	err := s.load()
+	if os.IsNotExist(err) {
+		err = stampDataVersion(dataDir)
+	}
+	if err != nil {
 		return nil, err
 	}
 	return s, nil
@@ -45,6 +105,11 @@ func (s *UserStore) load() error {
 	if err := json.Unmarshal(data, &list); err != nil {
 		return err
 	}
+	for i := range list {
+		if err := list[i].check(); err != nil {
+			return fmt.Errorf("%s: %w", s.path, err)
+		}
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for i := range list {
@@ -71,19 +136,21 @@ func (s *UserStore) save() error {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return err
 	}
-	return os.WriteFile(s.path, data, 0600)
+	return s.files.write(s.path, data)
 }
 
+// ByID returns a copy of the user, or nil.
 func (s *UserStore) ByID(id string) *User {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.byID[id]
+	return s.byID[id].clone()
 }
 
+// ByUsername returns a copy of the user, or nil.
 func (s *UserStore) ByUsername(username string) *User {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.byName[username]
+	return s.byName[username].clone()
 }
 
 func (s *UserStore) Register(username, password string) (*User, error) {
@@ -103,9 +170,11 @@ func (s *UserStore) Register(username, password string) (*User, error) {
 		ID:       uuid.New().String(),
 		Username: username,
 		Hash:     string(hash),
+		Role:     RoleUser,
 	}
 	s.byID[u.ID] = u
 	s.byName[u.Username] = u
+	created := u.clone()
 	s.mu.Unlock()
 	if err := s.save(); err != nil {
 		s.mu.Lock()
@@ -114,16 +183,354 @@ func (s *UserStore) Register(username, password string) (*User, error) {
 		s.mu.Unlock()
 		return nil, err
 	}
-	return u, nil
+	return created, nil
+}
+
+// dummyHash is made at startup, so that the first login with an unknown
+// username takes no longer than later ones.
+var dummyHash = func() []byte {
+	h, err := bcrypt.GenerateFromPassword([]byte("chatlocal-dummy-password"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}()
+
+// compareDummy spends as long as a real password check so that unknown
+// usernames cannot be told apart from wrong passwords by timing.
+func compareDummy(password string) {
+	_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
 }
 
 func (s *UserStore) Login(username, password string) (*User, error) {
 	u := s.ByUsername(username)
 	if u == nil {
+		compareDummy(password)
 		return nil, ErrInvalidCredentials
 	}
 	if err := bcrypt.CompareHashAndPassword([]byte(u.Hash), []byte(password)); err != nil {
 		return nil, ErrInvalidCredentials
 	}
+	if u.Disabled {
+		return nil, ErrAccountDisabled
+	}
 	return u, nil
 }
+
+// LinkPolicy says which existing accounts External may link to an external
+// identity with the same username.
+type LinkPolicy int
+
+const (
+	// LinkNever refuses to link; the account must have been linked before.
+	LinkNever LinkPolicy = iota
+	// LinkPasswordless links only accounts without a local password, so a
+	// directory entry cannot take over an account that someone else set up.
+	LinkPasswordless
+	// LinkAny links any account not yet linked to another identity.
+	LinkAny
+)
+
+// canLink reports whether u already belongs to the identity, and otherwise
+// why it may not be linked to it.
+func canLink(u *User, source, externalID string, link LinkPolicy) (linked bool, err error) {
+	switch {
+	case u.ExternalID == externalID && u.Source == source:
+		return true, nil
+	case u.ExternalID != "":
+		return false, ErrIdentityMismatch
+	case link == LinkNever, link == LinkPasswordless && u.Hash != "":
+		return false, ErrNotLinked
+	}
+	return false, nil
+}
+
+// CheckLink returns the error External would, without changing anything:
+// nil if username is free, linked to the identity, or may be linked to it.
+func (s *UserStore) CheckLink(username, source, externalID string, link LinkPolicy) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u := s.byName[username]
+	if u == nil {
+		return nil
+	}
+	_, err := canLink(u, source, externalID, link)
+	return err
+}
+
+// External returns the user for an identity asserted by an external
+// provider. An existing account with the same username is linked on first
+// use if link allows it, and ErrNotLinked is returned otherwise. A new
+// account without a local password is created only if create is set.
+// Accounts already linked to a different identity are refused.
+func (s *UserStore) External(username, source, externalID string, create bool, link LinkPolicy) (u *User, created bool, err error) {
+	if username == "" || source == "" || externalID == "" {
+		return nil, false, ErrInvalidCredentials
+	}
+	s.mu.Lock()
+	u = s.byName[username]
+	if u != nil {
+		linked, err := canLink(u, source, externalID, link)
+		id := u.ID
+		s.mu.Unlock()
+		if err != nil {
+			return nil, false, err
+		}
+		if !linked {
+			err = s.update(id, func(u *User) {
+				u.Source = source
+				u.ExternalID = externalID
+			})
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		return s.ByID(id), false, nil
+	}
+	if !create {
+		s.mu.Unlock()
+		return nil, false, ErrUserNotFound
+	}
+	u = &User{
+		ID:         uuid.New().String(),
+		Username:   username,
+		Role:       RoleUser,
+		Source:     source,
+		ExternalID: externalID,
+	}
+	s.byID[u.ID] = u
+	s.byName[u.Username] = u
+	created = true
+	u = u.clone()
+	s.mu.Unlock()
+	if err := s.save(); err != nil {
+		s.mu.Lock()
+		delete(s.byID, u.ID)
+		delete(s.byName, u.Username)
+		s.mu.Unlock()
+		return nil, false, err
+	}
+	return u, created, nil
+}
+
+// List returns a snapshot of all users sorted by username.
+func (s *UserStore) List() []User {
+	s.mu.RLock()
+	list := make([]User, 0, len(s.byID))
+	for _, u := range s.byID {
+		list = append(list, *u)
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+// update applies fn to the user under the write lock and persists the
+// store, restoring the previous state if saving fails.
+func (s *UserStore) update(id string, fn func(u *User)) error {
+	s.mu.Lock()
+	u := s.byID[id]
+	if u == nil {
+		s.mu.Unlock()
+		return ErrUserNotFound
+	}
+	old := *u
+	fn(u)
+	s.mu.Unlock()
+	if err := s.save(); err != nil {
+		s.mu.Lock()
+		*u = old
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *UserStore) SetRole(id, role string) error {
+	if role != RoleUser && role != RoleAdmin {
+		return ErrInvalidRole
+	}
+	return s.update(id, func(u *User) { u.Role = role })
+}
+
+func (s *UserStore) SetDisabled(id string, disabled bool) error {
+	return s.update(id, func(u *User) { u.Disabled = disabled })
+}
+
+// IsDisabled reports whether the user is missing or disabled.
+func (s *UserStore) IsDisabled(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u := s.byID[id]
+	return u == nil || u.Disabled
+}
+
+// SetPassword replaces the password of the given user without checking the old one.
+func (s *UserStore) SetPassword(id, password string) error {
+	if len(password) < 1 {
+		return ErrInvalidCredentials
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return s.update(id, func(u *User) { u.Hash = string(hash) })
+}
+
+// CheckPassword reports ErrInvalidCredentials unless password matches the user's.
+func (s *UserStore) CheckPassword(id, password string) error {
+	u := s.ByID(id)
+	if u == nil {
+		return ErrUserNotFound
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Hash), []byte(password)); err != nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// ChangePassword sets a new password after verifying the current one.
+func (s *UserStore) ChangePassword(id, current, password string) error {
+	if err := s.CheckPassword(id, current); err != nil {
+		return err
+	}
+	return s.SetPassword(id, password)
+}
+
+// Delete removes the user from the store.
+func (s *UserStore) Delete(id string) error {
+	s.mu.Lock()
+	u := s.byID[id]
+	if u == nil {
+		s.mu.Unlock()
+		return ErrUserNotFound
+	}
+	delete(s.byID, u.ID)
+	delete(s.byName, u.Username)
+	s.mu.Unlock()
+	if err := s.save(); err != nil {
+		s.mu.Lock()
+		s.byID[u.ID] = u
+		s.byName[u.Username] = u
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// HasTOTP reports whether the user has two-factor authentication enabled.
+func (s *UserStore) HasTOTP(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u := s.byID[id]
+	return u != nil && u.TOTPSecret != ""
+}
+
+// TOTPStatus reports whether 2FA is enabled and how many recovery codes are left.
+func (s *UserStore) TOTPStatus(id string) (enabled bool, recoveryLeft int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u := s.byID[id]
+	if u == nil {
+		return false, 0
+	}
+	return u.TOTPSecret != "", len(u.RecoveryCodes)
+}
+
+// BeginTOTP generates a new secret that becomes active once ConfirmTOTP
+// sees a valid code for it.
+func (s *UserStore) BeginTOTP(id string) (secret string, err error) {
+	secret, err = newTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	err = s.update(id, func(u *User) { u.TOTPPending = secret })
+	return secret, err
+}
+
+// ConfirmTOTP enables the pending secret if code is valid for it and returns
+// fresh recovery codes. They are only stored hashed and cannot be shown again.
+func (s *UserStore) ConfirmTOTP(id, code string) ([]string, error) {
+	s.mu.RLock()
+	u := s.byID[id]
+	var pending string
+	if u != nil {
+		pending = u.TOTPPending
+	}
+	s.mu.RUnlock()
+	if u == nil {
+		return nil, ErrUserNotFound
+	}
+	if pending == "" {
+		return nil, ErrInvalidCode
+	}
+	step, ok := matchTOTP(pending, code, time.Now(), 0)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = s.update(id, func(u *User) {
+		u.TOTPSecret = pending
+		u.TOTPPending = ""
+		u.TOTPLastStep = step
+		u.RecoveryCodes = hashes
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off for the user.
+func (s *UserStore) DisableTOTP(id string) error {
+	return s.update(id, func(u *User) {
+		u.TOTPSecret = ""
+		u.TOTPPending = ""
+		u.TOTPLastStep = 0
+		u.RecoveryCodes = nil
+	})
+}
+
+// VerifySecondFactor accepts either a current TOTP code or an unused
+// recovery code, which is then consumed.
+func (s *UserStore) VerifySecondFactor(id, code string) error {
+	s.mu.Lock()
+	u := s.byID[id]
+	if u == nil {
+		s.mu.Unlock()
+		return ErrUserNotFound
+	}
+	if u.TOTPSecret == "" {
+		s.mu.Unlock()
+		return ErrInvalidCode
+	}
+	old := *u
+	ok := false
+	if step, match := matchTOTP(u.TOTPSecret, code, time.Now(), u.TOTPLastStep); match {
+		u.TOTPLastStep = step
+		ok = true
+	} else {
+		h := hashRecoveryCode(code)
+		for i, rc := range u.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(rc), []byte(h)) == 1 {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+				ok = true
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		return ErrInvalidCode
+	}
+	if err := s.save(); err != nil {
+		s.mu.Lock()
+		*u = old
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLookupsReturnCopies(t *testing.T) {
+	s, err := NewUserStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.Register("alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID, byName := s.ByID(u.ID), s.ByUsername(u.Username)
+	if err := s.SetRole(u.ID, RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetDisabled(u.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range []*User{u, byID, byName} {
+		if got.Role != RoleUser || got.Disabled {
+			t.Errorf("earlier lookup changed: role %q, disabled %v", got.Role, got.Disabled)
+		}
+	}
+	byID.Role = RoleAdmin
+	byID.Hash = ""
+	if now := s.ByID(u.ID); now.Role != RoleAdmin || !now.Disabled || now.Hash == "" {
+		t.Errorf("store state: %+v", now)
+	}
+}
+
+// TestConcurrentUpdates is meant for go test -race: lookups and the fields
+// callers read from them must not race with updates.
+func TestConcurrentUpdates(t *testing.T) {
+	s, err := NewUserStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.Register("alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for i := range 20 {
+			role := RoleUser
+			if i%2 == 0 {
+				role = RoleAdmin
+			}
+			if err := s.SetRole(u.ID, role); err != nil {
+				t.Error(err)
+			}
+			if err := s.SetDisabled(u.ID, i%2 == 0); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	wg.Go(func() {
+		for range 200 {
+			if got := s.ByID(u.ID); got.Role == "" || got.Hash == "" {
+				t.Error("incomplete user")
+			}
+			_ = s.ByUsername(u.Username).IsAdmin()
+		}
+	})
+	wg.Wait()
+}
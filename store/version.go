@@ -0,0 +1,148 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DataVersion is the layout of the data directory this code reads and
+// writes. A data directory without a VERSION file has layout 1, unless it
+// has no users.json either: then it is new, and gets the current layout
+// when its user store is created.
+//
+// Layout 2 stores every user's role in users.json. Layout 1 files predate
+// roles, disabled accounts, two-factor authentication and external
+// identities, or were written while those fields were optional.
+const DataVersion = 2
+
+const versionFile = "VERSION"
+
+// migration upgrades a data directory from layout from to from+1.
+type migration struct {
+	from int
+	desc string
+	run  func(dataDir string) error
+}
+
+// migrations lists the upgrades in order.
+var migrations = []migration{
+	{1, "give every user a role and check the account fields in users.json", migrateUsersV2},
+}
+
+// migrateUsersV2 fills in the fields layout 1 left out of users.json: a
+// missing role becomes "user", and two-factor state without a confirmed
+// secret is dropped. Accounts are not disabled and have no external
+// identity unless the file says so. A record that is still invalid stops
+// the migration, leaving the file as it was.
+func migrateUsersV2(dataDir string) error {
+	path := filepath.Join(dataDir, "users.json")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range list {
+		u := &list[i]
+		if u.Role == "" {
+			u.Role = RoleUser
+		}
+		if u.TOTPSecret == "" {
+			u.TOTPLastStep, u.RecoveryCodes = 0, nil
+		}
+		if err := u.check(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if data, err = json.MarshalIndent(list, "", "  "); err != nil {
+		return err
+	}
+	return filesFor(dataDir).write(path, data)
+}
+
+// ReadDataVersion returns the layout of dataDir.
+func ReadDataVersion(dataDir string) (int, error) {
+	b, err := os.ReadFile(filepath.Join(dataDir, versionFile))
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(dataDir, "users.json")); os.IsNotExist(err) {
+			return DataVersion, nil // a new directory
+		}
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("%s: bad data version %q", versionFile, strings.TrimSpace(string(b)))
+	}
+	return v, nil
+}
+
+func writeDataVersion(dataDir string, v int) error {
+	return filesFor(dataDir).write(filepath.Join(dataDir, versionFile), []byte(strconv.Itoa(v)+"\n"))
+}
+
+// stampDataVersion records the current layout in a data directory that has
+// no accounts and no VERSION file yet, so that a new directory does not
+// look like layout 1.
+func stampDataVersion(dataDir string) error {
+	if _, err := os.Stat(filepath.Join(dataDir, versionFile)); !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+	return writeDataVersion(dataDir, DataVersion)
+}
+
+// CheckDataVersion reports an error unless dataDir has the layout this
+// code expects.
+func CheckDataVersion(dataDir string) error {
+	v, err := ReadDataVersion(dataDir)
+	if err != nil {
+		return err
+	}
+	if v > DataVersion {
+		return fmt.Errorf("the data directory has layout %d, written by a newer chatlocal; this one knows layout %d", v, DataVersion)
+	}
+	if v < DataVersion {
+		return fmt.Errorf("the data directory has layout %d and needs upgrading to %d; run: chatlocal -data %s migrate", v, DataVersion, dataDir)
+	}
+	return nil
+}
+
+// Migrate upgrades dataDir to DataVersion, calling report before each
+// step, and returns the layout it started from. Each step records the new
+// layout when it is done, so a failed migration can be run again.
+func Migrate(dataDir string, report func(desc string)) (from int, err error) {
+	from, err = ReadDataVersion(dataDir)
+	if err != nil {
+		return 0, err
+	}
+	if from > DataVersion {
+		return from, CheckDataVersion(dataDir)
+	}
+	for _, m := range migrations {
+		if m.from < from {
+			continue
+		}
+		report(fmt.Sprintf("%d -> %d: %s", m.from, m.from+1, m.desc))
+		if err := m.run(dataDir); err != nil {
+			return from, fmt.Errorf("migrate %d -> %d: %w", m.from, m.from+1, err)
+		}
+		if err := writeDataVersion(dataDir, m.from+1); err != nil {
+			return from, err
+		}
+	}
+	return from, writeDataVersion(dataDir, DataVersion)
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// layout1Users is users.json as layout 1 left it: accounts from before
+// roles existed, and fields that were optional then.
+const layout1Users = `[
+  {"id": "1", "username": "old@example.com", "hash": "$2a$10$abcdefghijklmnopqrstuu"},
+  {"id": "2", "username": "admin@example.com", "hash": "x", "role": "admin"},
+  {"id": "3", "username": "sso@example.com", "hash": "", "source": "oidc", "externalId": "sub-3", "disabled": true},
+  {"id": "4", "username": "stale@example.com", "hash": "x", "totpPending": "ABC", "totpLastStep": 7, "recoveryCodes": ["h"]}
+]`
+
+func TestMigrateUsers(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "users.json"), []byte(layout1Users), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ReadDataVersion(dir); v != 1 || err != nil {
+		t.Fatalf("layout %d, %v; want 1", v, err)
+	}
+	if err := CheckDataVersion(dir); err == nil || !strings.Contains(err.Error(), "migrate") {
+		t.Errorf("CheckDataVersion: %v", err)
+	}
+	if _, err := NewUserStore(dir); err == nil || !strings.Contains(err.Error(), "no role") {
+		t.Errorf("NewUserStore before migrating: %v", err)
+	}
+
+	var steps []string
+	from, err := Migrate(dir, func(desc string) { steps = append(steps, desc) })
+	if err != nil || from != 1 || len(steps) != 1 {
+		t.Fatalf("Migrate: from %d, steps %q, %v", from, steps, err)
+	}
+	if err := CheckDataVersion(dir); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]User{
+		"old@example.com":   {Role: RoleUser},
+		"admin@example.com": {Role: RoleAdmin},
+		"sso@example.com":   {Role: RoleUser, Disabled: true, Source: "oidc", ExternalID: "sub-3"},
+		"stale@example.com": {Role: RoleUser, TOTPPending: "ABC"},
+	} {
+		u := s.ByUsername(name)
+		if u.Role != want.Role || u.Disabled != want.Disabled || u.Source != want.Source || u.ExternalID != want.ExternalID ||
+			u.TOTPPending != want.TOTPPending || u.TOTPLastStep != 0 || len(u.RecoveryCodes) != 0 {
+			t.Errorf("%s: %+v", name, u)
+		}
+	}
+
+	if from, err := Migrate(dir, func(string) { t.Error("migrated twice") }); from != DataVersion || err != nil {
+		t.Errorf("second Migrate: from %d, %v", from, err)
+	}
+}
+
+func TestMigrateStopsOnInvalidUser(t *testing.T) {
+	dir := t.TempDir()
+	bad := `[{"id": "1", "username": "a@example.com", "hash": "x", "role": "owner"}]`
+	if err := os.WriteFile(filepath.Join(dir, "users.json"), []byte(bad), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Migrate(dir, func(string) {}); err == nil {
+		t.Fatal("migrated an unknown role")
+	}
+	if v, _ := ReadDataVersion(dir); v != 1 {
+		t.Errorf("layout %d after a failed migration, want 1", v)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "users.json")); string(b) != bad {
+		t.Errorf("users.json changed: %s", b)
+	}
+}
+
+func TestNewDataDirectoryHasCurrentLayout(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := CheckDataVersion(dir); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Register("alice@example.com", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ReadDataVersion(dir); v != DataVersion || err != nil {
+		t.Errorf("layout %d, %v; want %d", v, err, DataVersion)
+	}
+}
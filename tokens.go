@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+const maxTokenNameLen = 64
+
+// maxTokenDays bounds expiresInDays, so the lifetime cannot overflow.
+const maxTokenDays = 3650
+
+// tokensHandler serves /account/tokens (list, create) and
+// /account/tokens/{id} (revoke). Token secrets are only returned on creation.
+func tokensHandler(tokens *store.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := store.UserIDFromContext(r.Context())
+		if userID == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		if path == "/account/tokens" {
+			switch r.Method {
+			case http.MethodGet:
+				list, err := tokens.List(userID)
+				if err != nil {
+					slog.ErrorContext(r.Context(), "tokens list", "err", err)
+					http.Error(w, "internal error", http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{"tokens": list})
+			case http.MethodPost:
+				var body struct {
+					Name          string   `json:"name"`
+					Scopes        []string `json:"scopes"`
+					ExpiresInDays int      `json:"expiresInDays"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					http.Error(w, "bad request", http.StatusBadRequest)
+					return
+				}
+				name := strings.TrimSpace(body.Name)
+				if name == "" || utf8.RuneCountInString(name) > maxTokenNameLen {
+					jsonError(w, http.StatusBadRequest, "name is required and must be at most 64 characters")
+					return
+				}
+				if len(body.Scopes) == 0 {
+					body.Scopes = []string{store.ScopeRead, store.ScopePrompt}
+				}
+				for _, s := range body.Scopes {
+					if !store.ValidScope(s) {
+						jsonError(w, http.StatusBadRequest, "unknown scope "+s+"; use read, write or prompt")
+						return
+					}
+				}
+				if body.ExpiresInDays < 0 || body.ExpiresInDays > maxTokenDays {
+					jsonError(w, http.StatusBadRequest, "expiresInDays must be between 0 (never) and 3650")
+					return
+				}
+				t, secret, err := tokens.Create(userID, name, body.Scopes, time.Duration(body.ExpiresInDays)*24*time.Hour)
+				if err != nil {
+					slog.ErrorContext(r.Context(), "tokens create", "err", err)
+					http.Error(w, "internal error", http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(map[string]interface{}{"token": secret, "info": t})
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		id := strings.TrimPrefix(path, "/account/tokens/")
+		if id == path || id == "" || strings.Contains(id, "/") {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := tokens.Revoke(userID, id); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			slog.ErrorContext(r.Context(), "tokens revoke", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+func TestCreateTokenExpiry(t *testing.T) {
+	tokens, err := store.NewTokenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := tokensHandler(tokens)
+	for _, tc := range []struct {
+		days string
+		want int
+	}{
+		{"0", http.StatusCreated},
+		{"90", http.StatusCreated},
+		{"3650", http.StatusCreated},
+		{"3651", http.StatusBadRequest},
+		{"200000", http.StatusBadRequest},
+		{"-1", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/account/tokens", strings.NewReader(`{"name":"script","expiresInDays":`+tc.days+`}`))
+		req = req.WithContext(store.ContextWithUserID(req.Context(), "u"))
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("expiresInDays %s: status %d, want %d", tc.days, rec.Code, tc.want)
+		}
+	}
+	list, err := tokens.List("u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("%d tokens created, want 3", len(list))
+	}
+	for _, tok := range list {
+		if !tok.ExpiresAt.IsZero() && tok.ExpiresAt.Before(tok.CreatedAt) {
+			t.Errorf("token expires at %s, before it was created", tok.ExpiresAt)
+		}
+	}
+}
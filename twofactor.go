@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/agerasimovski/chatlocal/qr"
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+const totpIssuer = "chatlocal"
+
+// need2FA blocks users without two-factor authentication from h while
+// -require-2fa is set. Pages redirect to the enrollment page; API calls get 403.
+func need2FA(users *store.UserStore, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if current().Require2FA && !users.HasTOTP(store.UserIDFromContext(r.Context())) {
+			if r.Method == http.MethodGet && r.URL.Path == "/" {
+				http.Redirect(w, r, "/2fa", http.StatusFound)
+				return
+			}
+			jsonError(w, http.StatusForbidden, "two-factor authentication must be enabled first")
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+// login2FAHandler completes a login that loginHandler left pending.
+func login2FAHandler(users *store.UserStore, sessions *store.SessionStore, pending *store.PendingLogins, throttle *store.LoginThrottle) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			PendingToken string `json:"pendingToken"`
+			Code         string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		userID, ok := pending.Lookup(body.PendingToken)
+		if !ok {
+			http.Error(w, "login expired, please log in again", http.StatusUnauthorized)
+			return
+		}
+		key := "2fa:" + userID
+		if wait := throttle.Reserve(key); wait > 0 {
+			pending.Delete(body.PendingToken)
+			http.Error(w, "too many failed attempts, please log in again later", http.StatusTooManyRequests)
+			return
+		}
+		if err := users.VerifySecondFactor(userID, body.Code); err != nil {
+			if err != store.ErrInvalidCode {
+				throttle.Refund(key)
+				slog.ErrorContext(r.Context(), "verify 2fa", "err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			pending.Fail(body.PendingToken)
+			http.Error(w, "invalid code", http.StatusUnauthorized)
+			return
+		}
+		throttle.Succeed(key)
+		pending.Delete(body.PendingToken)
+		u := users.ByID(userID)
+		if u == nil {
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		if !startSession(w, r, sessions, userID) {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"username": u.Username})
+	}
+}
+
+func twoFactorPageHandler(w http.ResponseWriter, r *http.Request) {
+	ui.render(w, r, "twofactor.html", nil)
+}
+
+// account2FAHandler serves /account/2fa and its setup, enable and disable
+// actions. Enabling ends the user's other sessions, which were opened with
+// the password alone. Disabling is confirmed as confirmIdentity describes.
+func account2FAHandler(users *store.UserStore, sessions *store.SessionStore, throttle *store.LoginThrottle) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := store.UserIDFromContext(r.Context())
+		u := users.ByID(userID)
+		if u == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		action := strings.TrimPrefix(strings.TrimSuffix(r.URL.Path, "/"), "/account/2fa")
+		if action == "" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			enabled, left := users.TOTPStatus(userID)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"enabled":           enabled,
+				"required":          current().Require2FA,
+				"recoveryCodesLeft": left,
+				"passwordless":      u.Source != "",
+			})
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			Code     string `json:"code"`
+			Password string `json:"password"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+		}
+		switch action {
+		case "/setup":
+			if users.HasTOTP(userID) {
+				jsonError(w, http.StatusConflict, "two-factor authentication is already enabled")
+				return
+			}
+			secret, err := users.BeginTOTP(userID)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "2fa setup", "err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			uri := store.TOTPURI(totpIssuer, u.Username, secret)
+			code, err := qr.Encode(uri)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "2fa setup", "err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"secret": secret,
+				"uri":    uri,
+				"qr":     code.DataURL(4),
+			})
+		case "/enable":
+			codes, err := users.ConfirmTOTP(userID, body.Code)
+			if err != nil {
+				if err == store.ErrInvalidCode {
+					jsonError(w, http.StatusBadRequest, "code does not match, check the time on your device and try again")
+					return
+				}
+				slog.ErrorContext(r.Context(), "2fa enable", "err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			var current string
+			if c, err := r.Cookie(store.SessionCookieName); err == nil {
+				current = c.Value
+			}
+			if n, err := sessions.DeleteForUserExcept(userID, current); err != nil {
+				slog.ErrorContext(r.Context(), "revoke sessions", "err", err)
+			} else {
+				slog.InfoContext(r.Context(), "2fa enabled", "user", userID, "sessions_revoked", n)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"recoveryCodes": codes})
+		case "/disable":
+			if current().Require2FA {
+				jsonError(w, http.StatusForbidden, "two-factor authentication is required on this server")
+				return
+			}
+			if !confirmIdentity(w, r, users, sessions, throttle, u, body.Password, body.Code) {
+				return
+			}
+			if err := users.DisableTOTP(userID); err != nil {
+				slog.ErrorContext(r.Context(), "2fa disable", "err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agerasimovski/chatlocal/store"
+)
+
+func TestEnable2FARevokesOtherSessions(t *testing.T) {
+	useSettings(t, nil)
+	dir := t.TempDir()
+	users, err := store.NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := store.NewSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := store.NewTokenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := users.Register("alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := sessions.Create(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := sessions.Create(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := store.RequireAuth(users, sessions, tokens, account2FAHandler(users, sessions, store.NewLoginThrottle()))
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: store.SessionCookieName, Value: current})
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	rec := post("/account/2fa/setup", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("setup: status %d: %s", rec.Code, rec.Body)
+	}
+	var setup struct{ Secret, URI, QR string }
+	if err := json.NewDecoder(rec.Body).Decode(&setup); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(setup.QR, "data:image/png;base64,") {
+		t.Errorf("qr is %.40q, want a PNG data URL", setup.QR)
+	}
+	if _, ok := sessions.Get(other); !ok {
+		t.Fatal("setup alone ended the other session")
+	}
+
+	rec = post("/account/2fa/enable", `{"code":"`+totp(t, setup.Secret, time.Now())+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("enable: status %d: %s", rec.Code, rec.Body)
+	}
+	if _, ok := sessions.Get(current); !ok {
+		t.Error("the session that enabled 2FA was ended")
+	}
+	if _, ok := sessions.Get(other); ok {
+		t.Error("other session still valid")
+	}
+}
+
+func TestRequire2FAFollowsSettings(t *testing.T) {
+	users, err := store.NewUserStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := users.Register("alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := need2FA(users, func(w http.ResponseWriter, r *http.Request) {})
+	for _, require := range []string{"true", "false"} {
+		useSettings(t, map[string]string{"require-2fa": require})
+		req := httptest.NewRequest(http.MethodGet, "/chats", nil)
+		req = req.WithContext(store.ContextWithUserID(req.Context(), u.ID))
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if want := map[string]int{"true": http.StatusForbidden, "false": http.StatusOK}[require]; rec.Code != want {
+			t.Errorf("-require-2fa=%s: status %d, want %d", require, rec.Code, want)
+		}
+	}
+	if !reloadable["require-2fa"] {
+		t.Error("-require-2fa is not reloadable")
+	}
+}
+
+func TestDisable2FAConfirmation(t *testing.T) {
+	useSettings(t, nil)
+	dir := t.TempDir()
+	users, err := store.NewUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := store.NewSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := store.NewTokenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := store.RequireAuth(users, sessions, tokens, account2FAHandler(users, sessions, store.NewLoginThrottle()))
+	enable := func(u *store.User) string {
+		t.Helper()
+		secret, err := users.BeginTOTP(u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := users.ConfirmTOTP(u.ID, totp(t, secret, time.Now().Add(-30*time.Second))); err != nil {
+			t.Fatal(err)
+		}
+		return secret
+	}
+	disable := func(u *store.User, body string) int {
+		t.Helper()
+		sid, err := sessions.Create(u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/account/2fa/disable", strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: store.SessionCookieName, Value: sid})
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+
+	local, err := users.Register("alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enable(local)
+	if code := disable(local, `{"password":"wrong"}`); code != http.StatusForbidden {
+		t.Errorf("local, wrong password: status %d", code)
+	}
+	if code := disable(local, `{"password":"correct horse battery"}`); code != http.StatusNoContent || users.HasTOTP(local.ID) {
+		t.Errorf("local, right password: status %d", code)
+	}
+
+	sso, _, err := users.External("bob@example.com", "oidc", "sub-bob", true, store.LinkNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := enable(sso)
+	if code := disable(sso, `{"password":""}`); code != http.StatusForbidden {
+		t.Errorf("SSO, no code: status %d", code)
+	}
+	if code := disable(sso, `{"code":"`+totp(t, secret, time.Now())+`"}`); code != http.StatusNoContent || users.HasTOTP(sso.ID) {
+		t.Errorf("SSO, right code: status %d", code)
+	}
+}